@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 本地管理接口，只读，供 ffmesh services 等命令查询运行中的节点
+const ADMIN_REQUEST_TIMEOUT = 5 * time.Second
+
+func admin_main(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", admin_services)
+	fmt.Printf("🛠️  管理接口: http://%s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("⚠️  启动管理接口失败: %v\n", err)
+	}
+}
+
+func admin_services(w http.ResponseWriter, r *http.Request) {
+	views := fm.services.list()
+	if views == nil {
+		views = []service_view{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+const services_usage = `用法:
+  ffmesh services [--config config.yaml] [--admin 127.0.0.1:7070]
+`
+
+// ffmesh services 子命令：查询运行中节点的服务目录
+func services_main(args []string) error {
+	fs := flag.NewFlagSet("services", flag.ContinueOnError)
+	config_file := fs.String("config", "config.yaml", "节点配置文件，用于读取管理接口地址")
+	addr := fs.String("admin", "", "管理接口地址，默认使用配置文件中的admin")
+	fs.Usage = func() { fmt.Print(services_usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" {
+		// 只读取admin字段，不做完整的配置加载（避免生成节点ID、密钥等副作用）
+		data, err := ioutil.ReadFile(*config_file)
+		if err != nil {
+			return fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		var config Config
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("解析配置文件失败: %v", err)
+		}
+		if config.Admin == "" {
+			return errors.New("配置文件中没有admin，请用 --admin 指定管理接口地址")
+		}
+		*addr = config.Admin
+	}
+
+	views, err := fetch_services(*addr)
+	if err != nil {
+		return err
+	}
+	print_services(views)
+	return nil
+}
+
+func fetch_services(addr string) ([]service_view, error) {
+	client := &http.Client{Timeout: ADMIN_REQUEST_TIMEOUT}
+	resp, err := client.Get("http://" + addr + "/services")
+	if err != nil {
+		return nil, fmt.Errorf("查询管理接口失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("查询管理接口失败: %s", resp.Status)
+	}
+	var views []service_view
+	if err := json.NewDecoder(resp.Body).Decode(&views); err != nil {
+		return nil, fmt.Errorf("解析服务目录失败: %v", err)
+	}
+	return views, nil
+}
+
+func print_services(views []service_view) {
+	if len(views) == 0 {
+		fmt.Println("没有发现任何服务")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "服务\t节点\t健康\t开销")
+	for _, v := range views {
+		health := "✅"
+		if !v.Healthy {
+			health = "❌"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", v.Service, v.NodeID, health, v.Cost)
+	}
+	w.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 组网密钥认证：双方用共享密钥对本连接的挑战值（见identity.go）计算HMAC
+// 连接方在SYN_MSG中证明自己知道密钥，监听方在SYN_ACK_MSG中证明自己知道密钥
+const (
+	AUTH_ROLE_SYN     = "ffmesh auth syn_msg"
+	AUTH_ROLE_SYN_ACK = "ffmesh auth syn_ack_msg"
+	MIN_SECRET_LEN    = 16 // 组网密钥最短长度
+)
+
+var errNoAuth = errors.New("对端没有提供认证信息")
+
+// 计算认证码，未配置密钥时返回空
+func mesh_auth(conn quic.Connection, secret string, role string, node_id string) []byte {
+	if secret == "" {
+		return nil
+	}
+	challenge, err := identity_challenge(conn, role, node_id)
+	if err != nil {
+		fmt.Printf("⚠️  计算认证码失败: %v\n", err)
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// 校验对端的认证码，未配置密钥时不校验
+func check_mesh_auth(conn quic.Connection, secret string, role string, node_id string, auth []byte) error {
+	if secret == "" {
+		return nil
+	}
+	if len(auth) == 0 {
+		return errNoAuth
+	}
+	expected := mesh_auth(conn, secret, role, node_id)
+	if expected == nil || !hmac.Equal(auth, expected) {
+		return errors.New("组网密钥不匹配")
+	}
+	return nil
+}
+
+// 记录认证失败
+func auth_failed(stage string, conn quic.Connection, node_id string, err error) {
+	fm.metrics.inc("auth_failed." + stage)
+	fmt.Printf("🚫 认证失败 [%s] %s (%s): %v\n", stage, node_id, conn.RemoteAddr(), err)
+}
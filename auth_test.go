@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamSecret(t *testing.T) {
+	q := QuicConfig{
+		Secret: "mesh-secret-0123456789",
+		Upstreams: []UpstreamConfig{
+			{Name: "a", NodeID: "up-a", Address: "127.0.0.1:1", Secret: "upstream-secret-0123"},
+			{Name: "b", NodeID: "up-b", Address: "127.0.0.1:2"},
+		},
+	}
+	if q.GetUpstreamSecret("up-a") != "upstream-secret-0123" || q.GetUpstreamSecret("up-b") != q.Secret {
+		t.Error("上级节点密钥选择不正确")
+	}
+	config := &Config{NodeID: "auth-node-1", Quic: QuicConfig{Secret: "short"}}
+	if err := validateConfig(config); err == nil {
+		t.Error("过短的组网密钥应该被拒绝")
+	}
+}
+
+func TestMeshSecretHandshake(t *testing.T) {
+	setup_test_node()
+
+	const secret = "test-mesh-secret-0123"
+	fm.config.Quic.Secret = secret
+	defer func() { fm.config.Quic.Secret = "" }()
+
+	handshake := func(node_id string, secret string) (*test_peer, map[string]interface{}) {
+		p := dial_test_peer_conn(t, node_id)
+		p.send(MSG_TYPE_SYN_MSG, SynMsgMessage{
+			Version:      VERSION,
+			MinVersion:   MIN_VERSION,
+			Capabilities: CAPABILITIES &^ CAP_CODEC_CBOR,
+			NodeID:       node_id,
+			Auth:         mesh_auth(p.conn, secret, AUTH_ROLE_SYN, node_id),
+		})
+		ack := p.read()
+		if ack == nil {
+			t.Fatalf("没有收到握手回复: %s", node_id)
+		}
+		return p, ack.Data.(map[string]interface{})
+	}
+
+	before := fm.metrics.get("auth_failed.syn_msg")
+	for _, c := range []struct{ node_id, secret string }{
+		{"auth-none-1", ""},
+		{"auth-wrong-1", "wrong-mesh-secret-0123"},
+	} {
+		p, ack := handshake(c.node_id, c.secret)
+		p.close()
+		if ack["result"].(bool) || !strings.Contains(ack["reason"].(string), "authentication failed") {
+			t.Errorf("%s应该被拒绝: %v", c.node_id, ack)
+		}
+		if fm.peers.get(c.node_id) != nil {
+			t.Errorf("%s不应该被注册", c.node_id)
+		}
+	}
+	if fm.metrics.get("auth_failed.syn_msg") != before+2 {
+		t.Error("没有统计认证失败次数")
+	}
+
+	p, ack := handshake("auth-ok-1", secret)
+	defer p.close()
+	if !ack["result"].(bool) {
+		t.Fatalf("密钥正确应该握手成功: %v", ack)
+	}
+	auth, _ := base64.StdEncoding.DecodeString(ack["auth"].(string))
+	if err := check_mesh_auth(p.conn, secret, AUTH_ROLE_SYN_ACK, fm.config.NodeID, auth); err != nil {
+		t.Errorf("监听节点的认证码不正确: %v", err)
+	}
+}
+
+// 数据通道只能开在已经注册的连接上，并且声称的上一跳必须是该连接注册的节点
+func TestDataChannelUnauthenticated(t *testing.T) {
+	setup_test_node()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	dialed := make(chan bool, 2)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- true
+			conn.Close()
+		}
+	}()
+
+	refused := func(p *test_peer) bool {
+		reply := p.open_data(t, SynDataMessage{
+			NodeID:        p.node_id,
+			TargetID:      fm.config.NodeID,
+			TargetTcpAddr: backend.Addr().String(),
+			HopLimit:      5,
+			Path:          []string{p.node_id},
+		})
+		return reply != nil && reply.Type == MSG_TYPE_ERROR && int(reply.Data.(map[string]interface{})["code"].(float64)) == ERR_CODE_REFUSED_BY_ACL
+	}
+
+	before := fm.metrics.get("auth_failed.syn_data")
+	// 没有发送消息通道握手，直接打开数据通道
+	raw := dial_test_peer_conn(t, "auth-raw-1")
+	defer raw.close()
+	if !refused(raw) {
+		t.Error("没有完成握手的连接打开数据通道应该被拒绝")
+	}
+
+	// 已注册的节点冒充其他节点
+	peer := dial_test_peer(t, "auth-data-1")
+	defer peer.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(peer.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+	if !refused(&test_peer{node_id: "auth-other-1", conn: peer.conn}) {
+		t.Error("声称的上一跳与连接注册的节点不一致时应该被拒绝")
+	}
+	if fm.metrics.get("auth_failed.syn_data") != before+2 {
+		t.Error("没有统计数据通道认证失败")
+	}
+	select {
+	case <-dialed:
+		t.Error("被拒绝的数据通道不应该连接目标地址")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if refused(peer) {
+		t.Error("已注册的节点应该可以打开数据通道")
+	}
+}
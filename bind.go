@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 绑定地址：IPv4地址只监听IPv4，IPv6地址只监听IPv6（:: 不接受IPv4连接），* 为所有地址（IPv4和IPv6双栈）
+// 配置中可以写一个地址或地址列表
+const (
+	BIND_ALL = "*"
+)
+
+var (
+	BIND_LOOPBACK = bind_list{"127.0.0.1", "::1"} // 代理默认只监听本机
+	BIND_DEFAULT  = bind_list{BIND_ALL}           // QUIC默认监听所有地址
+)
+
+type bind_list []string
+
+func (b *bind_list) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*b = bind_list{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*b = list
+	return nil
+}
+
+func (b bind_list) MarshalYAML() (interface{}, error) {
+	if len(b) == 1 {
+		return b[0], nil
+	}
+	return []string(b), nil
+}
+
+// 检查绑定地址：IP地址或 *，不能重复
+func (b bind_list) validate() error {
+	seen := make(map[string]bool)
+	for _, bind := range b {
+		if bind != BIND_ALL && net.ParseIP(bind) == nil {
+			return fmt.Errorf("绑定地址应该是IP地址或*: %q", bind)
+		}
+		if seen[bind] {
+			return fmt.Errorf("绑定地址重复: %s", bind)
+		}
+		seen[bind] = true
+	}
+	return nil
+}
+
+// 没有配置时使用默认地址
+func (b bind_list) or(def bind_list) bind_list {
+	if len(b) == 0 {
+		return def
+	}
+	return b
+}
+
+// 每个绑定地址加上端口，用于日志
+func (b bind_list) format(port string) string {
+	addrs := make([]string, len(b))
+	for i, bind := range b {
+		addrs[i] = net.JoinHostPort(bind, port)
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// 两组绑定地址是否有重叠
+func (b bind_list) overlaps(other bind_list) bool {
+	for _, x := range b {
+		for _, y := range other {
+			if bind_overlap(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 两个绑定地址是否会监听同一个地址：相同地址，或者同一地址族中有一个是所有地址
+func bind_overlap(a string, b string) bool {
+	if a == BIND_ALL || b == BIND_ALL {
+		return true
+	}
+	ip_a, ip_b := net.ParseIP(a), net.ParseIP(b)
+	if (ip_a.To4() != nil) != (ip_b.To4() != nil) {
+		return false
+	}
+	return ip_a.IsUnspecified() || ip_b.IsUnspecified() || ip_a.Equal(ip_b)
+}
+
+// 代理使用默认的回环地址时，本机没有IPv6可以跳过 ::1
+func (p *ProxyConfig) optional_bind(bind string) bool {
+	return len(p.Bind) == 0 && net.ParseIP(bind).To4() == nil
+}
+
+// 绑定地址对应的监听网络和地址，network 为 tcp 或 udp
+func bind_network(network string, bind string, port int) (string, string) {
+	if bind == BIND_ALL {
+		return network, fmt.Sprintf(":%d", port)
+	}
+	if net.ParseIP(bind).To4() != nil {
+		network += "4"
+	} else {
+		network += "6"
+	}
+	return network, net.JoinHostPort(bind, strconv.Itoa(port))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBindList(t *testing.T) {
+	var c struct {
+		One  bind_list `yaml:"one"`
+		Many bind_list `yaml:"many"`
+	}
+	if err := yaml.Unmarshal([]byte("one: \"::\"\nmany: [\"127.0.0.1\", \"*\"]\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.One) != 1 || c.One[0] != "::" || len(c.Many) != 2 || c.Many[1] != BIND_ALL {
+		t.Errorf("解析绑定地址不正确: %v %v", c.One, c.Many)
+	}
+	data, _ := yaml.Marshal(c)
+	if !strings.Contains(string(data), "one: '::'") {
+		t.Errorf("单个地址应该保存为字符串: %s", data)
+	}
+
+	for _, bad := range []bind_list{{"localhost"}, {"127.0.0.1", "127.0.0.1"}, {""}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("%v 应该无效", bad)
+		}
+	}
+
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"0.0.0.0", "127.0.0.1", true},
+		{"::", "127.0.0.1", false},
+		{"::", "0.0.0.0", false},
+		{"::", "::1", true},
+		{"*", "::1", true},
+		{"*", "10.0.0.1", true},
+	} {
+		if got := bind_overlap(c.a, c.b); got != c.want {
+			t.Errorf("%s 与 %s 重叠=%v, 期望 %v", c.a, c.b, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		bind, network, addr string
+	}{
+		{"*", "tcp", ":80"},
+		{"0.0.0.0", "tcp4", "0.0.0.0:80"},
+		{"::", "tcp6", "[::]:80"},
+		{"192.168.1.10", "tcp4", "192.168.1.10:80"},
+	} {
+		if network, addr := bind_network(PROTO_TCP, c.bind, 80); network != c.network || addr != c.addr {
+			t.Errorf("%s 监听地址不正确: %s %s", c.bind, network, addr)
+		}
+	}
+}
+
+// 代理默认只监听本机
+func TestProxyBind(t *testing.T) {
+	proxy := ProxyConfig{Name: "local", TargetNodeID: "n", TargetAddress: "127.0.0.1:1"}
+	listeners, err := tcp_proxy_listen(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		defer l.Close()
+		if ip := l.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("默认应该只监听本机: %s", l.Addr())
+		}
+	}
+	if len(listeners) == 0 || listeners[0].Addr().(*net.TCPAddr).IP.To4() == nil {
+		t.Fatalf("应该监听127.0.0.1: %v", listeners)
+	}
+
+	config := &Config{NodeID: "bind-node1", Proxies: []ProxyConfig{
+		{Name: "a", LocalPort: 8080, TargetNodeID: "n", TargetAddress: "10.0.0.1:80"},
+		{Name: "b", LocalPort: 8080, Bind: bind_list{"192.168.1.10"}, TargetNodeID: "n", TargetAddress: "10.0.0.2:80"},
+	}}
+	if err := validateConfig(config); err != nil {
+		t.Errorf("本机和其他地址的相同端口不冲突: %v", err)
+	}
+	if got := config.Proxies[0].ListenAddr(); got != "127.0.0.1:8080, [::1]:8080" {
+		t.Errorf("默认监听地址不正确: %s", got)
+	}
+	config.Proxies[1].Bind = bind_list{BIND_ALL}
+	if err := validateConfig(config); err == nil {
+		t.Error("监听所有地址和本机的相同端口应该冲突")
+	}
+
+	config.Proxies = nil
+	config.Quic.Bind = bind_list{"localhost"}
+	if err := validateConfig(config); err == nil {
+		t.Error("QUIC bind应该只接受IP地址或*")
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 组网CA目录中的文件
+const (
+	CA_CERT_FILE = "ca.crt"
+	CA_KEY_FILE  = "ca.key"
+	CA_CRL_FILE  = "crl.pem"
+)
+
+const (
+	CA_VALID_DAYS       = 10 * 365
+	NODE_VALID_DAYS     = 365
+	CRL_VALID_DAYS      = 365
+	CRL_RELOAD_INTERVAL = 30 * time.Second // 监听节点检查吊销列表文件是否变化的间隔
+)
+
+const ca_usage = `用法:
+  ffmesh ca init   [--dir ./ca] [--days 3650]
+  ffmesh ca issue  --node-id <节点ID> [--dir ./ca] [--out .] [--days 365]
+  ffmesh ca revoke (--cert <证书文件> | --serial <序列号>) [--dir ./ca]
+`
+
+// ffmesh ca 子命令
+func ca_main(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(ca_usage)
+		return errors.New("缺少子命令")
+	}
+	switch args[0] {
+	case "init":
+		fs := flag.NewFlagSet("ca init", flag.ContinueOnError)
+		dir := fs.String("dir", "./ca", "CA目录")
+		days := fs.Int("days", CA_VALID_DAYS, "CA证书有效天数")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return ca_init(*dir, *days)
+	case "issue":
+		fs := flag.NewFlagSet("ca issue", flag.ContinueOnError)
+		dir := fs.String("dir", "./ca", "CA目录")
+		node_id := fs.String("node-id", "", "节点ID")
+		out := fs.String("out", ".", "证书输出目录")
+		days := fs.Int("days", NODE_VALID_DAYS, "节点证书有效天数")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *node_id == "" {
+			return errors.New("必须指定 --node-id")
+		}
+		_, err := ca_issue(*dir, *node_id, *out, *days)
+		return err
+	case "revoke":
+		fs := flag.NewFlagSet("ca revoke", flag.ContinueOnError)
+		dir := fs.String("dir", "./ca", "CA目录")
+		cert := fs.String("cert", "", "要吊销的证书文件")
+		serial := fs.String("serial", "", "要吊销的证书序列号（十六进制）")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return ca_revoke(*dir, *cert, *serial)
+	default:
+		fmt.Print(ca_usage)
+		return fmt.Errorf("未知的子命令: %s", args[0])
+	}
+}
+
+// 创建CA证书、私钥和空的吊销列表
+func ca_init(dir string, days int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := new_cert_template("FFMesh CA", time.Duration(days)*24*time.Hour)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	// 私钥已存在时不覆盖，避免误操作导致已签发的证书全部失效
+	if err := write_private_key(filepath.Join(dir, CA_KEY_FILE), key, false); err != nil {
+		return err
+	}
+	if err := write_pem_file(filepath.Join(dir, CA_CERT_FILE), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	cert, _ := x509.ParseCertificate(der)
+	if err := write_crl(dir, cert, key, big.NewInt(1), nil); err != nil {
+		return err
+	}
+	fmt.Printf("✅ CA已创建: %s\n", dir)
+	fmt.Printf("   证书: %s\n", filepath.Join(dir, CA_CERT_FILE))
+	fmt.Printf("   私钥: %s（请妥善保管）\n", filepath.Join(dir, CA_KEY_FILE))
+	fmt.Printf("   吊销列表: %s\n", filepath.Join(dir, CA_CRL_FILE))
+	return nil
+}
+
+// 签发节点证书，URI SAN 为 spiffe://ffmesh/node/<node_id>，CN 也是节点ID
+func ca_issue(dir string, node_id string, out string, days int) (*x509.Certificate, error) {
+	if err := check_node_id(node_id); err != nil {
+		return nil, err
+	}
+	ca_cert, ca_key, err := load_ca(dir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := url.Parse(SPIFFE_NODE_PREFIX + node_id)
+	if err != nil {
+		return nil, err
+	}
+	template := new_cert_template(node_id, time.Duration(days)*24*time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// 节点既是服务端也是客户端
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	template.URIs = []*url.URL{uri}
+	if template.NotAfter.After(ca_cert.NotAfter) {
+		template.NotAfter = ca_cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca_cert, &key.PublicKey, ca_key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return nil, err
+	}
+	cert_path := filepath.Join(out, node_id+".crt")
+	key_path := filepath.Join(out, node_id+".key")
+	if err := write_private_key(key_path, key, true); err != nil {
+		return nil, err
+	}
+	if err := write_pem_file(cert_path, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	cert, _ := x509.ParseCertificate(der)
+	fmt.Printf("✅ 已签发节点证书: %s\n", node_id)
+	fmt.Printf("   序列号: %s\n", cert.SerialNumber.Text(16))
+	fmt.Printf("   证书: %s\n", cert_path)
+	fmt.Printf("   私钥: %s\n", key_path)
+	fmt.Printf("   有效期至: %s\n", cert.NotAfter.Format("2006-01-02"))
+	return cert, nil
+}
+
+// 吊销证书：把序列号加入吊销列表并重新签名
+func ca_revoke(dir string, cert_path string, serial_hex string) error {
+	var serial *big.Int
+	switch {
+	case cert_path != "":
+		certs, err := read_pem_certs(cert_path)
+		if err != nil {
+			return err
+		}
+		serial = certs[0].SerialNumber
+	case serial_hex != "":
+		var ok bool
+		serial, ok = new(big.Int).SetString(strings.ReplaceAll(serial_hex, ":", ""), 16)
+		if !ok {
+			return fmt.Errorf("序列号格式错误: %s", serial_hex)
+		}
+	default:
+		return errors.New("必须指定 --cert 或 --serial")
+	}
+
+	ca_cert, ca_key, err := load_ca(dir)
+	if err != nil {
+		return err
+	}
+	crl, err := read_crl(filepath.Join(dir, CA_CRL_FILE))
+	if err != nil {
+		return err
+	}
+	entries := crl.RevokedCertificateEntries
+	for _, e := range entries {
+		if e.SerialNumber.Cmp(serial) == 0 {
+			fmt.Printf("⚠️  证书已经吊销: %s\n", serial.Text(16))
+			return nil
+		}
+	}
+	entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: time.Now()})
+	number := new(big.Int).Add(crl.Number, big.NewInt(1))
+	if err := write_crl(dir, ca_cert, ca_key, number, entries); err != nil {
+		return err
+	}
+	fmt.Printf("✅ 已吊销证书: %s（吊销列表版本 %s，共%d个）\n", serial.Text(16), number, len(entries))
+	fmt.Printf("   请把 %s 分发到各监听节点，节点会自动重新加载\n", filepath.Join(dir, CA_CRL_FILE))
+	return nil
+}
+
+func load_ca(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certs, err := read_pem_certs(filepath.Join(dir, CA_CERT_FILE))
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, CA_KEY_FILE))
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取CA私钥失败: %w", err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, nil, fmt.Errorf("CA私钥格式错误: %s", filepath.Join(dir, CA_KEY_FILE))
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析CA私钥失败: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA私钥不支持签名")
+	}
+	return certs[0], signer, nil
+}
+
+func write_crl(dir string, ca_cert *x509.Certificate, ca_key crypto.Signer, number *big.Int, entries []x509.RevocationListEntry) error {
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(CRL_VALID_DAYS * 24 * time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca_cert, ca_key)
+	if err != nil {
+		return fmt.Errorf("生成吊销列表失败: %w", err)
+	}
+	// 先写临时文件再改名，监听节点不会读到写了一半的文件
+	path := filepath.Join(dir, CA_CRL_FILE)
+	if err := write_pem_file(path+".tmp", "X509 CRL", der, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func write_private_key(path string, key crypto.PrivateKey, overwrite bool) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flag |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return fmt.Errorf("写入私钥失败: %w", err)
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func write_pem_file(path string, typ string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+func read_pem_certs(path string) ([]*x509.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取证书失败: %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析证书失败 %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("文件中没有证书: %s", path)
+	}
+	return certs, nil
+}
+
+func read_crl(path string) (*x509.RevocationList, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取吊销列表失败: %w", err)
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return nil, fmt.Errorf("解析吊销列表失败: %w", err)
+	}
+	return crl, nil
+}
+
+// 监听节点加载的吊销列表，文件变化后重新加载
+type crl_file struct {
+	path string
+	ca   []*x509.Certificate
+
+	mu      sync.RWMutex
+	revoked map[string]bool // 吊销的证书序列号（十六进制）
+	number  *big.Int
+	mtime   time.Time
+}
+
+func load_crl_file(path string, ca []*x509.Certificate) (*crl_file, error) {
+	c := &crl_file{path: path, ca: ca}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 文件修改时间变化时重新加载，返回是否重新加载；加载失败时保留原来的吊销列表
+func (c *crl_file) reload() (bool, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return false, fmt.Errorf("读取吊销列表失败: %w", err)
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.mtime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	crl, err := read_crl(c.path)
+	if err != nil {
+		return false, err
+	}
+	if err := check_crl_signature(crl, c.ca); err != nil {
+		return false, err
+	}
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.Text(16)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.number != nil && crl.Number != nil && crl.Number.Cmp(c.number) < 0 {
+		// 防止被旧版本的吊销列表覆盖
+		return false, fmt.Errorf("吊销列表版本%s低于当前版本%s", crl.Number, c.number)
+	}
+	c.revoked = revoked
+	c.number = crl.Number
+	c.mtime = info.ModTime()
+	return true, nil
+}
+
+func check_crl_signature(crl *x509.RevocationList, ca []*x509.Certificate) error {
+	for _, cert := range ca {
+		if crl.CheckSignatureFrom(cert) == nil {
+			return nil
+		}
+	}
+	return errors.New("吊销列表不是由配置的CA签发")
+}
+
+func (c *crl_file) version() *big.Int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.number
+}
+
+func (c *crl_file) is_revoked(cert *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.revoked[cert.SerialNumber.Text(16)]
+}
+
+// 定时重新加载吊销列表，并断开证书已被吊销的节点
+func reload_crl() {
+	if fm.tls == nil || fm.tls.crl == nil {
+		return
+	}
+	changed, err := fm.tls.crl.reload()
+	if err != nil {
+		fmt.Printf("⚠️  重新加载吊销列表失败: %v\n", err)
+		return
+	}
+	if !changed {
+		return
+	}
+	fmt.Printf("🔐 吊销列表已更新: 版本%s\n", fm.tls.crl.version())
+	fm.peers.each(func(client *quic_client) bool {
+		if client.conn == nil {
+			return true
+		}
+		if err := fm.tls.check_revoked(client.conn.ConnectionState().TLS.PeerCertificates); err != nil {
+			fmt.Printf("🔐 断开证书已吊销的节点 [%s]: %v\n", client.node_id, err)
+			fm.peers.remove_by_conn(client.conn, "certificate revoked")
+		}
+		return true
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestCACommands(t *testing.T) {
+	setup_test_node()
+
+	dir := t.TempDir()
+	ca_dir := filepath.Join(dir, "ca")
+	if err := ca_main([]string{"init", "--dir", ca_dir}); err != nil {
+		t.Fatalf("创建CA失败: %v", err)
+	}
+	if err := ca_main([]string{"init", "--dir", ca_dir}); err == nil {
+		t.Error("CA私钥已存在时不应该覆盖")
+	}
+	for _, node_id := range []string{fm.config.NodeID, "ca-node-a", "ca-node-b"} {
+		if err := ca_main([]string{"issue", "--dir", ca_dir, "--node-id", node_id, "--out", dir}); err != nil {
+			t.Fatalf("签发证书失败: %v", err)
+		}
+	}
+	if err := ca_main([]string{"issue", "--dir", ca_dir}); err == nil {
+		t.Error("没有指定节点ID时应该失败")
+	}
+	for _, bad := range []string{"../evil", "a/b", "..", "node id", "node%2f"} {
+		if err := ca_main([]string{"issue", "--dir", ca_dir, "--node-id", bad, "--out", dir}); err == nil {
+			t.Errorf("节点ID %q 应该被拒绝", bad)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "evil.crt")); err == nil {
+		t.Error("证书不应该写到输出目录之外")
+	}
+
+	load := func(node_id string) *mesh_tls {
+		t.Helper()
+		m, err := load_mesh_tls(TLSConfig{
+			Cert: filepath.Join(dir, node_id+".crt"),
+			Key:  filepath.Join(dir, node_id+".key"),
+			CA:   filepath.Join(ca_dir, CA_CERT_FILE),
+			CRL:  filepath.Join(ca_dir, CA_CRL_FILE),
+		})
+		if err != nil {
+			t.Fatalf("加载证书失败: %v", err)
+		}
+		if m.node_id() != node_id || m.cert.Leaf.Subject.CommonName != node_id {
+			t.Fatalf("证书节点ID不正确: %s", m.node_id())
+		}
+		return m
+	}
+	server := load(fm.config.NodeID)
+	node_a := load("ca-node-a")
+	node_b := load("ca-node-b")
+
+	// 吊销前保存一份旧的吊销列表
+	old_crl, _ := os.ReadFile(filepath.Join(ca_dir, CA_CRL_FILE))
+	if err := ca_main([]string{"revoke", "--dir", ca_dir, "--cert", filepath.Join(dir, "ca-node-b.crt")}); err != nil {
+		t.Fatalf("吊销证书失败: %v", err)
+	}
+	if changed, err := server.crl.reload(); !changed || err != nil {
+		t.Fatalf("重新加载吊销列表失败: %v", err)
+	}
+	if server.check_revoked([]*x509.Certificate{node_b.cert.Leaf}) == nil {
+		t.Error("node-b的证书应该已被吊销")
+	}
+	if server.check_revoked([]*x509.Certificate{node_a.cert.Leaf}) != nil {
+		t.Error("node-a的证书不应该被吊销")
+	}
+
+	// 旧版本的吊销列表不会覆盖新版本
+	os.WriteFile(filepath.Join(ca_dir, CA_CRL_FILE), old_crl, 0644)
+	if _, err := server.crl.reload(); err == nil {
+		t.Error("旧版本的吊销列表应该被拒绝")
+	}
+	if server.check_revoked([]*x509.Certificate{node_b.cert.Leaf}) == nil {
+		t.Error("加载失败时应该保留原来的吊销列表")
+	}
+
+	// 监听节点拒绝证书已吊销的节点
+	fm.tls = server
+	defer func() { fm.tls = nil }()
+	listener, err := quic.ListenAddr("127.0.0.1:0", GetServerTLSConfig(), GetQuicServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go handleQuicConnection(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+	if msg := tls_handshake(addr, node_a, "ca-node-a"); msg == nil || !msg.Data.(map[string]interface{})["result"].(bool) {
+		t.Errorf("未吊销的节点应该握手成功: %v", msg)
+	}
+	if msg := tls_handshake(addr, node_b, "ca-node-b"); msg != nil {
+		t.Error("证书已吊销的节点应该被拒绝")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// 消息编码
+// 握手消息（SYN_MSG/SYN_ACK_MSG/SYN_DATA）始终使用JSON，老版本节点可以识别
+// 双方都带CAP_CODEC_CBOR时控制通道改用CBOR；读取时按第一个字节自动识别编码
+const (
+	CODEC_JSON = "json"
+	CODEC_CBOR = "cbor"
+)
+
+type codec interface {
+	name() string
+	encode(m *QuicMessage) ([]byte, error)
+	decode(buf []byte) (*QuicMessage, error)
+}
+
+var codecs = map[string]codec{
+	CODEC_JSON: json_codec{},
+	CODEC_CBOR: cbor_codec{},
+}
+
+// 根据消息帧内容识别编码，JSON对象一定以'{'开头，CBOR数组的第一个字节是0x84
+func detect_codec(buf []byte) codec {
+	if len(buf) > 0 && buf[0] == '{' {
+		return codecs[CODEC_JSON]
+	}
+	return codecs[CODEC_CBOR]
+}
+
+// 按协商后的能力选择发给对端的编码
+func select_codec(caps uint32) codec {
+	if caps&CAP_CODEC_CBOR != 0 {
+		return codecs[CODEC_CBOR]
+	}
+	return codecs[CODEC_JSON]
+}
+
+// 根据消息类型创建Data对应的结构体并解析，Data为空时也给一个空结构体
+func decode_msg_data(msg *QuicMessage, empty bool, unmarshal func(v interface{}) error) error {
+	info, ok := msg_types[msg.Type]
+	if !ok || info.new_data == nil {
+		return nil
+	}
+	data := info.new_data()
+	if !empty {
+		if err := unmarshal(data); err != nil {
+			return fmt.Errorf("解析%s消息内容失败: %w", info.name, err)
+		}
+	}
+	msg.Data = data
+	return nil
+}
+
+type json_codec struct{}
+
+func (json_codec) name() string { return CODEC_JSON }
+
+func (json_codec) encode(m *QuicMessage) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (json_codec) decode(buf []byte) (*QuicMessage, error) {
+	var raw struct {
+		QuicMessage
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("解析消息失败: %w", err)
+	}
+	msg := raw.QuicMessage
+	msg.Data = nil
+	empty := len(raw.Data) == 0 || string(raw.Data) == "null"
+	if err := decode_msg_data(&msg, empty, func(v interface{}) error {
+		return json.Unmarshal(raw.Data, v)
+	}); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// CBOR编码的消息外层是定长数组 [type, to_id, from_id, data]，Data字段沿用json标签
+type cbor_message struct {
+	_      struct{} `cbor:",toarray"`
+	Type   int
+	ToID   string
+	FromID string
+	Data   cbor.RawMessage
+}
+
+// 限制解析时的嵌套和元素数量，防止恶意消息占用大量内存
+var cbor_dec_mode, _ = cbor.DecOptions{
+	MaxNestedLevels:  16,
+	MaxArrayElements: 65536,
+	MaxMapPairs:      65536,
+}.DecMode()
+
+type cbor_codec struct{}
+
+func (cbor_codec) name() string { return CODEC_CBOR }
+
+func (cbor_codec) encode(m *QuicMessage) ([]byte, error) {
+	data, err := cbor.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(cbor_message{Type: m.Type, ToID: m.ToID, FromID: m.FromID, Data: data})
+}
+
+func (cbor_codec) decode(buf []byte) (*QuicMessage, error) {
+	var raw cbor_message
+	if err := cbor_dec_mode.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("解析消息失败: %w", err)
+	}
+	msg := QuicMessage{Type: raw.Type, ToID: raw.ToID, FromID: raw.FromID}
+	// 0xf6 为CBOR的null
+	empty := len(raw.Data) == 0 || (len(raw.Data) == 1 && raw.Data[0] == 0xf6)
+	if err := decode_msg_data(&msg, empty, func(v interface{}) error {
+		return cbor_dec_mode.Unmarshal(raw.Data, v)
+	}); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
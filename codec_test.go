@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 测试用的消息，覆盖常用的控制消息
+func sample_messages() []*QuicMessage {
+	routes := make([]RouteInfo, 0, 20)
+	for i := 0; i < cap(routes); i++ {
+		routes = append(routes, RouteInfo{NodeID: fmt.Sprintf("node-%02d", i), Cost: i%5 + 1, Path: []string{"a", "b", fmt.Sprintf("node-%02d", i)}})
+	}
+	return []*QuicMessage{
+		{Type: MSG_TYPE_PING, FromID: "a", ToID: "b", Data: &PingMessage{}},
+		{Type: MSG_TYPE_FIND_NODE, FromID: "a", ToID: "b", Data: &FindNodeMessage{RequestID: "a-1", NodeID: "a", TargetID: "z", HopLimit: 15, Path: []string{"a"}}},
+		{Type: MSG_TYPE_FIND_NODE_ACK, FromID: "b", ToID: "a", Data: &FindNodeAckMessage{RequestID: "a-1", NodeID: "a", TargetID: "z", Error: &ErrorMessage{Code: ERR_CODE_LOOP, Detail: "loop", NodeID: "c"}}},
+		{Type: MSG_TYPE_ROUTE_UPDATE, FromID: "a", ToID: "b", Data: &RouteUpdateMessage{Routes: routes}},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for _, msg := range sample_messages() {
+			buf := msg.encode(c)
+			got, err := read_quic_message(bytes.NewReader(buf), DEFAULT_MAX_FRAME_SIZE)
+			if err != nil {
+				t.Fatalf("[%s] 解析%s消息失败: %v", c.name(), msg_type_name(msg.Type), err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("[%s] %s消息不一致: %+v != %+v", c.name(), msg_type_name(msg.Type), got, msg)
+			}
+		}
+	}
+
+	// CBOR编码比JSON小
+	msg := sample_messages()[3]
+	if cbor_len, json_len := len(msg.encode(codecs[CODEC_CBOR])), len(msg.ToBuffer()); cbor_len >= json_len {
+		t.Errorf("CBOR编码应该比JSON小: %d >= %d", cbor_len, json_len)
+	}
+}
+
+// 双方都支持CBOR时控制通道使用CBOR，握手仍然是JSON
+func TestCodecNegotiation(t *testing.T) {
+	setup_test_node()
+
+	p, ack := dial_test_peer_syn(t, SynMsgMessage{
+		Version:      VERSION,
+		MinVersion:   MIN_VERSION,
+		Capabilities: CAPABILITIES,
+		NodeID:       "cbor-node-1",
+	})
+	defer p.close()
+	if ack == nil || ack.Type != MSG_TYPE_SYN_ACK_MSG {
+		t.Fatalf("握手失败: %v", ack)
+	}
+	if !wait_for(t, 5*time.Second, func() bool { return fm.peers.get(p.node_id) != nil }) {
+		t.Fatal("节点没有注册")
+	}
+	if name := fm.peers.get(p.node_id).codec.name(); name != CODEC_CBOR {
+		t.Fatalf("应该协商为CBOR编码, 实际: %s", name)
+	}
+
+	p.send(MSG_TYPE_PING, PingMessage{})
+	for {
+		buf, err := read_frame(p.stream, DEFAULT_MAX_FRAME_SIZE)
+		if err != nil {
+			t.Fatalf("读取消息失败: %v", err)
+		}
+		if detect_codec(buf).name() != CODEC_CBOR {
+			t.Fatalf("应该收到CBOR编码的消息: %q", buf)
+		}
+		msg, err := decode_quic_message(buf)
+		if err != nil {
+			t.Fatalf("解析消息失败: %v", err)
+		}
+		if msg.Type == MSG_TYPE_PONG {
+			break
+		}
+	}
+}
+
+func benchmark_encode(b *testing.B, c codec) {
+	msgs := sample_messages()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			msg.encode(c)
+		}
+	}
+}
+
+func benchmark_decode(b *testing.B, c codec) {
+	var frames [][]byte
+	for _, msg := range sample_messages() {
+		frames = append(frames, msg.encode(c))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, frame := range frames {
+			if _, err := read_quic_message(bytes.NewReader(frame), DEFAULT_MAX_FRAME_SIZE); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) { benchmark_encode(b, codecs[CODEC_JSON]) }
+func BenchmarkEncodeCBOR(b *testing.B) { benchmark_encode(b, codecs[CODEC_CBOR]) }
+func BenchmarkDecodeJSON(b *testing.B) { benchmark_decode(b, codecs[CODEC_JSON]) }
+func BenchmarkDecodeCBOR(b *testing.B) { benchmark_decode(b, codecs[CODEC_CBOR]) }
@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,10 +17,67 @@ import (
 
 // 代理配置结构
 type ProxyConfig struct {
-	LocalPort     int    `yaml:"local_port"`
-	TargetNodeID  string `yaml:"target_node_id"`
-	TargetAddress string `yaml:"target_address"`
-	Name          string `yaml:"name"`
+	LocalPort     int       `yaml:"local_port,omitempty"`
+	LocalPorts    string    `yaml:"local_ports,omitempty"` // 本地端口范围，例如 20000-20100，target_address 的端口为同样长度的范围
+	Bind          bind_list `yaml:"bind,omitempty"`        // 绑定的本地IP地址，一个或多个，* 表示所有地址，默认只监听本机 127.0.0.1 和 ::1
+	Listen        string    `yaml:"listen,omitempty"`      // 监听unix socket: unix:/path，与local_port二选一，只支持tcp
+	ListenMode    string    `yaml:"listen_mode,omitempty"` // unix socket文件权限（八进制），默认 0600
+	TargetNodeID  string    `yaml:"target_node_id,omitempty"`
+	TargetAddress string    `yaml:"target_address,omitempty"`
+	Service       string    `yaml:"service,omitempty"`        // 目标节点发布的服务，格式 name@node_id，省略节点时自动选择，与target_address二选一
+	Protocol      string    `yaml:"protocol,omitempty"`       // tcp（默认）或 udp
+	ProxyProtocol string    `yaml:"proxy_protocol,omitempty"` // 要求目标节点连接目标后发送PROXY协议头: v1/v2，只支持tcp
+	Name          string    `yaml:"name"`
+
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"` // 负载均衡的地址(IP/CIDR)，来自这些地址的连接必须带PROXY协议头，只支持tcp
+	AllowClients   []string `yaml:"allow_clients,omitempty"`   // 允许的客户端地址(IP/CIDR)，为空表示所有
+
+	trusted_proxies []*net.IPNet
+	allow_clients   []*net.IPNet
+	port_min        int // 本地端口范围
+	port_max        int
+	target_port_min int // 目标端口范围的起点
+}
+
+// 代理的传输协议，默认tcp
+func (p *ProxyConfig) GetProtocol() string {
+	if p.Protocol == "" {
+		return PROTO_TCP
+	}
+	return p.Protocol
+}
+
+// 代理的本地监听地址，用于日志
+func (p *ProxyConfig) ListenAddr() string {
+	if p.Listen != "" {
+		return p.Listen
+	}
+	if p.LocalPorts != "" {
+		return p.binds().format(p.LocalPorts)
+	}
+	return p.binds().format(strconv.Itoa(p.LocalPort))
+}
+
+// 代理监听的本地地址，默认只监听本机
+func (p *ProxyConfig) binds() bind_list {
+	return p.Bind.or(BIND_LOOPBACK)
+}
+
+// 解析 service 字段，返回服务名和节点ID
+func (p *ProxyConfig) ServiceTarget() (string, string) {
+	if i := strings.LastIndex(p.Service, "@"); i >= 0 {
+		return p.Service[:i], p.Service[i+1:]
+	}
+	return p.Service, ""
+}
+
+// 本节点发布的服务
+type ServiceConfig struct {
+	Name    string   `yaml:"name"`
+	Address string   `yaml:"address"`         // 服务的本地地址，不会告诉其他节点
+	Allow   []string `yaml:"allow,omitempty"` // 允许访问的来源节点ID（支持*通配符），为空表示所有
+	// 连接服务后先发送PROXY协议头: v1/v2，优先于代理的proxy_protocol
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty"`
 }
 
 // 上级节点配置结构
@@ -23,19 +85,130 @@ type UpstreamConfig struct {
 	NodeID  string `yaml:"node_id"`
 	Address string `yaml:"address"`
 	Name    string `yaml:"name"`
+	Secret  string `yaml:"secret,omitempty"` // 连接该上级节点使用的组网密钥，不配置时使用quic.secret
 }
 
 // QUIC配置结构
 type QuicConfig struct {
-	ListenPort int              `yaml:"listen_port,omitempty"` // omitempty表示如果为0则不输出到YAML
-	Upstreams  []UpstreamConfig `yaml:"upstreams,omitempty"`
+	ListenPort   int              `yaml:"listen_port,omitempty"` // omitempty表示如果为0则不输出到YAML
+	Bind         bind_list        `yaml:"bind,omitempty"`        // 监听的本地IP地址，一个或多个，默认 * （所有地址，IPv4和IPv6双栈）
+	Upstreams    []UpstreamConfig `yaml:"upstreams,omitempty"`
+	MaxFrameSize int              `yaml:"max_frame_size,omitempty"` // 单条消息最大字节数，默认1MiB
+	Codec        string           `yaml:"codec,omitempty"`          // 控制通道编码: cbor(默认)/json
+	TLS          TLSConfig        `yaml:"tls,omitempty"`            // 组网证书，不配置时不校验对端身份
+	Secret       string           `yaml:"secret,omitempty"`         // 组网密钥，配置后不知道密钥的节点无法接入
+}
+
+// 连接某个上级节点使用的组网密钥
+func (q *QuicConfig) GetUpstreamSecret(node_id string) string {
+	for _, upstream := range q.Upstreams {
+		if upstream.NodeID == node_id && upstream.Secret != "" {
+			return upstream.Secret
+		}
+	}
+	return q.Secret
+}
+
+// 组网证书配置（PEM文件路径），节点证书的URI SAN为 spiffe://ffmesh/node/<node_id>
+type TLSConfig struct {
+	Cert string `yaml:"cert,omitempty"` // 本节点证书
+	Key  string `yaml:"key,omitempty"`  // 本节点私钥
+	CA   string `yaml:"ca,omitempty"`   // 信任的CA证书
+	CRL  string `yaml:"crl,omitempty"`  // 吊销列表（可选），文件变化后自动重新加载
+}
+
+// 是否配置了证书
+func (t *TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.Key != "" || t.CA != "" || t.CRL != ""
+}
+
+// 获取控制通道编码
+func (q *QuicConfig) GetCodec() string {
+	if q.Codec == "" {
+		return CODEC_CBOR
+	}
+	return q.Codec
+}
+
+// 获取单条消息最大字节数
+func (q *QuicConfig) GetMaxFrameSize() int {
+	if q.MaxFrameSize > 0 {
+		return q.MaxFrameSize
+	}
+	return DEFAULT_MAX_FRAME_SIZE
+}
+
+// 密钥身份配置
+type IdentityConfig struct {
+	Key     string `yaml:"key,omitempty"`     // Ed25519私钥文件（相对路径相对于配置文件目录），不存在时自动生成；配置后节点ID由公钥推导
+	Require bool   `yaml:"require,omitempty"` // 要求所有对端都用密钥证明节点ID
+}
+
+// 入站监听器配置：目标地址由客户端按连接指定（socks5/http_proxy），出口节点按规则选择
+// http_ingress 按Host和路径、sni 按TLS的SNI转发到固定的目标
+type ListenerConfig struct {
+	Name        string          `yaml:"name"`
+	Type        string          `yaml:"type"`   // socks5 / http_proxy / http_ingress / sni
+	Listen      string          `yaml:"listen"` // 监听地址，例如 127.0.0.1:1080
+	Users       []ListenerUser  `yaml:"users,omitempty"`
+	Routes      []ListenerRoute `yaml:"routes,omitempty"`       // 按目标地址选择出口节点，第一条匹配的生效
+	DefaultNode string          `yaml:"default_node,omitempty"` // 没有匹配的规则时使用的出口节点
+	Ingress     []IngressRoute  `yaml:"ingress,omitempty"`      // http_ingress/sni的转发规则
+	TLSCert     string          `yaml:"tls_cert,omitempty"`     // http_ingress配置证书后监听HTTPS
+	TLSKey      string          `yaml:"tls_key,omitempty"`
+
+	routes []listener_route // 编译后的规则
+}
+
+// 监听器的用户名密码，配置后客户端必须认证
+type ListenerUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// 出口规则：目标地址匹配 destinations 时从 node 出去
+type ListenerRoute struct {
+	Destinations []string `yaml:"destinations"` // 域名通配符、IP或CIDR，可以带端口，例如 *.corp、10.0.0.0/8、db.lan:5432
+	Node         string   `yaml:"node"`
+}
+
+// HTTP入口规则：Host和路径前缀都匹配时转发到目标节点上的地址或服务
+type IngressRoute struct {
+	Host        string `yaml:"host,omitempty"`         // Host头（不含端口），支持*通配符，为空匹配所有
+	Path        string `yaml:"path,omitempty"`         // 路径前缀，默认 /
+	Node        string `yaml:"node,omitempty"`         // 目标节点ID
+	Address     string `yaml:"address,omitempty"`      // 目标节点上的地址
+	Service     string `yaml:"service,omitempty"`      // 目标服务，格式 name@node_id，省略节点时自动选择，与node/address二选一
+	StripPrefix bool   `yaml:"strip_prefix,omitempty"` // 转发前去掉路径前缀
+}
+
+// 访问控制策略配置
+type PolicyConfig struct {
+	Targets  []PolicyRule `yaml:"targets,omitempty"`   // 本节点作为目标节点时的规则，目标为 host:port
+	Transit  []PolicyRule `yaml:"transit,omitempty"`   // 本节点作为中继时的规则，目标为节点ID
+	AuditLog string       `yaml:"audit_log,omitempty"` // 审计日志文件（可选）
+}
+
+// 访问控制规则，来源和目标支持*通配符，为空表示所有
+type PolicyRule struct {
+	Action       string   `yaml:"action"` // allow / deny
+	Sources      []string `yaml:"sources,omitempty"`
+	Destinations []string `yaml:"destinations,omitempty"`
 }
 
 // 主配置结构
 type Config struct {
-	NodeID  string        `yaml:"node_id"`
-	Proxies []ProxyConfig `yaml:"proxies,omitempty"`
-	Quic    QuicConfig    `yaml:"quic,omitempty"`
+	NodeID    string           `yaml:"node_id"`
+	Identity  IdentityConfig   `yaml:"identity,omitempty"`
+	Proxies   []ProxyConfig    `yaml:"proxies,omitempty"`
+	Services  []ServiceConfig  `yaml:"services,omitempty"`
+	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+	Quic      QuicConfig       `yaml:"quic,omitempty"`
+	Policy    PolicyConfig     `yaml:"policy,omitempty"`
+	Admin     string           `yaml:"admin,omitempty"` // 本地管理接口监听地址，例如 127.0.0.1:7070，为空不启动
+
+	identity *node_identity // 加载后的节点密钥，未配置时为nil
+	policy   *mesh_policy   // 编译后的访问控制策略，未配置时为nil
 }
 
 // 生成随机节点ID
@@ -53,6 +226,24 @@ func generateNodeID() string {
 	return nodeID
 }
 
+const MAX_NODE_ID_LEN = 64 // 节点ID最长长度
+
+// 节点ID只能由字母、数字、'-'、'_'组成：节点ID会出现在证书的SPIFFE URI和证书文件名中
+func check_node_id(node_id string) error {
+	if node_id == "" {
+		return fmt.Errorf("节点ID不能为空")
+	}
+	if len(node_id) > MAX_NODE_ID_LEN {
+		return fmt.Errorf("节点ID不能超过%d个字符", MAX_NODE_ID_LEN)
+	}
+	for _, c := range node_id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("节点ID %q 包含不允许的字符 %q，只能使用字母、数字、'-'和'_'", node_id, c)
+		}
+	}
+	return nil
+}
+
 // 保存配置到文件
 func (c *Config) SaveConfig(filename string) error {
 	data, err := yaml.Marshal(c)
@@ -81,9 +272,28 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("解析配置文件失败: %v", err)
 	}
 
+	// 加载节点密钥，节点ID必须由公钥推导
+	if config.Identity.Key != "" {
+		key_path := config.Identity.Key
+		if !filepath.IsAbs(key_path) {
+			key_path = filepath.Join(filepath.Dir(filename), key_path)
+		}
+		config.identity, err = load_node_identity(key_path)
+		if err != nil {
+			return nil, err
+		}
+		if config.NodeID != "" && config.NodeID != config.identity.node_id {
+			return nil, fmt.Errorf("节点ID(%s)与节点密钥推导的ID(%s)不一致，请删除node_id或更换密钥", config.NodeID, config.identity.node_id)
+		}
+	}
+
 	// 检查节点ID是否为空，如果为空则生成新的
 	if config.NodeID == "" {
-		config.NodeID = generateNodeID()
+		if config.identity != nil {
+			config.NodeID = config.identity.node_id
+		} else {
+			config.NodeID = generateNodeID()
+		}
 		fmt.Printf("⚠️  检测到节点ID为空，自动生成新ID: %s\n", config.NodeID)
 
 		// 将新的配置写回文件
@@ -102,30 +312,134 @@ func LoadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// 按服务名查找本节点发布的服务
+func (c *Config) GetService(name string) *ServiceConfig {
+	for i := range c.Services {
+		if c.Services[i].Name == name {
+			return &c.Services[i]
+		}
+	}
+	return nil
+}
+
 // 验证配置
 func validateConfig(config *Config) error {
 	// 验证节点ID
-	if config.NodeID == "" {
-		return fmt.Errorf("节点ID不能为空")
+	if err := check_node_id(config.NodeID); err != nil {
+		return err
 	}
-	if len(config.NodeID) < 8 || len(config.NodeID) > 12 {
+	if config.identity == nil && (len(config.NodeID) < 8 || len(config.NodeID) > 12) {
 		return fmt.Errorf("节点ID长度应该在8-12位之间")
 	}
 
 	// 验证代理配置
 	for i, proxy := range config.Proxies {
-		if proxy.LocalPort <= 0 || proxy.LocalPort > 65535 {
-			return fmt.Errorf("代理[%d]本地端口号无效: %d", i, proxy.LocalPort)
-		}
-		if proxy.TargetNodeID == "" {
-			return fmt.Errorf("代理[%d]目标节点ID不能为空", i)
+		if proxy.Listen != "" {
+			p, ok := unix_path(proxy.Listen)
+			if !ok || !filepath.IsAbs(p) {
+				return fmt.Errorf("代理[%d] listen应该为 unix:/绝对路径: %s", i, proxy.Listen)
+			}
+			if proxy.LocalPort != 0 || proxy.LocalPorts != "" || len(proxy.Bind) > 0 {
+				return fmt.Errorf("代理[%d] listen 与 local_port/local_ports/bind 不能同时配置", i)
+			}
+			if proxy.GetProtocol() != PROTO_TCP {
+				return fmt.Errorf("代理[%d] unix socket只支持tcp", i)
+			}
+			if len(proxy.TrustedProxies) > 0 || len(proxy.AllowClients) > 0 {
+				return fmt.Errorf("代理[%d] unix socket没有客户端IP，不能配置 trusted_proxies/allow_clients，请用 listen_mode 控制访问", i)
+			}
+			if _, err := parse_socket_mode(proxy.ListenMode); err != nil {
+				return fmt.Errorf("代理[%d] %v", i, err)
+			}
+		} else if proxy.ListenMode != "" {
+			return fmt.Errorf("代理[%d] listen_mode只用于unix socket", i)
+		} else if err := validate_proxy_ports(i, &config.Proxies[i]); err != nil {
+			return err
 		}
-		if proxy.TargetAddress == "" {
-			return fmt.Errorf("代理[%d]目标地址不能为空", i)
+		if proxy.Service != "" {
+			name, node_id := proxy.ServiceTarget()
+			if !valid_service_name(name) {
+				return fmt.Errorf("代理[%d]服务名无效: %s", i, proxy.Service)
+			}
+			if node_id == "" && strings.HasSuffix(proxy.Service, "@") {
+				return fmt.Errorf("代理[%d]服务格式应该为 name 或 name@node_id: %s", i, proxy.Service)
+			}
+			if proxy.TargetAddress != "" || (proxy.TargetNodeID != "" && proxy.TargetNodeID != node_id) {
+				return fmt.Errorf("代理[%d] service 与 target_node_id/target_address 不能同时配置", i)
+			}
+			config.Proxies[i].TargetNodeID = node_id
+		} else {
+			if proxy.TargetNodeID == "" {
+				return fmt.Errorf("代理[%d]目标节点ID不能为空", i)
+			}
+			if proxy.TargetAddress == "" {
+				return fmt.Errorf("代理[%d]目标地址不能为空", i)
+			}
+			if p, ok := unix_path(proxy.TargetAddress); ok && !filepath.IsAbs(p) {
+				return fmt.Errorf("代理[%d]目标unix socket应该是绝对路径: %s", i, proxy.TargetAddress)
+			}
 		}
 		if proxy.Name == "" {
 			return fmt.Errorf("代理[%d]名称不能为空", i)
 		}
+		if p := proxy.GetProtocol(); p != PROTO_TCP && p != PROTO_UDP {
+			return fmt.Errorf("代理[%d]协议无效: %s (可选: tcp, udp)", i, proxy.Protocol)
+		}
+		if !valid_proxy_protocol(proxy.ProxyProtocol) {
+			return fmt.Errorf("代理[%d] proxy_protocol无效: %s (可选: v1, v2)", i, proxy.ProxyProtocol)
+		}
+		if proxy.ProxyProtocol != "" && proxy.GetProtocol() != PROTO_TCP {
+			return fmt.Errorf("代理[%d] proxy_protocol只支持tcp", i)
+		}
+		if len(proxy.TrustedProxies) > 0 && proxy.GetProtocol() != PROTO_TCP {
+			return fmt.Errorf("代理[%d] trusted_proxies只支持tcp", i)
+		}
+		var err error
+		if config.Proxies[i].trusted_proxies, err = parse_cidrs(proxy.TrustedProxies); err != nil {
+			return fmt.Errorf("代理[%d] trusted_proxies: %v", i, err)
+		}
+		if config.Proxies[i].allow_clients, err = parse_cidrs(proxy.AllowClients); err != nil {
+			return fmt.Errorf("代理[%d] allow_clients: %v", i, err)
+		}
+	}
+	if err := check_proxy_overlap(config.Proxies); err != nil {
+		return err
+	}
+
+	// 验证发布的服务
+	service_names := make(map[string]bool)
+	for i, service := range config.Services {
+		if !valid_service_name(service.Name) {
+			return fmt.Errorf("服务[%d]名称无效: %q (只能包含字母、数字、.、_、-)", i, service.Name)
+		}
+		if service_names[service.Name] {
+			return fmt.Errorf("服务名称重复: %s", service.Name)
+		}
+		service_names[service.Name] = true
+		if err := validate_target_address(service.Address); err != nil {
+			return fmt.Errorf("服务[%s]地址无效: %v", service.Name, err)
+		}
+		if !valid_proxy_protocol(service.ProxyProtocol) {
+			return fmt.Errorf("服务[%s] proxy_protocol无效: %s (可选: v1, v2)", service.Name, service.ProxyProtocol)
+		}
+		for _, src := range service.Allow {
+			if _, err := path.Match(src, ""); err != nil {
+				return fmt.Errorf("服务[%s]来源节点通配符错误 %q", service.Name, src)
+			}
+		}
+	}
+
+	if config.Admin != "" {
+		if _, _, err := net.SplitHostPort(config.Admin); err != nil {
+			return fmt.Errorf("管理接口地址无效: %v", err)
+		}
+	}
+
+	// 验证入站监听器
+	for i := range config.Listeners {
+		if err := validate_listener(&config.Listeners[i]); err != nil {
+			return fmt.Errorf("监听器[%d]%v", i, err)
+		}
 	}
 
 	// 验证QUIC配置（如果配置了监听端口）
@@ -134,6 +448,31 @@ func validateConfig(config *Config) error {
 			return fmt.Errorf("QUIC监听端口号无效: %d", config.Quic.ListenPort)
 		}
 	}
+	if err := config.Quic.Bind.validate(); err != nil {
+		return fmt.Errorf("QUIC bind: %v", err)
+	}
+
+	if config.Quic.MaxFrameSize < 0 {
+		return fmt.Errorf("QUIC最大消息长度无效: %d", config.Quic.MaxFrameSize)
+	}
+
+	if _, ok := codecs[config.Quic.GetCodec()]; !ok {
+		return fmt.Errorf("QUIC控制通道编码无效: %s (可选: %s, %s)", config.Quic.Codec, CODEC_CBOR, CODEC_JSON)
+	}
+
+	if tls := config.Quic.TLS; tls.Enabled() && (tls.Cert == "" || tls.Key == "" || tls.CA == "") {
+		return fmt.Errorf("QUIC证书配置不完整: cert/key/ca 必须同时配置")
+	}
+
+	if config.Quic.Secret != "" && len(config.Quic.Secret) < MIN_SECRET_LEN {
+		return fmt.Errorf("组网密钥至少%d个字符", MIN_SECRET_LEN)
+	}
+
+	policy, err := compile_policy(config.Policy)
+	if err != nil {
+		return fmt.Errorf("访问控制策略错误: %v", err)
+	}
+	config.policy = policy
 
 	// 验证上级节点配置（最多2个）
 	if len(config.Quic.Upstreams) > 2 {
@@ -150,6 +489,9 @@ func validateConfig(config *Config) error {
 		if upstream.Name == "" {
 			return fmt.Errorf("上级节点[%d]名称不能为空", i)
 		}
+		if upstream.Secret != "" && len(upstream.Secret) < MIN_SECRET_LEN {
+			return fmt.Errorf("上级节点[%d]组网密钥至少%d个字符", i, MIN_SECRET_LEN)
+		}
 	}
 
 	return nil
@@ -171,18 +513,56 @@ func (c *Config) PrintConfig() {
 	} else {
 		for i, proxy := range c.Proxies {
 			fmt.Printf("  [%d] %s\n", i+1, proxy.Name)
-			fmt.Printf("      本地端口: %d (TCP)\n", proxy.LocalPort)
-			fmt.Printf("      目标节点: %s\n", proxy.TargetNodeID)
-			fmt.Printf("      目标地址: %s\n", proxy.TargetAddress)
+			fmt.Printf("      本地监听: %s (%s)\n", proxy.ListenAddr(), strings.ToUpper(proxy.GetProtocol()))
+			if proxy.TargetNodeID != "" {
+				fmt.Printf("      目标节点: %s\n", proxy.TargetNodeID)
+			} else {
+				fmt.Printf("      目标节点: 按服务目录自动选择\n")
+			}
+			if proxy.Service != "" {
+				fmt.Printf("      目标服务: %s\n", proxy.Service)
+			} else {
+				fmt.Printf("      目标地址: %s\n", proxy.TargetAddress)
+			}
 		}
 	}
 
+	if len(c.Services) > 0 {
+		fmt.Printf("\n发布的服务:\n")
+		for _, service := range c.Services {
+			fmt.Printf("  %s -> %s\n", service.Name, service.Address)
+		}
+	}
+	if len(c.Listeners) > 0 {
+		fmt.Printf("\n入站监听器:\n")
+		for _, l := range c.Listeners {
+			if l.Type == LISTENER_HTTP_INGRESS || l.Type == LISTENER_SNI {
+				fmt.Printf("  %s (%s): %s, %d条入口规则\n", l.Name, l.Type, l.Listen, len(l.Ingress))
+				continue
+			}
+			fmt.Printf("  %s (%s): %s, %d条出口规则, 默认出口 %s\n", l.Name, l.Type, l.Listen, len(l.Routes), l.DefaultNode)
+		}
+	}
+	if c.Admin != "" {
+		fmt.Printf("\n管理接口: %s\n", c.Admin)
+	}
+
 	fmt.Printf("\nQUIC配置:\n")
 	if c.IsQuicEnabled() {
-		fmt.Printf("  监听端口: %d\n", c.Quic.ListenPort)
+		fmt.Printf("  监听地址: %s\n", c.Quic.Bind.or(BIND_DEFAULT).format(strconv.Itoa(c.Quic.ListenPort)))
 	} else {
 		fmt.Printf("  监听端口: 未配置 (QUIC功能禁用)\n")
 	}
+	fmt.Printf("  最大消息长度: %d 字节\n", c.Quic.GetMaxFrameSize())
+	fmt.Printf("  控制通道编码: %s\n", c.Quic.GetCodec())
+	if c.Quic.TLS.Enabled() {
+		fmt.Printf("  节点证书: %s (CA: %s)\n", c.Quic.TLS.Cert, c.Quic.TLS.CA)
+		if c.Quic.TLS.CRL != "" {
+			fmt.Printf("  吊销列表: %s\n", c.Quic.TLS.CRL)
+		}
+	} else {
+		fmt.Printf("  节点证书: 未配置 (不校验对端身份)\n")
+	}
 
 	if len(c.Quic.Upstreams) == 0 {
 		fmt.Printf("  上级节点: 无\n")
@@ -199,7 +579,7 @@ func (c *Config) PrintConfig() {
 // 获取代理配置
 func (c *Config) GetProxyByPort(port int) *ProxyConfig {
 	for _, proxy := range c.Proxies {
-		if proxy.LocalPort == port {
+		if proxy.Listen == "" && port >= proxy.port_min && port <= proxy.port_max {
 			return &proxy
 		}
 	}
@@ -246,7 +626,7 @@ func main_testconfig() {
 	// 启动代理监听器
 	if len(config.Proxies) > 0 {
 		for _, proxy := range config.Proxies {
-			fmt.Printf("启动代理监听器: %s -> 端口 %d\n", proxy.Name, proxy.LocalPort)
+			fmt.Printf("启动代理监听器: %s -> %s\n", proxy.Name, proxy.ListenAddr())
 			fmt.Printf("  将代理到节点 %s 的 %s\n", proxy.TargetNodeID, proxy.TargetAddress)
 			// TODO: 实际启动代理监听器
 		}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/quic-go/quic-go"
 )
 
@@ -11,27 +14,122 @@ type streaminfo struct {
 }
 
 // QUIC客户端连接信息
+// node_id/conn/is_up/version/caps/codec 创建后不再修改，streaminfo 由 mu 保护
 type quic_client struct {
 	node_id    string
 	conn       quic.Connection
 	streaminfo []streaminfo
 	is_up      bool
-	version    int
+	version    int    // 协商后的协议版本
+	caps       uint32 // 双方都支持的能力
+	codec      codec  // 控制通道发送消息使用的编码
+
+	mu sync.Mutex
+}
+
+// 对端是否能处理该类型的消息
+func (c *quic_client) supports(typ int) bool {
+	return msg_type_supported(typ, c.version, c.caps)
+}
+
+// 追加一条stream
+func (c *quic_client) add_stream(stream quic.Stream, link_type int) {
+	c.mu.Lock()
+	c.streaminfo = append(c.streaminfo, streaminfo{stream: stream, link_type: link_type})
+	c.mu.Unlock()
+}
+
+// 双方是否都支持该能力
+func (c *quic_client) has_cap(cap uint32) bool {
+	return c.caps&cap != 0
+}
+
+// 获取消息通道
+func (c *quic_client) msg_stream() quic.Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, info := range c.streaminfo {
+		if info.link_type == LINK_TYPE_MSG && info.stream != nil {
+			return info.stream
+		}
+	}
+	return nil
+}
+
+// 在消息通道上发送消息
+func (c *quic_client) send_msg(msg *QuicMessage) error {
+	if !c.supports(msg.Type) {
+		return fmt.Errorf("%w: %s (版本%d)", errMsgUnsupported, msg_type_name(msg.Type), c.version)
+	}
+	stream := c.msg_stream()
+	if stream == nil {
+		return errNoMsgStream
+	}
+	_, err := stream.Write(msg.encode(c.codec))
+	return err
+}
+
+// 关闭连接和所有stream
+func (c *quic_client) close(reason string) {
+	if c.conn != nil {
+		c.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), reason)
+	}
+	c.mu.Lock()
+	streams := c.streaminfo
+	c.mu.Unlock()
+	for _, info := range streams {
+		if info.stream != nil {
+			info.stream.Close()
+		}
+	}
+}
+
+// 消息通道的写操作需要加锁：ping定时器、各个handler都会并发往同一个stream里写消息
+type locked_stream struct {
+	quic.Stream
+	wmu sync.Mutex
+}
+
+func new_locked_stream(stream quic.Stream) *locked_stream {
+	if ls, ok := stream.(*locked_stream); ok {
+		return ls
+	}
+	return &locked_stream{Stream: stream}
+}
+
+func (s *locked_stream) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.Stream.Write(p)
 }
 
 // FFMesh主结构体
 type ffmesh struct {
-	config      *Config
-	quic_client map[string]*quic_client
+	config    *Config
+	peers     *peer_registry
+	routes    *route_table
+	finds     *find_node_table
+	metrics   *mesh_metrics
+	tls       *mesh_tls // 组网证书，nil表示未配置
+	services  *service_catalog
+	node_keys *node_key_table // 用密钥验证过的节点ID
 }
 
 // 创建新的FFMesh实例
 func new_ffmesh() *ffmesh {
 	return &ffmesh{
-		quic_client: make(map[string]*quic_client),
+		peers:     new_peer_registry(),
+		finds:     new_find_node_table(),
+		metrics:   new_mesh_metrics(),
+		services:  new_service_catalog(),
+		node_keys: new_node_key_table(),
 	}
 }
 
+// 加载配置后调用，初始化依赖节点ID的模块
 func (f *ffmesh) start() {
-
+	// 只有开启了QUIC监听的节点才是中继，帮别人转发
+	f.routes = new_route_table(f.config.NodeID, f.config.IsQuicEnabled())
+	f.peers.watch(route_on_peer_event)
+	f.peers.watch(services_on_peer_event)
 }
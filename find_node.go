@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FIND_NODE_TIMEOUT = 3 * time.Second // 代理建立数据通道前查找节点的超时时间
+)
+
+var errNodeNotFound = errors.New("目标节点不在网络中")
+
+// 等待FIND_NODE_ACK的请求表
+type find_node_table struct {
+	seq     atomic.Uint64
+	mu      sync.Mutex
+	pending map[string]chan *FindNodeAckMessage
+}
+
+func new_find_node_table() *find_node_table {
+	return &find_node_table{
+		pending: make(map[string]chan *FindNodeAckMessage),
+	}
+}
+
+// 登记一个新请求，返回请求ID和接收结果的channel
+func (t *find_node_table) add(self string) (string, chan *FindNodeAckMessage) {
+	request_id := fmt.Sprintf("%s-%d", self, t.seq.Add(1))
+	ch := make(chan *FindNodeAckMessage, 1)
+	t.mu.Lock()
+	t.pending[request_id] = ch
+	t.mu.Unlock()
+	return request_id, ch
+}
+
+func (t *find_node_table) remove(request_id string) {
+	t.mu.Lock()
+	delete(t.pending, request_id)
+	t.mu.Unlock()
+}
+
+// 把结果交给等待的请求，返回是否有人在等
+func (t *find_node_table) deliver(ack *FindNodeAckMessage) bool {
+	t.mu.Lock()
+	ch, ok := t.pending[ack.RequestID]
+	delete(t.pending, ack.RequestID)
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	ch <- ack
+	return true
+}
+
+// 在网络中查找目标节点，直到收到回复、ctx结束或确定节点不存在
+func (f *ffmesh) FindNode(ctx context.Context, targetID string) (*FindNodeAckMessage, error) {
+	self := f.config.NodeID
+	if targetID == self || f.peers.get(targetID) != nil {
+		return &FindNodeAckMessage{NodeID: self, TargetID: targetID, IsExist: true}, nil
+	}
+
+	next := find_node_next_hop(targetID, "")
+	if next == nil {
+		return nil, fmt.Errorf("%w: %s", errNodeNotFound, targetID)
+	}
+
+	request_id, ch := f.finds.add(self)
+	defer f.finds.remove(request_id)
+
+	msg := NewQuicMessage(MSG_TYPE_FIND_NODE, next.node_id, FindNodeMessage{
+		RequestID: request_id,
+		NodeID:    self,
+		TargetID:  targetID,
+		HopLimit:  HOP_LIMIT,
+		Path:      []string{self},
+	})
+	if err := next.send_msg(msg); err != nil {
+		return nil, fmt.Errorf("发送查找节点请求失败: %v", err)
+	}
+
+	select {
+	case ack := <-ch:
+		if ack.Error != nil {
+			f.metrics.inc("find_node_error_received." + error_code_name(ack.Error.Code))
+			return ack, ack.Error
+		}
+		if !ack.IsExist {
+			return ack, fmt.Errorf("%w: %s", errNodeNotFound, targetID)
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("查找节点超时: %s: %w", targetID, ctx.Err())
+	}
+}
+
+// 查找请求的下一跳：优先走路由表，没有路由时交给上级节点
+// 不会选择上一跳和 exclude 中已经经过的节点
+func find_node_next_hop(target_id string, prev_hop string, exclude ...string) *quic_client {
+	if next := find_node_route(target_id, prev_hop, exclude...); next != nil {
+		return next
+	}
+	var next *quic_client
+	fm.peers.each(func(client *quic_client) bool {
+		if client.is_up && client.node_id != prev_hop && !contains_string(exclude, client.node_id) {
+			next = client
+			return false
+		}
+		return true
+	})
+	return next
+}
+
+// 按直连节点和路由表选择下一跳，没有路由时返回nil
+// 回复沿路由返回发起方，不交给上级节点，防止在节点之间来回转发
+func find_node_route(target_id string, prev_hop string, exclude ...string) *quic_client {
+	skip := func(node_id string) bool {
+		return node_id == prev_hop || contains_string(exclude, node_id)
+	}
+	if client := fm.peers.get(target_id); client != nil && !skip(target_id) {
+		return client
+	}
+	if route, ok := fm.routes.lookup(target_id); ok && !skip(route.next_hop) {
+		return fm.peers.get(route.next_hop)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFindNode(t *testing.T) {
+	setup_test_node()
+
+	up := dial_test_peer_up(t, "up-find-1", true)
+	defer up.close()
+	if !wait_for(t, 5*time.Second, func() bool { return fm.peers.get(up.node_id) != nil }) {
+		t.Fatal("上级节点没有注册")
+	}
+
+	// 直连节点直接返回存在
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := fm.FindNode(ctx, up.node_id); err != nil {
+		t.Fatalf("查找直连节点失败: %v", err)
+	}
+
+	// 上级节点回复存在/不存在
+	go func() {
+		for {
+			msg := up.read()
+			if msg == nil {
+				return
+			}
+			if msg.Type != MSG_TYPE_FIND_NODE {
+				continue
+			}
+			data := msg.Data.(map[string]interface{})
+			target := data["target_id"].(string)
+			up.send(MSG_TYPE_FIND_NODE_ACK, FindNodeAckMessage{
+				RequestID: data["request_id"].(string),
+				NodeID:    data["node_id"].(string),
+				TargetID:  target,
+				IsExist:   target == "far-node",
+			})
+		}
+	}()
+
+	ack, err := fm.FindNode(ctx, "far-node")
+	if err != nil || !ack.IsExist {
+		t.Fatalf("查找远端节点失败: %v", err)
+	}
+	if _, err := fm.FindNode(ctx, "missing-node"); !errors.Is(err, errNodeNotFound) {
+		t.Fatalf("查找不存在的节点应该返回errNodeNotFound, 实际: %v", err)
+	}
+}
+
+func TestFindNodeNoUpstream(t *testing.T) {
+	setup_test_node()
+
+	if !wait_for(t, 10*time.Second, func() bool { return fm.peers.len() == 0 }) {
+		t.Fatalf("还有残留的节点: %d", fm.peers.len())
+	}
+	// 没有上级节点时立即失败，不用等超时
+	start := time.Now()
+	_, err := fm.FindNode(context.Background(), "missing-node")
+	if !errors.Is(err, errNodeNotFound) {
+		t.Fatalf("应该返回errNodeNotFound, 实际: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("没有上级节点时应该立即失败")
+	}
+}
+
+// 数据通道建立失败时把错误消息返回给上一跳
+func TestDataChannelErrorReplies(t *testing.T) {
+	setup_test_node()
+
+	child := dial_test_peer_up(t, "child-hop-1", true)
+	defer child.close()
+
+	cases := []struct {
+		syn  SynDataMessage
+		code int
+	}{
+		{SynDataMessage{NodeID: "origin", TargetID: "far-node", HopLimit: 1, Path: []string{"origin", child.node_id}}, ERR_CODE_HOP_LIMIT},
+		{SynDataMessage{NodeID: "origin", TargetID: "far-node", HopLimit: 5, Path: []string{"origin", fm.config.NodeID, child.node_id}}, ERR_CODE_LOOP},
+		{SynDataMessage{NodeID: "origin", TargetID: "far-node", HopLimit: 5, Path: []string{"origin", child.node_id}}, ERR_CODE_NODE_NOT_FOUND},
+		{SynDataMessage{NodeID: "origin", TargetID: fm.config.NodeID, TargetTcpAddr: "127.0.0.1:1", HopLimit: 5, Path: []string{"origin", child.node_id}}, ERR_CODE_TARGET_UNREACHABLE},
+	}
+	before := fm.metrics.get("data_error_sent.target-unreachable")
+	for _, c := range cases {
+		reply := child.open_data(t, c.syn)
+		if reply == nil || reply.Type != MSG_TYPE_ERROR {
+			t.Fatalf("应该收到错误消息, 实际: %v", reply)
+		}
+		data := reply.Data.(map[string]interface{})
+		if int(data["code"].(float64)) != c.code || data["node_id"] != fm.config.NodeID {
+			t.Errorf("错误消息不正确, 期望错误码: %d, 实际: %v", c.code, data)
+		}
+	}
+	if fm.metrics.get("data_error_sent.target-unreachable") != before+1 {
+		t.Error("没有统计target-unreachable错误")
+	}
+}
+
+// 查找节点回复只沿路由转发回发起方，没有路由、超过跳数或出现环路时丢弃
+func TestFindNodeAckRelay(t *testing.T) {
+	setup_test_node()
+
+	up := dial_test_peer_up(t, "up-ack-1", true)
+	defer up.close()
+	child := dial_test_peer(t, "child-ack-1")
+	defer child.close()
+	if !wait_for(t, 5*time.Second, func() bool { return fm.peers.get(up.node_id) != nil && fm.peers.get(child.node_id) != nil }) {
+		t.Fatal("节点没有注册")
+	}
+	acks := make(chan map[string]interface{}, 4)
+	go func() {
+		for {
+			msg := up.read()
+			if msg == nil {
+				return
+			}
+			if msg.Type == MSG_TYPE_FIND_NODE_ACK {
+				acks <- msg.Data.(map[string]interface{})
+			}
+		}
+	}()
+
+	for _, ack := range []FindNodeAckMessage{
+		{RequestID: "no-route", NodeID: "ghost-node", TargetID: "x", HopLimit: 5, Path: []string{child.node_id}},
+		{RequestID: "hop-limit", NodeID: up.node_id, TargetID: "x", HopLimit: 1, Path: []string{child.node_id}},
+		{RequestID: "loop", NodeID: up.node_id, TargetID: "x", HopLimit: 5, Path: []string{child.node_id, fm.config.NodeID}},
+		{RequestID: "ok", NodeID: up.node_id, TargetID: "x", HopLimit: 5, Path: []string{child.node_id}},
+	} {
+		child.send(MSG_TYPE_FIND_NODE_ACK, ack)
+	}
+
+	select {
+	case ack := <-acks:
+		if ack["request_id"] != "ok" {
+			t.Fatalf("应该丢弃的回复被转发了: %v", ack)
+		}
+		if ack["hop_limit"].(float64) != 4 || len(ack["path"].([]interface{})) != 2 {
+			t.Errorf("转发的回复应该减少跳数并追加路径: %v", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("回复没有转发给发起方")
+	}
+	select {
+	case ack := <-acks:
+		t.Errorf("多转发了回复: %v", ack)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 消息帧格式：
+//
+//	长度 < 0xFFFF:  [2字节长度][内容]             （与版本1完全相同）
+//	长度 >= 0xFFFF: [0xFFFF][4字节长度][内容]     （扩展长度）
+//
+// 老版本节点发出的消息都小于64KiB，所以新旧节点可以互通
+const (
+	FRAME_EXTENDED_MARK    = 0xFFFF  // 2字节长度为此值时，后面跟4字节的真实长度
+	DEFAULT_MAX_FRAME_SIZE = 1 << 20 // 默认单条消息最大1MiB
+)
+
+var (
+	errFrameTooLarge = errors.New("消息帧超过最大长度")
+	errFrameEmpty    = errors.New("消息帧长度为0")
+)
+
+// 给内容加上帧头
+func encode_frame(payload []byte) []byte {
+	n := len(payload)
+	if n < FRAME_EXTENDED_MARK {
+		buf := make([]byte, 2, 2+n)
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		return append(buf, payload...)
+	}
+	buf := make([]byte, 6, 6+n)
+	binary.BigEndian.PutUint16(buf, FRAME_EXTENDED_MARK)
+	binary.BigEndian.PutUint32(buf[2:], uint32(n))
+	return append(buf, payload...)
+}
+
+// 读取一个完整的消息帧，max_size 为允许的最大内容长度
+// 使用 io.ReadFull，QUIC stream 的短读不会破坏帧边界
+func read_frame(r io.Reader, max_size int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:2]))
+	if n == FRAME_EXTENDED_MARK {
+		if _, err := io.ReadFull(r, header[:4]); err != nil {
+			return nil, fmt.Errorf("读取扩展长度失败: %w", unexpected_eof(err))
+		}
+		ext := binary.BigEndian.Uint32(header[:4])
+		if uint64(ext) > uint64(max_size) {
+			return nil, fmt.Errorf("%w: %d > %d", errFrameTooLarge, ext, max_size)
+		}
+		n = int(ext)
+	}
+	if n == 0 {
+		return nil, errFrameEmpty
+	}
+	if n > max_size {
+		return nil, fmt.Errorf("%w: %d > %d", errFrameTooLarge, n, max_size)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("读取消息内容失败: %w", unexpected_eof(err))
+	}
+	return buf, nil
+}
+
+// 帧头之后的EOF说明帧被截断
+func unexpected_eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
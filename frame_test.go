@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 100, FRAME_EXTENDED_MARK - 1, FRAME_EXTENDED_MARK, 200 * 1024} {
+		payload := bytes.Repeat([]byte{'x'}, n)
+		// 每次只读1个字节，模拟QUIC stream的短读
+		r := iotest.OneByteReader(bytes.NewReader(encode_frame(payload)))
+		buf, err := read_frame(r, DEFAULT_MAX_FRAME_SIZE)
+		if err != nil {
+			t.Fatalf("读取%d字节的消息帧失败: %v", n, err)
+		}
+		if !bytes.Equal(buf, payload) {
+			t.Fatalf("%d字节的消息帧内容不一致", n)
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	big := encode_frame(bytes.Repeat([]byte{'x'}, 2048))
+	if _, err := read_frame(bytes.NewReader(big), 1024); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("超长消息帧应该返回errFrameTooLarge, 实际: %v", err)
+	}
+	ext := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	if _, err := read_frame(bytes.NewReader(ext), DEFAULT_MAX_FRAME_SIZE); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("超长扩展长度应该返回errFrameTooLarge, 实际: %v", err)
+	}
+	if _, err := read_frame(bytes.NewReader([]byte{0, 0}), DEFAULT_MAX_FRAME_SIZE); !errors.Is(err, errFrameEmpty) {
+		t.Errorf("空消息帧应该返回errFrameEmpty, 实际: %v", err)
+	}
+	if _, err := read_frame(bytes.NewReader(nil), DEFAULT_MAX_FRAME_SIZE); err != io.EOF {
+		t.Errorf("没有数据时应该返回io.EOF, 实际: %v", err)
+	}
+	if _, err := read_frame(bytes.NewReader(big[:100]), DEFAULT_MAX_FRAME_SIZE); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("截断的消息帧应该返回io.ErrUnexpectedEOF, 实际: %v", err)
+	}
+}
+
+// 旧版本的帧（2字节长度）可以直接读取
+func TestFrameCompatible(t *testing.T) {
+	body := `{"type":4,"from_id":"a","to_id":"b","data":{}}`
+	old := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(old, uint16(len(body)))
+	old = append(old, body...)
+
+	msg, err := read_quic_message(bytes.NewReader(old), DEFAULT_MAX_FRAME_SIZE)
+	if err != nil {
+		t.Fatalf("读取旧版本消息失败: %v", err)
+	}
+	if _, ok := msg.Data.(*PingMessage); msg.Type != MSG_TYPE_PING || msg.FromID != "a" || !ok {
+		t.Errorf("消息解析不正确: %+v", msg)
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	routes := make([]RouteInfo, 0, 2000)
+	for i := 0; i < cap(routes); i++ {
+		routes = append(routes, RouteInfo{NodeID: strings.Repeat("n", 40), Cost: 1, Path: []string{"a", "b"}})
+	}
+	msg := NewQuicMessage(MSG_TYPE_ROUTE_UPDATE, "b", RouteUpdateMessage{Routes: routes})
+	msg.FromID = "a"
+	buf := msg.ToBuffer()
+	if len(buf) <= FRAME_EXTENDED_MARK {
+		t.Fatalf("测试消息应该超过64KiB, 实际: %d", len(buf))
+	}
+	got, err := read_quic_message(bytes.NewReader(buf), DEFAULT_MAX_FRAME_SIZE)
+	if err != nil {
+		t.Fatalf("读取大消息失败: %v", err)
+	}
+	if len(got.Data.(*RouteUpdateMessage).Routes) != len(routes) {
+		t.Error("大消息内容不完整")
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(encode_frame([]byte(`{"type":4}`)))
+	f.Add([]byte{0xFF, 0xFF, 0, 0, 0, 1, 'x'})
+	f.Add([]byte{0, 5, 'a'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buf, err := read_frame(bytes.NewReader(data), 4096)
+		if err != nil {
+			return
+		}
+		if len(buf) == 0 || len(buf) > 4096 {
+			t.Fatalf("消息帧长度不正确: %d", len(buf))
+		}
+		again, err := read_frame(bytes.NewReader(encode_frame(buf)), 4096)
+		if err != nil || !bytes.Equal(again, buf) {
+			t.Fatalf("重新编码后的消息帧不一致: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeQuicMessage(f *testing.F) {
+	f.Add([]byte(`{"type":4,"from_id":"a","to_id":"b","data":{"timestamp":1}}`))
+	f.Add([]byte(`{"type":8,"data":{"routes":[{"node_id":"x","cost":1,"path":["x"]}]}}`))
+	f.Add([]byte(`{"type":99,"data":null}`))
+	f.Add([]byte(`{"type":2,"data":"oops"}`))
+	for _, msg := range sample_messages() {
+		buf := msg.encode(codecs[CODEC_CBOR])
+		f.Add(buf[2:])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decode_quic_message(data)
+		if err != nil {
+			return
+		}
+		// 已知的消息类型一定解析成对应的结构体
+		if info, ok := msg_types[msg.Type]; ok && info.new_data != nil && msg.Data == nil {
+			t.Fatalf("%s消息没有解析Data", info.name)
+		}
+		// 解析成功的消息可以重新编码
+		if _, err := read_quic_message(bytes.NewReader(msg.ToBuffer()), 1<<30); err != nil {
+			t.Fatalf("重新编码后读取失败: %v", err)
+		}
+	})
+}
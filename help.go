@@ -1,91 +1,58 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
-func delete_quic_client(conn quic.Connection) {
-	for node_id, streaminfo := range fm.quic_client {
-		if streaminfo.conn == conn {
-			if fm.quic_client[node_id].conn != nil {
-				fm.quic_client[node_id].conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "accept stream error")
-			}
-			for _, streaminfo := range streaminfo.streaminfo {
-				if streaminfo.stream != nil {
-					streaminfo.stream.Close()
-				}
-			}
-			delete(fm.quic_client, node_id)
-			break
-		}
-	}
-}
+var (
+	errNoMsgStream    = errors.New("消息通道不存在")
+	errMsgUnsupported = errors.New("对端不支持该消息")
+)
 
-// 如果id+conn 发生了改变，删除原有conn
-func delete_quic_client_when_conn_change(node_id string, conn quic.Connection) {
-	client := fm.quic_client[node_id]
-	if client == nil {
-		return
-	}
-	if client.conn != conn {
-		client.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "already connected")
-		for _, streaminfo := range client.streaminfo {
-			streaminfo.stream.Close()
-		}
-		delete(fm.quic_client, node_id)
-	}
+// 删除conn对应的节点
+func delete_quic_client(conn quic.Connection) {
+	fm.peers.remove_by_conn(conn, "accept stream error")
 }
 
-// 存入新的quic的stream
-func save_quic_stream(node_id string, conn quic.Connection, stream quic.Stream, is_up bool, version int) {
-	if fm.quic_client[node_id] == nil {
-		fm.quic_client[node_id] = &quic_client{
-			node_id:    node_id,
-			conn:       conn,
-			streaminfo: []streaminfo{},
-			is_up:      is_up,
-			version:    version,
-		}
-	}
-	fm.quic_client[node_id].streaminfo = append(fm.quic_client[node_id].streaminfo, streaminfo{stream: stream, link_type: LINK_TYPE_MSG})
+// 存入新的quic的stream，如果id+conn 发生了改变，会替换并关闭原有conn
+func save_quic_stream(node_id string, conn quic.Connection, stream quic.Stream, is_up bool, version int, caps uint32) *quic_client {
+	return fm.peers.save(node_id, conn, stream, is_up, version, caps)
 }
 
-func quic_send_syn_msg(stream quic.SendStream, node_id string) {
+func quic_send_syn_msg(conn quic.Connection, stream quic.SendStream, node_id string) {
 	isup := false
 	if fm.config.IsQuicEnabled() {
 		isup = true
 	}
-	msgsyn := NewQuicMessage(MSG_TYPE_SYN_MSG, node_id, SynMsgMessage{Version: VERSION, NodeID: fm.config.NodeID, IsUp: isup})
+	pub, sig := sign_node_key(conn, IDENTITY_ROLE_SYN)
+	msgsyn := NewQuicMessage(MSG_TYPE_SYN_MSG, node_id, SynMsgMessage{
+		Version:      VERSION,
+		MinVersion:   MIN_VERSION,
+		Capabilities: local_capabilities(),
+		NodeID:       fm.config.NodeID,
+		IsUp:         isup,
+		PublicKey:    pub,
+		Signature:    sig,
+		Auth:         mesh_auth(conn, fm.config.Quic.GetUpstreamSecret(node_id), AUTH_ROLE_SYN, fm.config.NodeID),
+	})
 	stream.Write(msgsyn.ToBuffer())
 }
 
-// 如果id+conn 发生了改变，删除原有conn
-func delete_quic_client_by_id(node_id string) {
-	client := fm.quic_client[node_id]
-	if client == nil {
-		return
-	}
-	if client.conn != nil {
-		client.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "already connected")
-	}
-	for _, streaminfo := range client.streaminfo {
-		streaminfo.stream.Close()
-	}
-	delete(fm.quic_client, node_id)
-}
-
 // 验证syn ack
 func get_syn_ack(stream quic.Stream, msgtype int) *SynAckMsgMessage {
 	if stream == nil {
 		fmt.Printf("stream为空\n")
 		return nil
 	}
-	msgack := QuicMessageFromStream(stream)
-	if msgack == nil {
-		fmt.Printf("msgack为空\n")
+	msgack, err := QuicMessageFromStream(stream)
+	if err != nil {
+		fmt.Printf("读取synack失败: %v\n", err)
 		return nil
 	}
 	if msgack.Type != msgtype {
@@ -100,38 +67,144 @@ func get_syn_ack(stream quic.Stream, msgtype int) *SynAckMsgMessage {
 	return synack
 }
 
-func send_syn_data(remote_node_id string, stream quic.Stream, target_node_id string, target_address string) bool {
-	ok := false
+// 数据通道握手等待synack的超时时间，每经过一个中继减少1秒，保证下游的超时错误能先传回来
+func syn_data_timeout(hops int) time.Duration {
+	timeout := SYN_DATA_TIMEOUT - time.Duration(hops)*time.Second
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	return timeout
+}
 
-	go func() {
-		time.Sleep(time.Second * 3)
-		if !ok {
-			stream.Close()
-		}
-	}()
+// 发送数据通道握手并等待synack
+// 下游返回的错误原样返回，本节点等待超时等错误会生成新的错误消息
+func send_syn_data(remote_node_id string, stream quic.Stream, syn SynDataMessage) *ErrorMessage {
+	timeout := syn_data_timeout(len(syn.Path) - 1)
+	stream.SetReadDeadline(time.Now().Add(timeout))
+	defer stream.SetReadDeadline(time.Time{})
 
 	// 发送syn
-	msgsyn := NewQuicMessage(MSG_TYPE_SYN_DATA, remote_node_id, SynDataMessage{NodeID: fm.config.NodeID, TargetID: target_node_id, TargetTcpAddr: target_address})
-	stream.Write(msgsyn.ToBuffer())
+	msgsyn := NewQuicMessage(MSG_TYPE_SYN_DATA, remote_node_id, syn)
+	if _, err := stream.Write(msgsyn.ToBuffer()); err != nil {
+		return new_error_message(ERR_CODE_NODE_NOT_FOUND, fmt.Sprintf("向下一跳%s发送握手失败: %v", remote_node_id, err))
+	}
 
 	// 接收synack
-	msgack := QuicMessageFromStream(stream)
-	if msgack == nil || msgack.Type != MSG_TYPE_SYN_ACK_DATA {
-		fmt.Printf("接收synack失败\n")
-		return false
+	msgack, err := QuicMessageFromStream(stream)
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return new_error_message(ERR_CODE_TIMEOUT, fmt.Sprintf("等待下一跳%s回复超时(%v)", remote_node_id, timeout))
+		}
+		return new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("读取下一跳%s的回复失败: %v", remote_node_id, err))
 	}
-	ok = true
-	return true
+	switch msgack.Type {
+	case MSG_TYPE_SYN_ACK_DATA:
+		return nil
+	case MSG_TYPE_ERROR:
+		return msgack.Data.(*ErrorMessage)
+	}
+	return new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("下一跳%s回复了未知消息: %d", remote_node_id, msgack.Type))
 }
 
-func getupnodestream(notid1, notid2 string) (quic.Stream, string) {
-	for cid, client := range fm.quic_client {
-		if client.is_up && cid != notid1 && cid != notid2 {
-			// 向client中的消息通道发送findNodeMsg
-			if len(client.streaminfo) > 0 && client.streaminfo[0].stream != nil {
-				return client.streaminfo[0].stream, cid
-			}
+// 在数据通道上向上一跳回复错误，上一跳是不支持错误回复的老版本节点时只关闭数据通道
+func send_error(stream quic.Stream, to string, merr *ErrorMessage) {
+	if client := fm.peers.get(to); client != nil && !client.supports(MSG_TYPE_ERROR) {
+		return
+	}
+	if merr.NodeID == fm.config.NodeID {
+		fm.metrics.inc("data_error_sent." + error_code_name(merr.Code))
+	} else {
+		fm.metrics.inc("data_error_relayed." + error_code_name(merr.Code))
+	}
+	msg := NewQuicMessage(MSG_TYPE_ERROR, to, merr)
+	stream.Write(msg.ToBuffer())
+}
+
+// 检查中继请求的剩余跳数和已经过的路径
+// 返回转发给下一跳时使用的跳数和路径（追加了本节点）
+func check_relay_hops(hop_limit int, path []string) (int, []string, *ErrorMessage) {
+	self := fm.config.NodeID
+	if contains_string(path, self) {
+		return 0, nil, new_error_message(ERR_CODE_LOOP, fmt.Sprintf("路径中已经包含本节点: %v", path))
+	}
+	// 老版本节点不带跳数限制
+	if hop_limit == 0 {
+		hop_limit = HOP_LIMIT
+	}
+	if hop_limit <= 1 {
+		return 0, nil, new_error_message(ERR_CODE_HOP_LIMIT, fmt.Sprintf("经过%d个节点后超过跳数限制", len(path)))
+	}
+	next_path := make([]string, 0, len(path)+1)
+	next_path = append(next_path, path...)
+	next_path = append(next_path, self)
+	return hop_limit - 1, next_path, nil
+}
+
+// 数据通道的来源节点：发起方自己填写的node_id要和上一跳、路径对得上
+// 直连时发起方就是上一跳；多跳时上一跳必须是中继节点（is_up），路径从发起方开始、以上一跳结束，中间经过的节点由上一跳转述
+// 叶子节点不会替别人转发，它发来的多跳数据通道只可能是冒充来源
+func data_source(syn *SynDataMessage, prev_hop string) (string, *ErrorMessage) {
+	path := syn.Path
+	if len(path) <= 1 {
+		if syn.NodeID != prev_hop || (len(path) == 1 && path[0] != prev_hop) {
+			return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("来源节点%s与上一跳%s不一致", syn.NodeID, prev_hop))
+		}
+		return prev_hop, nil
+	}
+	if client := fm.peers.get(prev_hop); client == nil || !client.is_up {
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("上一跳%s不是中继节点，不能转发%s的数据通道", prev_hop, syn.NodeID))
+	}
+	if path[0] != syn.NodeID || path[len(path)-1] != prev_hop {
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("来源节点%s与路径%v不一致(上一跳%s)", syn.NodeID, path, prev_hop))
+	}
+	return syn.NodeID, nil
+}
+
+// 数据通道的扩展字段需要下一跳支持：老版本节点会忽略不认识的字段，按TCP连接目标，出错了也没有任何提示
+// 每一跳都检查自己的下一跳，整条路径上的节点就都支持
+func check_data_caps(syn *SynDataMessage, client *quic_client) *ErrorMessage {
+	if syn.Protocol == PROTO_UDP && !client.has_cap(CAP_DATA_UDP) {
+		return new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("下一跳%s不支持UDP数据通道(版本%d)", client.node_id, client.version))
+	}
+	if syn.ProxyProtocol != "" && !client.has_cap(CAP_DATA_PROXY) {
+		return new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("下一跳%s不支持PROXY协议头(版本%d)", client.node_id, client.version))
+	}
+	return nil
+}
+
+// 按路由表选择下一跳，打开数据通道并完成握手
+// prev_hop 是数据通道的上一跳节点，路由不会再绕回它或者 syn.Path 中已经经过的节点
+func open_data_channel(syn SynDataMessage, prev_hop string) (quic.Stream, string, *ErrorMessage) {
+	route, ok := fm.routes.lookup(syn.TargetID)
+	if !ok {
+		return nil, "", new_error_message(ERR_CODE_NODE_NOT_FOUND, fmt.Sprintf("没有到目标节点%s的路由", syn.TargetID))
+	}
+	if (prev_hop != "" && route.next_hop == prev_hop) || contains_string(syn.Path, route.next_hop) {
+		return nil, "", new_error_message(ERR_CODE_LOOP, fmt.Sprintf("到%s的路由指回了已经经过的节点%s", syn.TargetID, route.next_hop))
+	}
+	client := fm.peers.get(route.next_hop)
+	if client == nil || client.conn == nil {
+		return nil, "", new_error_message(ERR_CODE_NODE_NOT_FOUND, fmt.Sprintf("下一跳节点%s连接不存在", route.next_hop))
+	}
+
+	if merr := check_data_caps(&syn, client); merr != nil {
+		return nil, "", merr
+	}
+
+	// 对端stream数量达到上限时OpenStreamSync会一直阻塞
+	ctx, cancel := context.WithTimeout(context.Background(), OPEN_STREAM_TIMEOUT)
+	stream, err := client.conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, "", new_error_message(ERR_CODE_OVERLOADED, fmt.Sprintf("下一跳%s的数据通道已满", route.next_hop))
 		}
+		return nil, "", new_error_message(ERR_CODE_NODE_NOT_FOUND, fmt.Sprintf("向下一跳%s打开stream失败: %v", route.next_hop, err))
+	}
+	if merr := send_syn_data(route.next_hop, stream, syn); merr != nil {
+		stream.Close()
+		return nil, "", merr
 	}
-	return nil, ""
+	return stream, route.next_hop, nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP代理入站：CONNECT隧道和绝对URI的普通HTTP请求
+// 按目标地址选择出口节点，通过数据通道连接；组网返回错误时回复502，超时回复504
+const (
+	HTTP_PROXY_HEADER_TIMEOUT = 10 * time.Second
+	HTTP_PROXY_REALM          = "ffmesh"
+)
+
+type exit_node_key struct{}
+
+type http_proxy struct {
+	listener *ListenerConfig
+	forward  *httputil.ReverseProxy
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport // 出口节点 -> 连接池
+}
+
+func new_http_proxy(l *ListenerConfig) *http_proxy {
+	p := &http_proxy{listener: l, transports: make(map[string]*http.Transport)}
+	p.forward = &httputil.ReverseProxy{
+		// 请求已经是绝对URI，不需要改写目标
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: p,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http_gateway_error(w, r, err, "HTTP代理", l.Name)
+		},
+	}
+	return p
+}
+
+func http_proxy_main(l ListenerConfig) {
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		fmt.Printf("⚠️  启动HTTP代理监听器失败 [%s]: %v\n", l.Name, err)
+		return
+	}
+	defer listener.Close()
+	fmt.Printf("🌐 HTTP代理监听器 [%s]: %s\n", l.Name, l.Listen)
+	http_proxy_serve(listener, &l)
+}
+
+func http_proxy_serve(listener net.Listener, l *ListenerConfig) {
+	server := &http.Server{
+		Handler:           new_http_proxy(l),
+		ReadHeaderTimeout: HTTP_PROXY_HEADER_TIMEOUT,
+	}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Printf("⚠️  HTTP代理监听器 [%s] 退出: %v\n", l.Name, err)
+	}
+}
+
+// 读取 Proxy-Authorization: Basic 用户名密码
+func http_proxy_auth(r *http.Request) (string, string, bool) {
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// 数据通道错误转换成HTTP状态码
+func http_proxy_status(merr *ErrorMessage) int {
+	switch merr.Code {
+	case ERR_CODE_REFUSED_BY_ACL:
+		return http.StatusForbidden
+	case ERR_CODE_TIMEOUT:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (p *http_proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := p.listener
+	// 配置了用户时必须认证；没有配置用户时用户名只用于选择出口节点
+	username, password, ok := http_proxy_auth(r)
+	if len(l.Users) > 0 && (!ok || !l.check_user(username, password)) {
+		fm.metrics.inc("auth_failed.http_proxy")
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", HTTP_PROXY_REALM))
+		http.Error(w, "需要代理认证", http.StatusProxyAuthRequired)
+		return
+	}
+
+	var addr string
+	switch {
+	case r.Method == http.MethodConnect:
+		addr = r.Host
+	case r.URL.IsAbs() && r.URL.Scheme == "http":
+		addr = r.URL.Host
+		if r.URL.Port() == "" {
+			addr = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	default:
+		http.Error(w, "只支持CONNECT和http://绝对URI请求", http.StatusBadRequest)
+		return
+	}
+	host, port_str, err := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(port_str)
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(w, "目标地址无效", http.StatusBadRequest)
+		return
+	}
+	node_id := l.exit_node(username, host, port)
+	if node_id == "" {
+		fmt.Printf("⚠️  HTTP代理 [%s]: 没有到%s的出口节点\n", l.Name, addr)
+		http.Error(w, "没有出口节点", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, node_id, addr, r.RemoteAddr)
+		return
+	}
+	p.forward.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exit_node_key{}, node_id)))
+}
+
+// CONNECT：建立数据通道后回复200，之后双向转发
+func (p *http_proxy) connect(w http.ResponseWriter, node_id string, addr string, client_addr string) {
+	conn, err := mesh_dial_conn(SynDataMessage{TargetID: node_id, TargetTcpAddr: addr, ClientAddr: client_addr})
+	if err != nil {
+		// 错误详情只写日志，不回复给客户端：里面有节点ID、路径等组网内部信息
+		fmt.Printf("⚠️  HTTP代理 [%s]: 连接%s失败: %v\n", p.listener.Name, addr, err)
+		status := http_proxy_status(err.(*ErrorMessage))
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer conn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "不支持CONNECT", http.StatusInternalServerError)
+		return
+	}
+	client, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Time{})
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	ch := make(chan bool, 1)
+	go func() {
+		io.Copy(client, conn)
+		ch <- true
+	}()
+	go func() {
+		// 客户端可能在收到200之前就发送了数据，先转发已缓存的部分
+		io.Copy(conn, rw.Reader)
+		ch <- true
+	}()
+	<-ch
+}
+
+// 普通HTTP请求：每个出口节点一个连接池，连接通过数据通道建立
+// 连接会被不同客户端复用，不带客户端地址
+func (p *http_proxy) RoundTrip(r *http.Request) (*http.Response, error) {
+	node_id, _ := r.Context().Value(exit_node_key{}).(string)
+	return p.transport(node_id).RoundTrip(r)
+}
+
+func (p *http_proxy) transport(node_id string) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.transports[node_id]
+	if t == nil {
+		t = &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return mesh_dial_conn(SynDataMessage{TargetID: node_id, TargetTcpAddr: addr})
+			},
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		p.transports[node_id] = t
+	}
+	return t
+}
+
+// 转发请求失败时按数据通道错误回复502/504等状态码
+func http_gateway_error(w http.ResponseWriter, r *http.Request, err error, kind string, name string) {
+	fmt.Printf("⚠️  %s [%s]: 转发%s%s失败: %v\n", kind, name, r.Host, r.URL.Path, err)
+	status := http.StatusBadGateway
+	var merr *ErrorMessage
+	if errors.As(err, &merr) {
+		status = http_proxy_status(merr)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	w.WriteHeader(status)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestHTTPProxyStatus(t *testing.T) {
+	for code, want := range map[int]int{
+		ERR_CODE_REFUSED_BY_ACL:     http.StatusForbidden,
+		ERR_CODE_TIMEOUT:            http.StatusGatewayTimeout,
+		ERR_CODE_TARGET_UNREACHABLE: http.StatusBadGateway,
+		ERR_CODE_NODE_NOT_FOUND:     http.StatusBadGateway,
+	} {
+		if got := http_proxy_status(&ErrorMessage{Code: code}); got != want {
+			t.Errorf("%s 应该回复%d, 实际: %d", error_code_name(code), want, got)
+		}
+	}
+}
+
+func TestHTTPProxyListener(t *testing.T) {
+	setup_test_node()
+
+	exit := dial_test_peer(t, "http-exit-1")
+	defer exit.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(exit.node_id) != nil }) {
+		t.Fatal("出口节点没有注册")
+	}
+	// 模拟出口节点：80端口是HTTP服务，回复目标地址和路径；其他端口回显目标地址和数据
+	exit.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		target := syn["target_tcp_addr"].(string)
+		if _, port, _ := net.SplitHostPort(target); port != "80" {
+			stream.Write([]byte(target + "|"))
+			io.Copy(stream, stream)
+			return
+		}
+		br := bufio.NewReader(stream)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			body := target + req.URL.Path
+			if req.Header.Get("Proxy-Authorization") != "" {
+				body = "凭据泄露"
+			}
+			fmt.Fprintf(stream, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	})
+
+	l := ListenerConfig{
+		Name:   "web",
+		Type:   LISTENER_HTTP_PROXY,
+		Listen: "127.0.0.1:0",
+		Users:  []ListenerUser{{Username: "alice", Password: "secret"}},
+		Routes: []ListenerRoute{
+			{Destinations: []string{"*.corp"}, Node: exit.node_id},
+			{Destinations: []string{"*.gone"}, Node: "missing-node"},
+		},
+	}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http_proxy_serve(listener, &l)
+
+	client := func(user string, pass string) *http.Client {
+		proxy := &url.URL{Scheme: "http", Host: listener.Addr().String(), User: url.UserPassword(user, pass)}
+		return &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+			Timeout:   10 * time.Second,
+		}
+	}
+
+	// 普通HTTP请求
+	for _, c := range []struct {
+		user string
+		url  string
+		want int
+		body string
+	}{
+		{"alice", "http://wiki.corp/index", http.StatusOK, "wiki.corp:80/index"},
+		{"alice@" + exit.node_id, "http://example.com/", http.StatusOK, "example.com:80/"},
+		{"alice", "http://example.com/", http.StatusForbidden, ""},
+		{"alice", "http://host.gone/", http.StatusBadGateway, ""},
+	} {
+		resp, err := client(c.user, "secret").Get(c.url)
+		if err != nil {
+			t.Fatalf("%s: %v", c.url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.want || (c.body != "" && string(body) != c.body) {
+			t.Errorf("[%s] %s 应该回复%d %q, 实际: %d %q", c.user, c.url, c.want, c.body, resp.StatusCode, body)
+		}
+	}
+	resp, err := client("alice", "wrong").Get("http://wiki.corp/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("密码错误应该回复407, 实际: %d", resp.StatusCode)
+	}
+
+	// CONNECT隧道：200之后双向转发
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, _ := http.NewRequest(http.MethodConnect, "http://git.corp:22", nil)
+	req.Host = "git.corp:22"
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	connect, err := http.ReadResponse(br, req)
+	if err != nil || connect.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT失败: %v %v", connect, err)
+	}
+	conn.Write([]byte("hello"))
+	want := "git.corp:22|hello"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != want {
+		t.Errorf("隧道数据不正确: %q %v", buf, err)
+	}
+
+	// 连接失败只回复状态码，不带组网内部的错误详情
+	gone, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gone.Close()
+	gone.SetDeadline(time.Now().Add(10 * time.Second))
+	req.Host = "host.gone:443"
+	req.URL.Host = req.Host
+	req.Write(gone)
+	resp, err = http.ReadResponse(bufio.NewReader(gone), req)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("连接失败应该回复502: %v %v", resp, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != http.StatusText(http.StatusBadGateway) {
+		t.Errorf("回复不应该包含错误详情: %q", body)
+	}
+}
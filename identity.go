@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 密钥身份：每个节点持有一对Ed25519密钥，节点ID由公钥推导
+// 握手时双方对本连接的TLS导出密钥（每条连接都不同，作为挑战值）签名，对端不需要CA就能验证节点ID属于对方
+const (
+	NODE_KEY_ID_BYTES   = 12 // 节点ID取公钥SHA-256的前12字节（24位16进制）
+	IDENTITY_EXPORT_LEN = 32
+
+	IDENTITY_EXPORT_LABEL = "EXPORTER-ffmesh-node-identity"
+	IDENTITY_ROLE_SYN     = "ffmesh syn_msg"     // 连接方在SYN_MSG中的签名
+	IDENTITY_ROLE_SYN_ACK = "ffmesh syn_ack_msg" // 监听方在SYN_ACK_MSG中的签名
+)
+
+var errNoNodeKey = errors.New("对端没有提供节点公钥")
+
+type node_identity struct {
+	key     ed25519.PrivateKey
+	node_id string
+}
+
+// 由公钥推导节点ID
+func node_id_from_key(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:NODE_KEY_ID_BYTES])
+}
+
+// 加载节点密钥，文件不存在时生成并保存
+func load_node_identity(path string) (*node_identity, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generate_node_identity(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取节点密钥失败: %w", err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("节点密钥格式错误: %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析节点密钥失败: %w", err)
+	}
+	ed_key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("节点密钥不是Ed25519密钥: %s", path)
+	}
+	return new_node_identity(ed_key), nil
+}
+
+func generate_node_identity(path string) (*node_identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := write_private_key(path, key, false); err != nil {
+		return nil, err
+	}
+	id := new_node_identity(key)
+	fmt.Printf("🔑 已生成节点密钥: %s (节点ID: %s)\n", path, id.node_id)
+	return id, nil
+}
+
+func new_node_identity(key ed25519.PrivateKey) *node_identity {
+	return &node_identity{
+		key:     key,
+		node_id: node_id_from_key(key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// 本连接的挑战值，双方计算结果相同，中间人的两条TLS连接得到的值不同
+func identity_challenge(conn quic.Connection, role string, node_id string) ([]byte, error) {
+	tls_state := conn.ConnectionState().TLS
+	ekm, err := tls_state.ExportKeyingMaterial(IDENTITY_EXPORT_LABEL, nil, IDENTITY_EXPORT_LEN)
+	if err != nil {
+		return nil, fmt.Errorf("导出挑战值失败: %w", err)
+	}
+	msg := make([]byte, 0, len(role)+1+len(node_id)+1+len(ekm))
+	msg = append(msg, role...)
+	msg = append(msg, 0)
+	msg = append(msg, node_id...)
+	msg = append(msg, 0)
+	return append(msg, ekm...), nil
+}
+
+// 对挑战值签名，返回公钥和签名
+func (id *node_identity) sign(conn quic.Connection, role string) ([]byte, []byte, error) {
+	challenge, err := identity_challenge(conn, role, id.node_id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id.key.Public().(ed25519.PublicKey), ed25519.Sign(id.key, challenge), nil
+}
+
+// 验证对端声称的节点ID属于它提供的公钥，并且签名有效
+func verify_node_key(conn quic.Connection, role string, node_id string, pub []byte, sig []byte) error {
+	if len(pub) == 0 {
+		return errNoNodeKey
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("节点公钥长度错误: %d", len(pub))
+	}
+	if derived := node_id_from_key(pub); derived != node_id {
+		return fmt.Errorf("节点ID与公钥不匹配: 公钥对应%s, 声称为%s", derived, node_id)
+	}
+	challenge, err := identity_challenge(conn, role, node_id)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, challenge, sig) {
+		return errors.New("节点密钥签名无效")
+	}
+	return nil
+}
+
+// 用密钥证明过身份的节点ID
+// 不要求密钥身份时，这些ID也不能再以无公钥的方式握手，否则冒用者会在节点表中顶替真正的对端
+type node_key_table struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func new_node_key_table() *node_key_table {
+	return &node_key_table{ids: make(map[string]bool)}
+}
+
+func (t *node_key_table) add(node_id string) {
+	t.mu.Lock()
+	t.ids[node_id] = true
+	t.mu.Unlock()
+}
+
+// 节点ID是否属于已知的密钥：本节点的密钥，或者对端曾经用密钥验证过
+func (t *node_key_table) known(node_id string) bool {
+	if id := fm.config.identity; id != nil && id.node_id == node_id {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ids[node_id]
+}
+
+// 握手时校验对端的密钥身份：提供了公钥就必须验证通过，没有提供时看是否要求密钥身份
+func check_node_key(conn quic.Connection, role string, node_id string, pub []byte, sig []byte) error {
+	err := verify_node_key(conn, role, node_id, pub, sig)
+	if err == nil {
+		fm.node_keys.add(node_id)
+		return nil
+	}
+	if errors.Is(err, errNoNodeKey) && !fm.config.Identity.Require {
+		if fm.node_keys.known(node_id) {
+			return fmt.Errorf("节点%s使用密钥身份，没有提供公钥", node_id)
+		}
+		return nil
+	}
+	return err
+}
+
+// 本节点的签名，未启用密钥身份时返回空
+func sign_node_key(conn quic.Connection, role string) ([]byte, []byte) {
+	if fm.config.identity == nil {
+		return nil, nil
+	}
+	pub, sig, err := fm.config.identity.sign(conn, role)
+	if err != nil {
+		fmt.Printf("⚠️  节点密钥签名失败: %v\n", err)
+		return nil, nil
+	}
+	return pub, sig
+}
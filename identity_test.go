@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodeIdentityConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node.yaml")
+	os.WriteFile(path, []byte("identity:\n  key: node.key\nquic:\n  listen_port: 3334\n"), 0644)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	if config.identity == nil || config.NodeID != config.identity.node_id || len(config.NodeID) != 2*NODE_KEY_ID_BYTES {
+		t.Fatalf("节点ID应该由公钥推导: %s", config.NodeID)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "node.key")); err != nil {
+		t.Fatalf("节点密钥没有保存: %v", err)
+	}
+
+	// 再次加载得到相同的节点ID
+	again, err := LoadConfig(path)
+	if err != nil || again.NodeID != config.NodeID {
+		t.Fatalf("再次加载节点ID不一致: %v %s", err, again.NodeID)
+	}
+
+	// 节点ID与密钥不一致时拒绝启动
+	os.WriteFile(path, []byte("node_id: 0123456789\nidentity:\n  key: node.key\n"), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("节点ID与密钥不一致时应该加载失败")
+	}
+}
+
+func new_test_identity(t *testing.T) *node_identity {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return new_node_identity(key)
+}
+
+// 用密钥身份握手，sign_conn 为签名使用的连接（用来模拟重放）
+func key_handshake(t *testing.T, id *node_identity, node_id string, sign_conn *test_peer) (*test_peer, bool) {
+	t.Helper()
+	p := dial_test_peer_conn(t, node_id)
+	if sign_conn == nil {
+		sign_conn = p
+	}
+	pub, sig, err := id.sign(sign_conn.conn, IDENTITY_ROLE_SYN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node_id != id.node_id {
+		// 用别人的节点ID重新签名
+		challenge, _ := identity_challenge(sign_conn.conn, IDENTITY_ROLE_SYN, node_id)
+		sig = ed25519.Sign(id.key, challenge)
+	}
+	p.send(MSG_TYPE_SYN_MSG, SynMsgMessage{
+		Version:      VERSION,
+		MinVersion:   MIN_VERSION,
+		Capabilities: CAPABILITIES &^ CAP_CODEC_CBOR,
+		NodeID:       node_id,
+		PublicKey:    pub,
+		Signature:    sig,
+	})
+	ack := p.read()
+	return p, ack != nil && ack.Data.(map[string]interface{})["result"].(bool)
+}
+
+func TestNodeKeyHandshake(t *testing.T) {
+	setup_test_node()
+
+	id := new_test_identity(t)
+	p, ok := key_handshake(t, id, id.node_id, nil)
+	defer p.close()
+	if !ok {
+		t.Fatal("签名正确的节点应该握手成功")
+	}
+
+	// 公钥推导不出声称的节点ID
+	other, ok := key_handshake(t, id, "someone-else", nil)
+	defer other.close()
+	if ok {
+		t.Error("节点ID与公钥不匹配时应该被拒绝")
+	}
+
+	// 重放其他连接上的签名
+	replay, ok := key_handshake(t, id, id.node_id, p)
+	defer replay.close()
+	if ok {
+		t.Error("其他连接上的签名应该被拒绝")
+	}
+
+	// 要求密钥身份：没有公钥的节点被拒绝，回复中带本节点签名
+	server := new_test_identity(t)
+	fm.config.identity = server
+	fm.config.Identity.Require = true
+	defer func() {
+		fm.config.identity = nil
+		fm.config.Identity.Require = false
+	}()
+
+	plain, ack := dial_test_peer_syn(t, SynMsgMessage{Version: VERSION, MinVersion: MIN_VERSION, NodeID: "plain-node-1"})
+	defer plain.close()
+	if ack == nil || ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Error("要求密钥身份时没有公钥的节点应该被拒绝")
+	}
+
+	signed := dial_test_peer_conn(t, "")
+	defer signed.close()
+	client := new_test_identity(t)
+	signed.node_id = client.node_id
+	pub, sig, _ := client.sign(signed.conn, IDENTITY_ROLE_SYN)
+	signed.send(MSG_TYPE_SYN_MSG, SynMsgMessage{Version: VERSION, MinVersion: MIN_VERSION, NodeID: client.node_id, PublicKey: pub, Signature: sig})
+	ack = signed.read()
+	if ack == nil || !ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Fatalf("签名正确的节点应该握手成功: %v", ack)
+	}
+	data := ack.Data.(map[string]interface{})
+	server_pub, _ := base64.StdEncoding.DecodeString(data["public_key"].(string))
+	server_sig, _ := base64.StdEncoding.DecodeString(data["signature"].(string))
+	if err := verify_node_key(signed.conn, IDENTITY_ROLE_SYN_ACK, server.node_id, server_pub, server_sig); err != nil {
+		t.Errorf("监听节点的签名验证失败: %v", err)
+	}
+}
+
+// 不提供公钥冒用已经用密钥验证过的节点ID，不能顶替真正的对端
+func TestNodeKeySpoof(t *testing.T) {
+	setup_test_node()
+
+	id := new_test_identity(t)
+	p, ok := key_handshake(t, id, id.node_id, nil)
+	defer p.close()
+	if !ok {
+		t.Fatal("签名正确的节点应该握手成功")
+	}
+
+	spoof, spoof_ack := dial_test_peer_syn(t, SynMsgMessage{Version: VERSION, MinVersion: MIN_VERSION, NodeID: id.node_id})
+	defer spoof.close()
+	if spoof_ack == nil || spoof_ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Error("没有公钥冒用密钥节点ID时应该被拒绝")
+	}
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(id.node_id) != nil }) {
+		t.Fatal("密钥节点没有注册")
+	}
+	if port := fm.peers.get(id.node_id).conn.RemoteAddr().(*net.UDPAddr).Port; port != p.conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Error("真正的对端不应该被顶替")
+	}
+}
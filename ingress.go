@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+	"time"
+)
+
+// HTTP入口：公网节点按Host和路径前缀把请求转发到其他节点上的地址或服务
+// 目标节点只需要有到上级节点的出站连接，数据通道经中继到达，不需要开放端口
+const (
+	INGRESS_IDLE_TIMEOUT = 90 * time.Second
+)
+
+type ingress_backend struct {
+	route *IngressRoute
+	proxy *httputil.ReverseProxy
+}
+
+type http_ingress struct {
+	listener *ListenerConfig
+	backends []*ingress_backend
+}
+
+// 检查并规范化入口规则：路径默认 /，Host转为小写，service@node 拆出节点
+func validate_ingress(l *ListenerConfig) error {
+	if len(l.Ingress) == 0 {
+		return errors.New("没有配置入口规则(ingress)")
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return errors.New("tls_cert 和 tls_key 必须同时配置")
+	}
+	for i := range l.Ingress {
+		r := &l.Ingress[i]
+		r.Host = strings.ToLower(r.Host)
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return fmt.Errorf("入口规则[%d] Host通配符错误 %q", i, r.Host)
+		}
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("入口规则[%d]路径前缀应该以/开头: %s", i, r.Path)
+		}
+		if r.Service != "" {
+			proxy := ProxyConfig{Service: r.Service}
+			name, node_id := proxy.ServiceTarget()
+			if !valid_service_name(name) || (node_id == "" && strings.HasSuffix(r.Service, "@")) {
+				return fmt.Errorf("入口规则[%d]服务格式应该为 name 或 name@node_id: %s", i, r.Service)
+			}
+			if r.Address != "" || (r.Node != "" && r.Node != node_id) {
+				return fmt.Errorf("入口规则[%d] service 与 node/address 不能同时配置", i)
+			}
+			r.Node = node_id
+			continue
+		}
+		if r.Node == "" || r.Address == "" {
+			return fmt.Errorf("入口规则[%d]需要配置 node 和 address，或者 service", i)
+		}
+		if err := validate_target_address(r.Address); err != nil {
+			return fmt.Errorf("入口规则[%d]目标地址无效: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// 按代理的方式描述入口规则的目标，复用代理选择节点的逻辑
+func (r *IngressRoute) proxy() ProxyConfig {
+	return ProxyConfig{TargetNodeID: r.Node, TargetAddress: r.Address, Service: r.Service}
+}
+
+// 路径前缀匹配按路径段：/app 匹配 /app 和 /app/x，不匹配 /apple
+func (r *IngressRoute) match(host string, p string) bool {
+	if r.Host != "" {
+		if ok, _ := path.Match(r.Host, host); !ok {
+			return false
+		}
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// 连接入口规则的目标：本节点自己的服务直接连接，其他通过数据通道
+// client_addr 为空表示连接会被不同客户端复用
+func ingress_dial(route *IngressRoute, client_addr string) (net.Conn, error) {
+	proxy := route.proxy()
+	node_id, service, err := proxy_target(proxy)
+	if err != nil {
+		return nil, new_error_message(ERR_CODE_SERVICE_NOT_FOUND, err.Error())
+	}
+	if node_id == fm.config.NodeID && service != "" {
+		conn, merr := dial_local_service(service, client_addr, "")
+		if merr != nil {
+			return nil, merr
+		}
+		return conn, nil
+	}
+	return mesh_dial_conn(SynDataMessage{TargetID: node_id, TargetTcpAddr: proxy.TargetAddress, Service: service, ClientAddr: client_addr})
+}
+
+func new_http_ingress(l *ListenerConfig) *http_ingress {
+	ingress := &http_ingress{listener: l}
+	for i := range l.Ingress {
+		route := &l.Ingress[i]
+		transport := &http.Transport{
+			// 每条规则一个连接池，连接都到同一个目标，忽略请求中的地址
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return ingress_dial(route, "")
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     INGRESS_IDLE_TIMEOUT,
+		}
+		ingress.backends = append(ingress.backends, &ingress_backend{
+			route: route,
+			proxy: &httputil.ReverseProxy{
+				Rewrite: func(pr *httputil.ProxyRequest) {
+					pr.Out.URL.Scheme = "http"
+					pr.Out.URL.Host = pr.In.Host
+					if route.StripPrefix {
+						p := strings.TrimPrefix(pr.In.URL.Path, strings.TrimSuffix(route.Path, "/"))
+						if !strings.HasPrefix(p, "/") {
+							p = "/" + p
+						}
+						pr.Out.URL.Path = p
+						pr.Out.URL.RawPath = ""
+					}
+					pr.SetXForwarded()
+				},
+				Transport:     transport,
+				FlushInterval: -1, // 流式响应立即发回客户端
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+					http_gateway_error(w, r, err, "HTTP入口", l.Name)
+				},
+			},
+		})
+	}
+	return ingress
+}
+
+// 选择Host匹配且路径前缀最长的规则，长度相同时按配置顺序
+func (g *http_ingress) backend(r *http.Request) *ingress_backend {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var best *ingress_backend
+	for _, b := range g.backends {
+		if b.route.match(host, r.URL.Path) && (best == nil || len(b.route.Path) > len(best.route.Path)) {
+			best = b
+		}
+	}
+	return best
+}
+
+func (g *http_ingress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := g.backend(r)
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	b.proxy.ServeHTTP(w, r)
+}
+
+func http_ingress_main(l ListenerConfig) {
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		fmt.Printf("⚠️  启动HTTP入口失败 [%s]: %v\n", l.Name, err)
+		return
+	}
+	defer listener.Close()
+	if l.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			fmt.Printf("⚠️  加载HTTP入口证书失败 [%s]: %v\n", l.Name, err)
+			return
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}})
+	}
+	fmt.Printf("🚪 HTTP入口 [%s]: %s, %d条规则\n", l.Name, l.Listen, len(l.Ingress))
+	http_ingress_serve(listener, &l)
+}
+
+func http_ingress_serve(listener net.Listener, l *ListenerConfig) {
+	server := &http.Server{
+		Handler:           new_http_ingress(l),
+		ReadHeaderTimeout: HTTP_PROXY_HEADER_TIMEOUT,
+		IdleTimeout:       INGRESS_IDLE_TIMEOUT,
+	}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Printf("⚠️  HTTP入口 [%s] 退出: %v\n", l.Name, err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestIngressConfig(t *testing.T) {
+	for _, bad := range []ListenerConfig{
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80"},
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80", Ingress: []IngressRoute{{Node: "n1"}}},
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80", Ingress: []IngressRoute{{Node: "n1", Address: "a:1", Path: "api"}}},
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80", Ingress: []IngressRoute{{Service: "api@n1", Address: "a:1"}}},
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80", Ingress: []IngressRoute{{Service: "api@"}}},
+		{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:443", TLSCert: "a.crt", Ingress: []IngressRoute{{Service: "api"}}},
+	} {
+		if err := validate_listener(&bad); err == nil {
+			t.Errorf("配置应该无效: %+v", bad)
+		}
+	}
+
+	l := ListenerConfig{Name: "x", Type: LISTENER_HTTP_INGRESS, Listen: "0.0.0.0:80", Ingress: []IngressRoute{
+		{Host: "Dash.Example.com", Service: "grafana@n1"},
+		{Path: "/api", Node: "n2", Address: "127.0.0.1:8080"},
+	}}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	if r := l.Ingress[0]; r.Host != "dash.example.com" || r.Node != "n1" || r.Path != "/" {
+		t.Errorf("入口规则没有规范化: %+v", r)
+	}
+	for _, c := range []struct {
+		path string
+		want bool
+	}{{"/api", true}, {"/api/v1", true}, {"/apiv1", false}, {"/", false}} {
+		if got := l.Ingress[1].match("any", c.path); got != c.want {
+			t.Errorf("路径%s匹配结果应该是%v", c.path, c.want)
+		}
+	}
+}
+
+func TestHTTPIngress(t *testing.T) {
+	setup_test_node()
+
+	backend := dial_test_peer(t, "ingress-be-1")
+	defer backend.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(backend.node_id) != nil }) {
+		t.Fatal("目标节点没有注册")
+	}
+	// 模拟目标节点上的HTTP服务：回复目标、Host、路径和X-Forwarded-For
+	backend.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		target, _ := syn["target_tcp_addr"].(string)
+		if service, _ := syn["service"].(string); service != "" {
+			target = service
+		}
+		br := bufio.NewReader(stream)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			body := fmt.Sprintf("%s|%s|%s|%s", target, req.Host, req.URL.Path, req.Header.Get("X-Forwarded-For"))
+			fmt.Fprintf(stream, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	})
+
+	l := ListenerConfig{
+		Name:   "gw",
+		Type:   LISTENER_HTTP_INGRESS,
+		Listen: "127.0.0.1:0",
+		Ingress: []IngressRoute{
+			{Host: "dash.example.com", Service: "grafana@" + backend.node_id},
+			{Host: "*.example.com", Path: "/api", Node: backend.node_id, Address: "10.0.0.8:8080", StripPrefix: true},
+			{Host: "www.example.com", Node: backend.node_id, Address: "10.0.0.8:80"},
+			{Host: "gone.example.com", Node: "missing-node", Address: "10.0.0.8:80"},
+		},
+	}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http_ingress_serve(listener, &l)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, c := range []struct {
+		host string
+		path string
+		want int
+		body string
+	}{
+		{"dash.example.com", "/d/home", http.StatusOK, "grafana|dash.example.com|/d/home|127.0.0.1"},
+		{"www.example.com", "/api/users", http.StatusOK, "10.0.0.8:8080|www.example.com|/users|127.0.0.1"},
+		{"www.example.com", "/apiary", http.StatusOK, "10.0.0.8:80|www.example.com|/apiary|127.0.0.1"},
+		{"other.org", "/", http.StatusNotFound, ""},
+		{"gone.example.com", "/", http.StatusBadGateway, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+c.path, nil)
+		req.Host = c.host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s%s: %v", c.host, c.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.want || (c.body != "" && string(body) != c.body) {
+			t.Errorf("%s%s 应该回复%d %q, 实际: %d %q", c.host, c.path, c.want, c.body, resp.StatusCode, body)
+		}
+	}
+}
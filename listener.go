@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 入站监听器：每个连接由客户端指定目标地址，按规则选择出口节点，复用数据通道
+const (
+	LISTENER_SOCKS5       = "socks5"
+	LISTENER_HTTP_PROXY   = "http_proxy"
+	LISTENER_HTTP_INGRESS = "http_ingress"
+	LISTENER_SNI          = "sni"
+)
+
+// 编译后的出口规则
+type listener_route struct {
+	targets []target_spec
+	node    string
+}
+
+func validate_listener(l *ListenerConfig) error {
+	if l.Name == "" {
+		return errors.New("名称不能为空")
+	}
+	switch l.Type {
+	case LISTENER_SOCKS5, LISTENER_HTTP_PROXY, LISTENER_HTTP_INGRESS, LISTENER_SNI:
+	default:
+		return fmt.Errorf("[%s]类型无效: %q (可选: %s, %s, %s, %s)", l.Name, l.Type, LISTENER_SOCKS5, LISTENER_HTTP_PROXY, LISTENER_HTTP_INGRESS, LISTENER_SNI)
+	}
+	if _, _, err := net.SplitHostPort(l.Listen); err != nil {
+		return fmt.Errorf("[%s]监听地址无效: %v", l.Name, err)
+	}
+	for _, u := range l.Users {
+		if u.Username == "" || strings.Contains(u.Username, "@") {
+			return fmt.Errorf("[%s]用户名无效: %q (不能为空或包含@)", l.Name, u.Username)
+		}
+	}
+	routes, err := compile_listener_routes(l.Routes)
+	if err != nil {
+		return fmt.Errorf("[%s]%v", l.Name, err)
+	}
+	l.routes = routes
+	switch l.Type {
+	case LISTENER_HTTP_INGRESS:
+		err = validate_ingress(l)
+	case LISTENER_SNI:
+		err = validate_sni(l)
+	}
+	if err != nil {
+		return fmt.Errorf("[%s]%v", l.Name, err)
+	}
+	return nil
+}
+
+func compile_listener_routes(routes []ListenerRoute) ([]listener_route, error) {
+	var compiled []listener_route
+	for i, r := range routes {
+		if r.Node == "" {
+			return nil, fmt.Errorf("出口规则[%d]节点不能为空", i)
+		}
+		route := listener_route{node: r.Node}
+		for _, dst := range r.Destinations {
+			// 不带端口时匹配所有端口
+			if _, _, err := net.SplitHostPort(dst); err != nil {
+				dst = net.JoinHostPort(strings.Trim(dst, "[]"), "*")
+			}
+			spec, err := parse_target_spec(dst)
+			if err != nil {
+				return nil, fmt.Errorf("出口规则[%d]: %w", i, err)
+			}
+			route.targets = append(route.targets, spec)
+		}
+		compiled = append(compiled, route)
+	}
+	return compiled, nil
+}
+
+// 选择出口节点：用户名 name@node_id 指定的节点优先，其次按规则匹配目标地址，最后使用默认出口
+// 域名不在本地解析（由出口节点解析），只有IP地址能匹配CIDR规则
+func (l *ListenerConfig) exit_node(username string, host string, port int) string {
+	if _, node_id, ok := strings.Cut(username, "@"); ok && node_id != "" {
+		return node_id
+	}
+	name := strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, route := range l.routes {
+		for i := range route.targets {
+			if route.targets[i].match(name, ip, port) {
+				return route.node
+			}
+		}
+	}
+	return l.DefaultNode
+}
+
+// 检查用户名密码，用户名可以带 @node_id 后缀指定出口节点
+// 没有配置用户时不校验密码
+func (l *ListenerConfig) check_user(username string, password string) bool {
+	if len(l.Users) == 0 {
+		return true
+	}
+	name, _, _ := strings.Cut(username, "@")
+	for _, u := range l.Users {
+		if u.Username == name && u.Password == password {
+			return true
+		}
+	}
+	return false
+}
+
+func listener_main(l ListenerConfig) {
+	switch l.Type {
+	case LISTENER_SOCKS5:
+		socks5_main(l)
+	case LISTENER_HTTP_PROXY:
+		http_proxy_main(l)
+	case LISTENER_HTTP_INGRESS:
+		http_ingress_main(l)
+	case LISTENER_SNI:
+		sni_main(l)
+	}
+}
+
+// 接受连接并交给handle处理，监听器关闭时返回
+func listener_serve(listener net.Listener, handle func(conn net.Conn)) {
+	errorcount := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("接受连接失败: %v\n", err)
+			errorcount++
+			if errorcount > 5 {
+				fmt.Printf("⚠️  接受连接失败次数过多，退出\n")
+				os.Exit(1)
+			}
+			continue
+		}
+		errorcount = 0
+		go handle(conn)
+	}
+}
+
+// 通过组网连接目标节点上的地址：确认目标节点在网络中，按路由表找到下一跳，建立数据通道并握手
+// syn 由调用方填写目标节点、地址或服务名、协议和客户端地址，发起方、跳数和路径在这里填写
+func mesh_dial(syn SynDataMessage) (quic.Stream, *ErrorMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), FIND_NODE_TIMEOUT)
+	_, err := fm.FindNode(ctx, syn.TargetID)
+	cancel()
+	if err != nil {
+		return nil, new_error_message(ERR_CODE_NODE_NOT_FOUND, fmt.Sprintf("查找目标节点失败: %v", err))
+	}
+
+	syn.NodeID = fm.config.NodeID
+	syn.HopLimit = HOP_LIMIT
+	syn.Path = []string{fm.config.NodeID}
+	protocol := PROTO_TCP
+	if syn.Protocol == PROTO_TCP {
+		// tcp不写，兼容老版本节点
+		syn.Protocol = ""
+	} else if syn.Protocol != "" {
+		protocol = syn.Protocol
+	}
+	stream, next_hop, merr := open_data_channel(syn, "")
+	if merr != nil {
+		fm.metrics.inc("data_error_received." + error_code_name(merr.Code))
+		return nil, merr
+	}
+	target := syn.TargetTcpAddr
+	if syn.Service != "" {
+		target = syn.Service
+	}
+	fmt.Printf("✅ 数据通道已建立: 下一跳 %s -> %s (%s/%s)\n", next_hop, syn.TargetID, target, protocol)
+	return stream, nil
+}
+
+// 数据通道的地址：目标节点上的目标地址
+type mesh_addr struct {
+	node_id string
+	addr    string
+}
+
+func (a mesh_addr) Network() string { return "ffmesh" }
+func (a mesh_addr) String() string  { return a.addr + "@" + a.node_id }
+
+// 把数据通道包装成net.Conn，供net/http等标准库使用
+type mesh_conn struct {
+	quic.Stream
+	local  mesh_addr
+	remote mesh_addr
+}
+
+func (c *mesh_conn) LocalAddr() net.Addr  { return c.local }
+func (c *mesh_conn) RemoteAddr() net.Addr { return c.remote }
+
+// quic.Stream的Close只关闭发送方向，这里两个方向都关闭
+func (c *mesh_conn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// 通过组网建立TCP连接，错误为*ErrorMessage
+func mesh_dial_conn(syn SynDataMessage) (net.Conn, error) {
+	stream, merr := mesh_dial(syn)
+	if merr != nil {
+		return nil, merr
+	}
+	remote := mesh_addr{node_id: syn.TargetID, addr: syn.TargetTcpAddr}
+	if syn.Service != "" {
+		remote.addr = syn.Service
+	}
+	return &mesh_conn{
+		Stream: stream,
+		local:  mesh_addr{node_id: fm.config.NodeID},
+		remote: remote,
+	}, nil
+}
@@ -4,16 +4,29 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"runtime"
 )
 
 var fm *ffmesh = new_ffmesh()
 
 func main() {
-	// 设置单线程
-	runtime.GOMAXPROCS(1)
-	// 启动定时器
-	timer_main()
+	// 证书管理子命令
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := ca_main(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 查询服务目录
+	if len(os.Args) > 1 && os.Args[1] == "services" {
+		if err := services_main(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// 检查命令行参数
 	configFile := "config.yaml"
 	if len(os.Args) > 1 {
@@ -30,9 +43,33 @@ func main() {
 	}
 	fm.config = config
 
+	// 加载组网证书
+	fm.tls, err = load_mesh_tls(config.Quic.TLS)
+	if err != nil {
+		log.Fatal("加载证书失败:", err)
+	}
+	if fm.tls == nil {
+		fmt.Printf("⚠️  未配置组网证书，任何节点都可以冒充上级节点，仅用于测试环境\n")
+	} else if id := fm.tls.node_id(); id != config.NodeID {
+		log.Fatalf("证书节点ID(%s)与配置的节点ID(%s)不一致", id, config.NodeID)
+	}
+
+	if err := config.policy.open_audit(config.Policy.AuditLog); err != nil {
+		log.Fatal(err)
+	}
+
+	fm.start()
+
+	// 启动定时器
+	timer_main()
+
 	// 打印配置信息
 	config.PrintConfig()
 
+	if config.Admin != "" {
+		go admin_main(config.Admin)
+	}
+
 	// 启动FFMesh节点
 	fmt.Printf("开始启动 FFMesh 节点: %s\n", config.NodeID)
 
@@ -55,15 +92,30 @@ func main() {
 	if len(config.Proxies) > 0 {
 		fmt.Printf("\n🔧 启动代理服务:\n")
 		for _, proxy := range config.Proxies {
-			fmt.Printf("   - %s: 本地端口 %d -> 节点 %s (%s)\n",
-				proxy.Name, proxy.LocalPort, proxy.TargetNodeID, proxy.TargetAddress)
-			// 启动TCP代理监听器
-			go tcp_proxy_main(proxy.LocalPort, proxy.TargetNodeID, proxy.TargetAddress)
+			target := proxy.TargetAddress
+			if proxy.Service != "" {
+				target = "服务 " + proxy.Service
+			}
+			fmt.Printf("   - %s: 本地 %s -> 节点 %s (%s)\n",
+				proxy.Name, proxy.ListenAddr(), proxy.TargetNodeID, target)
+			// 启动代理监听器，端口范围每个端口一个
+			for _, p := range proxy.expand() {
+				if p.GetProtocol() == PROTO_UDP {
+					go udp_proxy_main(p)
+				} else {
+					go tcp_proxy_main(p)
+				}
+			}
 		}
 	} else {
 		fmt.Printf("\n⚠️  无代理配置\n")
 	}
 
+	// 4. 启动入站监听器
+	for _, l := range config.Listeners {
+		go listener_main(l)
+	}
+
 	fmt.Printf("\n🚀 FFMesh 节点启动完成\n")
 
 	// 保持主程序运行
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 运行指标计数器，名称形如 data_error_sent.target-unreachable
+type mesh_metrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	printed  map[string]uint64 // 上次打印时的值，用于判断是否有变化
+}
+
+func new_mesh_metrics() *mesh_metrics {
+	return &mesh_metrics{
+		counters: make(map[string]uint64),
+		printed:  make(map[string]uint64),
+	}
+}
+
+func (m *mesh_metrics) inc(name string) {
+	m.mu.Lock()
+	m.counters[name]++
+	m.mu.Unlock()
+}
+
+func (m *mesh_metrics) get(name string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+// 获取所有计数器的快照
+func (m *mesh_metrics) snapshot() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]uint64, len(m.counters))
+	for name, v := range m.counters {
+		snap[name] = v
+	}
+	return snap
+}
+
+// 有变化时打印所有计数器
+func (m *mesh_metrics) print_if_changed() {
+	m.mu.Lock()
+	changed := false
+	for name, v := range m.counters {
+		if m.printed[name] != v {
+			m.printed[name] = v
+			changed = true
+		}
+	}
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	snap := m.snapshot()
+	names := make([]string, 0, len(snap))
+	for name := range snap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("📈 运行指标:\n")
+	for _, name := range names {
+		fmt.Printf("   %s = %d\n", name, snap[name])
+	}
+}
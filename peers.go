@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 节点注册表事件类型
+const (
+	PEER_EVENT_ADD     = 0 // 新节点加入
+	PEER_EVENT_REPLACE = 1 // 节点连接被替换（同一个节点ID换了新的conn）
+	PEER_EVENT_REMOVE  = 2 // 节点移除
+)
+
+// 节点注册表变更通知
+type peer_event struct {
+	typ     int
+	node_id string
+	client  *quic_client // 当前的节点信息（REMOVE时为被移除的节点）
+	old     *quic_client // REPLACE时为被替换掉的旧节点
+}
+
+// 线程安全的节点注册表，替代原来裸的 map[string]*quic_client
+type peer_registry struct {
+	mu       sync.RWMutex
+	clients  map[string]*quic_client
+	watchers []func(peer_event)
+}
+
+func new_peer_registry() *peer_registry {
+	return &peer_registry{
+		clients: make(map[string]*quic_client),
+	}
+}
+
+// 注册变更通知，回调在锁外同步执行
+func (r *peer_registry) watch(fn func(peer_event)) {
+	r.mu.Lock()
+	r.watchers = append(r.watchers, fn)
+	r.mu.Unlock()
+}
+
+func (r *peer_registry) notify(ev peer_event) {
+	r.mu.RLock()
+	watchers := make([]func(peer_event), len(r.watchers))
+	copy(watchers, r.watchers)
+	r.mu.RUnlock()
+	for _, fn := range watchers {
+		fn(ev)
+	}
+}
+
+// 存入节点的消息通道
+// 同一个conn重复存入时只追加stream；同一个节点ID换了conn时替换旧节点并关闭旧连接
+func (r *peer_registry) save(node_id string, conn quic.Connection, stream quic.Stream, is_up bool, version int, caps uint32) *quic_client {
+	r.mu.Lock()
+	old := r.clients[node_id]
+	if old != nil && old.conn == conn {
+		r.mu.Unlock()
+		old.add_stream(stream, LINK_TYPE_MSG)
+		return old
+	}
+	client := &quic_client{
+		node_id:    node_id,
+		conn:       conn,
+		streaminfo: []streaminfo{},
+		is_up:      is_up,
+		version:    version,
+		caps:       caps,
+		codec:      select_codec(caps),
+	}
+	client.add_stream(stream, LINK_TYPE_MSG)
+	r.clients[node_id] = client
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close("already connected")
+		r.notify(peer_event{typ: PEER_EVENT_REPLACE, node_id: node_id, client: client, old: old})
+	} else {
+		r.notify(peer_event{typ: PEER_EVENT_ADD, node_id: node_id, client: client})
+	}
+	return client
+}
+
+// 按节点ID查找
+func (r *peer_registry) get(node_id string) *quic_client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[node_id]
+}
+
+// 按conn查找在该连接上注册的节点
+func (r *peer_registry) get_by_conn(conn quic.Connection) *quic_client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, client := range r.clients {
+		if client.conn == conn {
+			return client
+		}
+	}
+	return nil
+}
+
+// 节点数量
+func (r *peer_registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients)
+}
+
+// 获取所有节点的快照
+func (r *peer_registry) snapshot() []*quic_client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*quic_client, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// 遍历所有节点，fn返回false时停止；遍历的是快照，回调中可以安全地修改注册表
+func (r *peer_registry) each(fn func(client *quic_client) bool) {
+	for _, client := range r.snapshot() {
+		if !fn(client) {
+			return
+		}
+	}
+}
+
+// 按节点ID移除并关闭连接
+func (r *peer_registry) remove(node_id string, reason string) *quic_client {
+	r.mu.Lock()
+	client := r.clients[node_id]
+	if client != nil {
+		delete(r.clients, node_id)
+	}
+	r.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	client.close(reason)
+	r.notify(peer_event{typ: PEER_EVENT_REMOVE, node_id: node_id, client: client})
+	return client
+}
+
+// 按conn移除并关闭连接
+// 旧连接退出时只会删除自己，不会误删同一节点ID下已经替换上来的新连接
+func (r *peer_registry) remove_by_conn(conn quic.Connection, reason string) *quic_client {
+	r.mu.Lock()
+	var client *quic_client
+	for node_id, c := range r.clients {
+		if c.conn == conn {
+			client = c
+			delete(r.clients, node_id)
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	client.close(reason)
+	r.notify(peer_event{typ: PEER_EVENT_REMOVE, node_id: client.node_id, client: client})
+	return client
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 等待条件成立
+func wait_for(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+// 模拟一个下级节点：连接测试节点并完成消息通道握手
+type test_peer struct {
+	node_id string
+	conn    quic.Connection
+	stream  quic.Stream
+}
+
+func dial_test_peer(t *testing.T, node_id string) *test_peer {
+	t.Helper()
+	return dial_test_peer_up(t, node_id, false)
+}
+
+func dial_test_peer_up(t *testing.T, node_id string, is_up bool) *test_peer {
+	t.Helper()
+	p, msg := dial_test_peer_syn(t, SynMsgMessage{
+		Version:      VERSION,
+		MinVersion:   MIN_VERSION,
+		Capabilities: CAPABILITIES &^ CAP_CODEC_CBOR, // 模拟节点按JSON解析收到的消息
+		NodeID:       node_id,
+		IsUp:         is_up,
+	})
+	if msg == nil || msg.Type != MSG_TYPE_SYN_ACK_MSG {
+		t.Fatalf("握手失败: %v", msg)
+	}
+	return p
+}
+
+// 用指定的握手消息连接测试节点，返回握手回复
+func dial_test_peer_syn(t *testing.T, syn SynMsgMessage) (*test_peer, *QuicMessage) {
+	t.Helper()
+	p := dial_test_peer_conn(t, syn.NodeID)
+	p.send(MSG_TYPE_SYN_MSG, syn)
+	return p, p.read()
+}
+
+// 连接测试节点并打开消息通道，还没有发送握手
+func dial_test_peer_conn(t *testing.T, node_id string) *test_peer {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", fm.config.Quic.ListenPort)
+	conn, err := quic.DialAddr(ctx, addr, GetClientTLSConfig(), GetQuicClientConfig())
+	if err != nil {
+		t.Fatalf("连接测试节点失败: %v", err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("打开stream失败: %v", err)
+	}
+	return &test_peer{node_id: node_id, conn: conn, stream: stream}
+}
+
+func (p *test_peer) send(typ int, data interface{}) error {
+	msg := &QuicMessage{Type: typ, FromID: p.node_id, ToID: fm.config.NodeID, Data: data}
+	_, err := p.stream.Write(msg.ToBuffer())
+	return err
+}
+
+// 读取发给模拟节点的消息（Data保持为原始json）
+func (p *test_peer) read() *QuicMessage {
+	buf, err := read_frame(p.stream, DEFAULT_MAX_FRAME_SIZE)
+	if err != nil {
+		return nil
+	}
+	var msg QuicMessage
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		return nil
+	}
+	return &msg
+}
+
+// 在模拟节点的连接上打开数据通道并发送握手，返回收到的第一条回复
+func (p *test_peer) open_data(t *testing.T, syn SynDataMessage) *QuicMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := p.conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("打开数据通道失败: %v", err)
+	}
+	defer stream.Close()
+	data := &test_peer{node_id: p.node_id, conn: p.conn, stream: stream}
+	data.send(MSG_TYPE_SYN_DATA, syn)
+	return data.read()
+}
+
+// 模拟目标节点：接受测试节点打开的数据通道，回复synack后交给fn处理，syn为收到的握手（原始json）
+func (p *test_peer) accept_data(fn func(syn map[string]interface{}, stream quic.Stream)) {
+	go func() {
+		for {
+			stream, err := p.conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				data := &test_peer{node_id: p.node_id, conn: p.conn, stream: stream}
+				msg := data.read()
+				if msg == nil || msg.Type != MSG_TYPE_SYN_DATA {
+					return
+				}
+				data.send(MSG_TYPE_SYN_ACK_DATA, SynAckDataMessage{})
+				fn(msg.Data.(map[string]interface{}), stream)
+			}()
+		}
+	}()
+}
+
+func (p *test_peer) close() {
+	p.conn.CloseWithError(0, "test complete")
+}
+
+func TestPeerRegistryConcurrent(t *testing.T) {
+	r := new_peer_registry()
+	var events atomic.Int64
+	r.watch(func(ev peer_event) {
+		events.Add(1)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				node_id := fmt.Sprintf("node-%d", j%10)
+				switch (i + j) % 4 {
+				case 0:
+					r.save(node_id, nil, nil, j%2 == 0, VERSION, CAPABILITIES)
+				case 1:
+					r.remove(node_id, "test")
+				case 2:
+					if c := r.get(node_id); c != nil {
+						c.msg_stream()
+					}
+				case 3:
+					r.each(func(c *quic_client) bool {
+						return c.node_id != "node-5"
+					})
+					r.len()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if events.Load() == 0 {
+		t.Error("没有收到注册表变更通知")
+	}
+}
+
+func TestPeerRegistryReplace(t *testing.T) {
+	r := new_peer_registry()
+	var got []int
+	r.watch(func(ev peer_event) {
+		got = append(got, ev.typ)
+	})
+
+	first := r.save("node-a", nil, nil, false, VERSION, CAPABILITIES)
+	if again := r.save("node-a", nil, nil, false, VERSION, CAPABILITIES); again != first {
+		t.Error("同一个conn重复保存不应该替换节点")
+	}
+	if r.remove_by_conn(nil, "test") != first {
+		t.Error("按conn删除失败")
+	}
+	if r.len() != 0 {
+		t.Errorf("删除后节点数量应该为0, 实际: %d", r.len())
+	}
+
+	want := []int{PEER_EVENT_ADD, PEER_EVENT_REMOVE}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("通知事件不正确, 期望: %v, 实际: %v", want, got)
+	}
+}
+
+// 多个下级节点同时接入、收发ping、重连、断开，配合 go test -race 检查数据竞争
+func TestMultiNodeMesh(t *testing.T) {
+	setup_test_node()
+	if !wait_for(t, 10*time.Second, func() bool { return fm.peers.len() == 0 }) {
+		t.Fatalf("还有残留的节点: %d", fm.peers.len())
+	}
+
+	const n = 4
+	peers := make([]*test_peer, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peers[i] = dial_test_peer(t, fmt.Sprintf("child-%03d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	if !wait_for(t, 5*time.Second, func() bool { return fm.peers.len() == n }) {
+		t.Fatalf("节点数量不正确, 期望: %d, 实际: %d", n, fm.peers.len())
+	}
+
+	// 下级节点发ping，本节点同时向所有节点发ping
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *test_peer) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				p.send(MSG_TYPE_PING, PingMessage{})
+			}
+			pongs := 0
+			for pongs < 5 {
+				msg := p.read()
+				if msg == nil {
+					t.Errorf("%s 读取消息失败", p.node_id)
+					return
+				}
+				if msg.Type == MSG_TYPE_PONG {
+					pongs++
+				}
+			}
+		}(p)
+	}
+	for j := 0; j < 5; j++ {
+		fm.peers.each(func(client *quic_client) bool {
+			quic_send_ping_msg(client)
+			return true
+		})
+	}
+	wg.Wait()
+
+	// 同一个节点ID重新连接，旧连接应该被替换
+	old := fm.peers.get(peers[0].node_id)
+	peers[0] = dial_test_peer(t, peers[0].node_id)
+	if !wait_for(t, 5*time.Second, func() bool {
+		c := fm.peers.get(peers[0].node_id)
+		return c != nil && c != old
+	}) {
+		t.Error("重连后旧连接没有被替换")
+	}
+
+	for _, p := range peers {
+		p.close()
+	}
+	if !wait_for(t, 10*time.Second, func() bool { return fm.peers.len() == 0 }) {
+		t.Errorf("断开后节点没有被清理, 剩余: %d", fm.peers.len())
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 访问控制策略
+// targets: 本节点作为目标节点时，哪些来源节点可以连接哪些地址
+// transit: 本节点作为中继时，哪些来源节点可以转发到哪些目标节点
+// 规则按顺序匹配，第一条匹配的规则生效；没有配置规则时全部允许（兼容老配置），配置了规则但都不匹配时拒绝
+// unix socket目标例外：没有targets规则时拒绝，只能由规则或服务（services）放行
+// 来源节点为数据通道的发起方：直连时必须就是完成握手的上一跳；多跳时只检查路径以发起方开始、以上一跳结束，
+// 发起方和中间节点由上一跳转述，本节点无法验证，不能比信任上一跳更信任它们
+const (
+	POLICY_ALLOW = "allow"
+	POLICY_DENY  = "deny"
+
+	POLICY_RESOLVE_TIMEOUT = 3 * time.Second // 解析目标域名的超时时间
+)
+
+// 编译后的策略规则
+type policy_rule struct {
+	allow   bool
+	sources []string      // 来源节点ID通配符，空表示所有
+	targets []target_spec // 目标地址（targets规则）
+	nodes   []string      // 目标节点ID通配符（transit规则）
+	text    string        // 规则原文，用于审计日志
+}
+
+// 目标地址：主机为IP、CIDR、域名通配符或*，端口为单个端口、范围或*；或者 unix:路径通配符
+type target_spec struct {
+	unix     string // unix socket路径通配符，不为空时只匹配unix socket
+	host     string // 域名通配符，为空时使用cidr
+	cidr     *net.IPNet
+	port_min int
+	port_max int
+}
+
+type mesh_policy struct {
+	targets []policy_rule
+	transit []policy_rule
+
+	audit_mu sync.Mutex
+	audit    *os.File // 审计日志文件，nil表示只打印
+}
+
+// 编译策略配置
+func compile_policy(c PolicyConfig) (*mesh_policy, error) {
+	p := &mesh_policy{}
+	for i, r := range c.Targets {
+		rule, err := compile_policy_rule(r)
+		if err != nil {
+			return nil, fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		for _, dst := range r.Destinations {
+			spec, err := parse_target_spec(dst)
+			if err != nil {
+				return nil, fmt.Errorf("targets[%d]: %w", i, err)
+			}
+			rule.targets = append(rule.targets, spec)
+		}
+		p.targets = append(p.targets, rule)
+	}
+	for i, r := range c.Transit {
+		rule, err := compile_policy_rule(r)
+		if err != nil {
+			return nil, fmt.Errorf("transit[%d]: %w", i, err)
+		}
+		for _, dst := range r.Destinations {
+			if _, err := path.Match(dst, ""); err != nil {
+				return nil, fmt.Errorf("transit[%d]: 目标节点通配符错误 %q", i, dst)
+			}
+		}
+		rule.nodes = r.Destinations
+		p.transit = append(p.transit, rule)
+	}
+	return p, nil
+}
+
+func compile_policy_rule(r PolicyRule) (policy_rule, error) {
+	rule := policy_rule{sources: r.Sources}
+	switch r.Action {
+	case POLICY_ALLOW:
+		rule.allow = true
+	case POLICY_DENY:
+	default:
+		return rule, fmt.Errorf("未知的动作 %q (可选: allow, deny)", r.Action)
+	}
+	for _, src := range r.Sources {
+		if _, err := path.Match(src, ""); err != nil {
+			return rule, fmt.Errorf("来源节点通配符错误 %q", src)
+		}
+	}
+	rule.text = fmt.Sprintf("%s %v -> %v", r.Action, r.Sources, r.Destinations)
+	return rule, nil
+}
+
+// 解析 host:port 形式的目标地址，例如 10.0.0.0/8:*、[fd00::/8]:22、*.lan:8000-8100、unix:/run/app/*.sock
+func parse_target_spec(s string) (target_spec, error) {
+	var spec target_spec
+	if p, ok := unix_path(s); ok {
+		if _, err := path.Match(p, ""); err != nil || !strings.HasPrefix(p, "/") {
+			return spec, fmt.Errorf("unix socket路径通配符错误 %q", s)
+		}
+		spec.unix = p
+		return spec, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return spec, fmt.Errorf("目标地址格式错误 %q: %v", s, err)
+	}
+	switch {
+	case port == "*":
+		spec.port_min, spec.port_max = 0, 65535
+	case strings.Contains(port, "-"):
+		lo, hi, _ := strings.Cut(port, "-")
+		spec.port_min, err = strconv.Atoi(lo)
+		if err == nil {
+			spec.port_max, err = strconv.Atoi(hi)
+		}
+		if err != nil || spec.port_min > spec.port_max {
+			return spec, fmt.Errorf("端口范围错误 %q", s)
+		}
+	default:
+		spec.port_min, err = strconv.Atoi(port)
+		if err != nil {
+			return spec, fmt.Errorf("端口错误 %q", s)
+		}
+		spec.port_max = spec.port_min
+	}
+	if spec.port_min < 0 || spec.port_max > 65535 {
+		return spec, fmt.Errorf("端口超出范围 %q", s)
+	}
+
+	if cidr := parse_cidr(host); cidr != nil {
+		spec.cidr = cidr
+	} else {
+		if _, err := path.Match(host, ""); err != nil {
+			return spec, fmt.Errorf("主机通配符错误 %q", s)
+		}
+		spec.host = strings.ToLower(host)
+	}
+	return spec, nil
+}
+
+func (s *target_spec) match(name string, ip net.IP, port int) bool {
+	if s.unix != "" {
+		return false
+	}
+	if port < s.port_min || port > s.port_max {
+		return false
+	}
+	if s.cidr != nil {
+		return s.cidr.Contains(ip)
+	}
+	if s.host == "*" {
+		return true
+	}
+	ok, _ := path.Match(s.host, name)
+	return ok
+}
+
+// p 为规范化后的unix socket路径
+func (s *target_spec) match_unix(p string) bool {
+	if s.unix == "" {
+		return false
+	}
+	ok, _ := path.Match(s.unix, p)
+	return ok
+}
+
+// 解析CIDR或单个IP，都不是时返回nil
+func parse_cidr(s string) *net.IPNet {
+	if _, cidr, err := net.ParseCIDR(s); err == nil {
+		return cidr
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// 解析客户端地址列表（CIDR或IP）
+func parse_cidrs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		cidr := parse_cidr(s)
+		if cidr == nil {
+			return nil, fmt.Errorf("地址应该为IP或CIDR: %q", s)
+		}
+		nets = append(nets, cidr)
+	}
+	return nets, nil
+}
+
+func match_cidrs(nets []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range nets {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func match_patterns(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 目标节点检查：来源节点能否连接目标地址，返回实际连接的地址
+// 域名先解析成IP再逐个匹配，连接匹配通过的IP，防止DNS在检查后被改指向内网地址
+func (p *mesh_policy) authorize_target(src string, addr string) (string, *ErrorMessage) {
+	if socket, ok := unix_path(addr); ok {
+		return p.authorize_unix(src, addr, socket)
+	}
+	if p == nil || len(p.targets) == 0 {
+		return addr, nil
+	}
+	host, port_str, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("目标地址格式错误: %s", addr))
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil {
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("目标端口错误: %s", addr))
+	}
+	name := strings.ToLower(host)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), POLICY_RESOLVE_TIMEOUT)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", new_error_message(ERR_CODE_TARGET_UNREACHABLE, fmt.Sprintf("解析%s失败: %v", host, err))
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	var reason string
+	for _, ip := range ips {
+		allow, rule := p.match_target(src, func(s *target_spec) bool { return s.match(name, ip, port) })
+		if allow {
+			p.record(true, "target", src, addr, rule)
+			return net.JoinHostPort(ip.String(), port_str), nil
+		}
+		reason = rule
+	}
+	p.record(false, "target", src, addr, reason)
+	return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("策略不允许%s连接%s", src, addr))
+}
+
+// unix socket目标按规范化后的路径匹配，连接的也是规范化后的路径；没有targets规则时拒绝
+func (p *mesh_policy) authorize_unix(src string, addr string, socket string) (string, *ErrorMessage) {
+	socket, err := clean_unix_path(socket)
+	if err != nil {
+		p.record(false, "target", src, addr, err.Error())
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, err.Error())
+	}
+	if p == nil || len(p.targets) == 0 {
+		p.record(false, "target", src, addr, "unix socket需要规则放行")
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("没有策略规则放行unix socket: %s", addr))
+	}
+	allow, rule := p.match_target(src, func(s *target_spec) bool { return s.match_unix(socket) })
+	p.record(allow, "target", src, addr, rule)
+	if !allow {
+		return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("策略不允许%s连接%s", src, addr))
+	}
+	return UNIX_ADDR_PREFIX + socket, nil
+}
+
+func (p *mesh_policy) match_target(src string, match func(*target_spec) bool) (bool, string) {
+	for _, rule := range p.targets {
+		if !match_patterns(rule.sources, src) {
+			continue
+		}
+		if len(rule.targets) == 0 {
+			return rule.allow, rule.text
+		}
+		for i := range rule.targets {
+			if match(&rule.targets[i]) {
+				return rule.allow, rule.text
+			}
+		}
+	}
+	return false, "没有匹配的规则"
+}
+
+// 中继检查：来源节点能否经过本节点转发到目标节点
+func (p *mesh_policy) authorize_transit(src string, target_id string) *ErrorMessage {
+	if p == nil || len(p.transit) == 0 {
+		return nil
+	}
+	for _, rule := range p.transit {
+		if match_patterns(rule.sources, src) && match_patterns(rule.nodes, target_id) {
+			p.record(rule.allow, "transit", src, target_id, rule.text)
+			if rule.allow {
+				return nil
+			}
+			return new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("策略不允许%s经过本节点转发到%s", src, target_id))
+		}
+	}
+	p.record(false, "transit", src, target_id, "没有匹配的规则")
+	return new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("策略不允许%s经过本节点转发到%s", src, target_id))
+}
+
+// 审计记录：拒绝的请求打印并计数，配置了审计日志时所有判定都写入文件（每行一个JSON）
+func (p *mesh_policy) record(allow bool, kind string, src string, dst string, rule string) {
+	if !allow {
+		fm.metrics.inc("policy_denied." + kind)
+		fmt.Printf("🛡️  策略拒绝 [%s] %s -> %s (%s)\n", kind, src, dst, rule)
+	}
+	if p == nil {
+		return
+	}
+	p.audit_mu.Lock()
+	defer p.audit_mu.Unlock()
+	if p.audit == nil {
+		return
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"time":   time.Now().Format(time.RFC3339),
+		"kind":   kind,
+		"allow":  allow,
+		"source": src,
+		"dest":   dst,
+		"rule":   rule,
+		"node":   fm.config.NodeID,
+	})
+	p.audit.Write(append(line, '\n'))
+}
+
+// 打开审计日志文件
+func (p *mesh_policy) open_audit(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("打开审计日志失败: %w", err)
+	}
+	p.audit = f
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyTargets(t *testing.T) {
+	p, err := compile_policy(PolicyConfig{Targets: []PolicyRule{
+		{Action: "deny", Sources: []string{"evil*"}},
+		{Action: "allow", Destinations: []string{"127.0.0.0/8:3000-4000", "localhost:22", "[::1]:*"}},
+		{Action: "allow", Sources: []string{"admin"}, Destinations: []string{"*:*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		src, addr string
+		ok        bool
+	}{
+		{"node-a", "127.0.0.1:3333", true},
+		{"node-a", "127.0.0.1:80", false},
+		{"evil-1", "127.0.0.1:3333", false},
+		{"node-a", "10.0.0.1:3333", false},
+		{"node-a", "[::1]:80", true},
+		{"node-a", "localhost:22", true},
+		{"admin", "10.0.0.1:80", true},
+		{"node-a", "bad-address", false},
+	}
+	for _, c := range cases {
+		dial, merr := p.authorize_target(c.src, c.addr)
+		if (merr == nil) != c.ok {
+			t.Errorf("%s -> %s 期望允许=%v, 实际: %v", c.src, c.addr, c.ok, merr)
+			continue
+		}
+		if merr != nil && merr.Code != ERR_CODE_REFUSED_BY_ACL {
+			t.Errorf("%s -> %s 错误码不正确: %v", c.src, c.addr, merr)
+		}
+		if merr == nil && strings.HasPrefix(c.addr, "localhost") && strings.HasPrefix(dial, "localhost") {
+			t.Errorf("域名应该解析成IP后再连接: %s", dial)
+		}
+	}
+
+	// 没有配置规则时全部允许
+	var none *mesh_policy
+	if dial, merr := none.authorize_target("node-a", "10.0.0.1:22"); merr != nil || dial != "10.0.0.1:22" {
+		t.Errorf("没有策略时应该允许: %v", merr)
+	}
+}
+
+func TestPolicyTransit(t *testing.T) {
+	p, err := compile_policy(PolicyConfig{Transit: []PolicyRule{
+		{Action: "allow", Sources: []string{"branch-*"}, Destinations: []string{"hq-*"}},
+		{Action: "deny", Destinations: []string{"hq-db"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merr := p.authorize_transit("branch-1", "hq-web"); merr != nil {
+		t.Errorf("应该允许: %v", merr)
+	}
+	if merr := p.authorize_transit("guest", "hq-web"); merr == nil || merr.Code != ERR_CODE_REFUSED_BY_ACL {
+		t.Errorf("没有匹配的规则时应该拒绝: %v", merr)
+	}
+}
+
+func TestPolicyConfigErrors(t *testing.T) {
+	for _, c := range []PolicyConfig{
+		{Targets: []PolicyRule{{Action: "permit"}}},
+		{Targets: []PolicyRule{{Action: "allow", Destinations: []string{"10.0.0.0/8"}}}},
+		{Targets: []PolicyRule{{Action: "allow", Destinations: []string{"*:9000-80"}}}},
+		{Transit: []PolicyRule{{Action: "deny", Sources: []string{"["}}}},
+	} {
+		if _, err := compile_policy(c); err == nil {
+			t.Errorf("应该编译失败: %+v", c)
+		}
+	}
+}
+
+// 策略拒绝时回复refused-by-acl错误并写审计日志
+// 测试期间使用策略，结束时恢复为没有策略
+// 数据通道在回复之前都经过了record（会锁audit_mu），先拿到这把锁再恢复，保证它们对策略的读取先于这里的写入
+func use_test_policy(t *testing.T, p *mesh_policy) {
+	fm.config.policy = p
+	t.Cleanup(func() {
+		p.audit_mu.Lock()
+		defer p.audit_mu.Unlock()
+		fm.config.policy = nil
+	})
+}
+
+func TestPolicyDataChannel(t *testing.T) {
+	setup_test_node()
+
+	p, err := compile_policy(PolicyConfig{
+		Targets: []PolicyRule{{Action: "allow", Sources: []string{"trusted"}}},
+		Transit: []PolicyRule{{Action: "deny"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	if err := p.open_audit(audit); err != nil {
+		t.Fatal(err)
+	}
+	defer p.audit.Close()
+	use_test_policy(t, p)
+
+	child := dial_test_peer_up(t, "child-acl-1", true)
+	defer child.close()
+
+	before := fm.metrics.get("policy_denied.target")
+	for _, syn := range []SynDataMessage{
+		{NodeID: "origin", TargetID: fm.config.NodeID, TargetTcpAddr: "127.0.0.1:22", HopLimit: 5, Path: []string{"origin", child.node_id}},
+		{NodeID: "origin", TargetID: "far-node", HopLimit: 5, Path: []string{"origin", child.node_id}},
+	} {
+		reply := child.open_data(t, syn)
+		if reply == nil || reply.Type != MSG_TYPE_ERROR {
+			t.Fatalf("应该收到错误消息, 实际: %v", reply)
+		}
+		if code := int(reply.Data.(map[string]interface{})["code"].(float64)); code != ERR_CODE_REFUSED_BY_ACL {
+			t.Errorf("错误码应该是refused-by-acl, 实际: %d", code)
+		}
+	}
+	if fm.metrics.get("policy_denied.target") != before+1 {
+		t.Error("没有统计策略拒绝次数")
+	}
+	data, _ := os.ReadFile(audit)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"allow":false`) {
+		t.Errorf("审计日志不正确: %s", data)
+	}
+}
+
+// 来源节点必须和上一跳、路径一致，冒充策略允许的节点被拒绝
+func TestPolicySpoofedSource(t *testing.T) {
+	setup_test_node()
+
+	p, err := compile_policy(PolicyConfig{
+		Targets: []PolicyRule{{Action: "allow", Sources: []string{"trusted"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	use_test_policy(t, p)
+
+	child := dial_test_peer(t, "child-spoof-1")
+	defer child.close()
+
+	error_code := func(node_id string, path ...string) int {
+		reply := child.open_data(t, SynDataMessage{NodeID: node_id, TargetID: fm.config.NodeID, TargetTcpAddr: "127.0.0.1:1", HopLimit: 5, Path: path})
+		if reply == nil || reply.Type != MSG_TYPE_ERROR {
+			t.Fatalf("应该收到错误消息, 实际: %v", reply)
+		}
+		return int(reply.Data.(map[string]interface{})["code"].(float64))
+	}
+	before := fm.metrics.get("policy_denied.target")
+	for _, path := range [][]string{
+		nil,
+		{"trusted"},
+		{child.node_id},
+		{"trusted", "other-hop"},
+		{"someone", child.node_id},
+	} {
+		if code := error_code("trusted", path...); code != ERR_CODE_REFUSED_BY_ACL {
+			t.Errorf("路径%v冒充来源应该被拒绝, 实际错误码: %d", path, code)
+		}
+	}
+	if fm.metrics.get("policy_denied.target") != before {
+		t.Error("来源不一致应该在检查策略之前拒绝")
+	}
+
+	// 叶子节点不能转发，路径再一致也不能冒充多跳来源
+	if code := error_code("trusted", "trusted", child.node_id); code != ERR_CODE_REFUSED_BY_ACL || fm.metrics.get("policy_denied.target") != before {
+		t.Errorf("叶子节点转述的多跳来源应该被拒绝, 实际错误码: %d", code)
+	}
+
+	// 中继节点转述的多跳来源按来源检查策略
+	relay := dial_test_peer_up(t, "relay-spoof-1", true)
+	defer relay.close()
+	reply := relay.open_data(t, SynDataMessage{NodeID: "trusted", TargetID: fm.config.NodeID, TargetTcpAddr: "127.0.0.1:1", HopLimit: 5, Path: []string{"trusted", relay.node_id}})
+	if reply == nil || reply.Type != MSG_TYPE_ERROR || int(reply.Data.(map[string]interface{})["code"].(float64)) != ERR_CODE_TARGET_UNREACHABLE {
+		t.Errorf("中继节点转述的多跳来源应该通过策略: %v", reply)
+	}
+	if code := error_code(child.node_id, child.node_id); code != ERR_CODE_REFUSED_BY_ACL || fm.metrics.get("policy_denied.target") != before+1 {
+		t.Errorf("直连的上一跳不在策略中应该被拒绝, 实际错误码: %d", code)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 端口范围代理：local_ports 为本地端口范围，target_address 的端口为同样长度的目标端口范围
+// 例如被动模式FTP、RTP，启动时每个本地端口展开成一个代理，目标端口按偏移对应
+
+// 解析端口或端口范围，例如 21 或 20000-20100
+func parse_port_range(s string) (int, int, error) {
+	lo_str, hi_str, is_range := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(lo_str)
+	hi := lo
+	if err == nil && is_range {
+		hi, err = strconv.Atoi(hi_str)
+	}
+	if err != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("端口范围无效: %s", s)
+	}
+	return lo, hi, nil
+}
+
+// 检查本地端口、端口范围和绑定地址，记录端口范围
+func validate_proxy_ports(i int, p *ProxyConfig) error {
+	if err := p.Bind.validate(); err != nil {
+		return fmt.Errorf("代理[%d] bind: %v", i, err)
+	}
+	if p.LocalPorts == "" {
+		if p.LocalPort <= 0 || p.LocalPort > 65535 {
+			return fmt.Errorf("代理[%d]本地端口号无效: %d", i, p.LocalPort)
+		}
+		p.port_min, p.port_max = p.LocalPort, p.LocalPort
+		return nil
+	}
+
+	if p.LocalPort != 0 {
+		return fmt.Errorf("代理[%d] local_port 与 local_ports 不能同时配置", i)
+	}
+	lo, hi, err := parse_port_range(p.LocalPorts)
+	if err != nil {
+		return fmt.Errorf("代理[%d] local_ports %v", i, err)
+	}
+	if p.Service != "" || p.TargetAddress == "" {
+		return fmt.Errorf("代理[%d]端口范围需要配置 target_address 端口范围，不支持service", i)
+	}
+	_, port, err := net.SplitHostPort(p.TargetAddress)
+	if err != nil {
+		return fmt.Errorf("代理[%d]目标地址无效: %v", i, err)
+	}
+	target_lo, target_hi, err := parse_port_range(port)
+	if err != nil {
+		return fmt.Errorf("代理[%d]目标%v", i, err)
+	}
+	if target_hi-target_lo != hi-lo {
+		return fmt.Errorf("代理[%d]目标端口范围 %s 与本地端口范围 %s 长度不同", i, port, p.LocalPorts)
+	}
+	p.port_min, p.port_max, p.target_port_min = lo, hi, target_lo
+	return nil
+}
+
+// 同一协议、绑定地址有重叠的代理，本地端口不能重叠
+func check_proxy_overlap(proxies []ProxyConfig) error {
+	for i := range proxies {
+		a := &proxies[i]
+		for j := 0; j < i; j++ {
+			b := &proxies[j]
+			if a.Listen != "" || b.Listen != "" {
+				if a.Listen == b.Listen {
+					return fmt.Errorf("代理[%d]与代理[%d]监听同一个unix socket: %s", j, i, a.Listen)
+				}
+				continue
+			}
+			if a.GetProtocol() != b.GetProtocol() || !a.binds().overlaps(b.binds()) {
+				continue
+			}
+			if a.port_min <= b.port_max && b.port_min <= a.port_max {
+				return fmt.Errorf("代理[%d] %s 与代理[%d] %s 的本地端口重叠", j, b.ListenAddr(), i, a.ListenAddr())
+			}
+		}
+	}
+	return nil
+}
+
+// 展开端口范围：每个本地端口一个代理，目标端口按偏移对应
+func (p *ProxyConfig) expand() []ProxyConfig {
+	if p.LocalPorts == "" {
+		return []ProxyConfig{*p}
+	}
+	host, _, _ := net.SplitHostPort(p.TargetAddress)
+	var proxies []ProxyConfig
+	for port := p.port_min; port <= p.port_max; port++ {
+		c := *p
+		c.LocalPort, c.LocalPorts = port, ""
+		c.TargetAddress = net.JoinHostPort(host, strconv.Itoa(p.target_port_min+port-p.port_min))
+		proxies = append(proxies, c)
+	}
+	return proxies
+}
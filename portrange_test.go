@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProxyPortRange(t *testing.T) {
+	config := &Config{NodeID: "range-node1", Proxies: []ProxyConfig{
+		{Name: "ftp", LocalPort: 2121, TargetNodeID: "88b2c4d4e5", TargetAddress: "10.0.0.5:21"},
+		{Name: "ftp-data", LocalPorts: "30000-30002", Bind: bind_list{"127.0.0.1"}, TargetNodeID: "88b2c4d4e5", TargetAddress: "10.0.0.5:40000-40002"},
+		{Name: "rtp", LocalPorts: "30000-30002", Protocol: PROTO_UDP, TargetNodeID: "88b2c4d4e5", TargetAddress: "10.0.0.6:30000-30002"},
+		{Name: "other", LocalPorts: "30000-30002", Bind: bind_list{"127.0.0.2"}, TargetNodeID: "88b2c4d4e5", TargetAddress: "10.0.0.7:30000-30002"},
+	}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	proxies := config.Proxies[1].expand()
+	if len(proxies) != 3 {
+		t.Fatalf("应该展开成3个代理: %d", len(proxies))
+	}
+	for i, want := range []string{"10.0.0.5:40000", "10.0.0.5:40001", "10.0.0.5:40002"} {
+		p := proxies[i]
+		if p.LocalPort != 30000+i || p.TargetAddress != want || p.ListenAddr() != fmt.Sprintf("127.0.0.1:%d", 30000+i) {
+			t.Errorf("展开的代理[%d]不正确: %s -> %s", i, p.ListenAddr(), p.TargetAddress)
+		}
+	}
+	if got := config.Proxies[0].expand(); len(got) != 1 || got[0].TargetAddress != "10.0.0.5:21" {
+		t.Errorf("单个端口不应该展开: %+v", got)
+	}
+	if p := config.GetProxyByPort(30001); p == nil || p.Name != "ftp-data" {
+		t.Errorf("应该按端口范围查找代理: %v", p)
+	}
+
+	for name, bad := range map[string][]ProxyConfig{
+		"目标范围长度不同": {{Name: "a", LocalPorts: "30000-30010", TargetNodeID: "n", TargetAddress: "10.0.0.5:30000-30005"}},
+		"目标没有范围":   {{Name: "a", LocalPorts: "30000-30010", TargetNodeID: "n", TargetAddress: "10.0.0.5:21"}},
+		"范围颠倒":     {{Name: "a", LocalPorts: "30010-30000", TargetNodeID: "n", TargetAddress: "10.0.0.5:30010-30000"}},
+		"范围和端口":    {{Name: "a", LocalPort: 21, LocalPorts: "30000-30001", TargetNodeID: "n", TargetAddress: "10.0.0.5:30000-30001"}},
+		"范围和服务":    {{Name: "a", LocalPorts: "30000-30001", Service: "ftp@n"}},
+		"bind无效":   {{Name: "a", LocalPort: 21, Bind: bind_list{"localhost"}, TargetNodeID: "n", TargetAddress: "10.0.0.5:21"}},
+		"范围重叠": {
+			{Name: "a", LocalPorts: "30000-30010", TargetNodeID: "n", TargetAddress: "10.0.0.5:30000-30010"},
+			{Name: "b", LocalPort: 30005, Bind: bind_list{"127.0.0.1"}, TargetNodeID: "n", TargetAddress: "10.0.0.5:21"},
+		},
+		"端口重复": {
+			{Name: "a", LocalPort: 21, TargetNodeID: "n", TargetAddress: "10.0.0.5:21"},
+			{Name: "b", LocalPort: 21, TargetNodeID: "n", TargetAddress: "10.0.0.6:21"},
+		},
+	} {
+		if err := validateConfig(&Config{NodeID: "range-node1", Proxies: bad}); err == nil {
+			t.Errorf("%s 应该无效", name)
+		}
+	}
+}
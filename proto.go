@@ -1,16 +1,17 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
-// 这里会定义一些结构体。用于传输数据，json格式
+// 这里会定义一些结构体。用于传输数据，json格式（控制通道可协商为cbor，见codec.go）
 
-// 消息类型常量
+// 消息类型常量，每个类型的编码必须唯一（在msg_types中注册，重复编码会编译失败）
 const (
 	MSG_TYPE_SYN_MSG       = 0  // 握手-并告知这是一条控制信令通道
 	MSG_TYPE_SYN_ACK_MSG   = 1  // 握手回复-并告知这是一条控制信令通道
@@ -18,14 +19,101 @@ const (
 	MSG_TYPE_SYN_ACK_DATA  = 3  // 握手回复-并告知这是一条数据通道
 	MSG_TYPE_PING          = 4  // ping消息
 	MSG_TYPE_PONG          = 5  // pong回复
-	MSG_TYPE_PROXY_DATA    = 6  // 代理数据
-	MSG_TYPE_NODE_INFO     = 5  // 节点信息
-	MSG_TYPE_ROUTE_UPDATE  = 5  // 路由更新
 	MSG_TYPE_FIND_NODE     = 6  // 查找节点
 	MSG_TYPE_FIND_NODE_ACK = 7  // 查找节点回复
+	MSG_TYPE_ROUTE_UPDATE  = 8  // 路由更新
+	MSG_TYPE_NODE_INFO     = 9  // 节点信息
 	MSG_TYPE_ERROR         = 99 // 错误消息
 )
 
+// 协议版本
+// 1: 最初版本，SYN/PING/FIND_NODE
+// 2: 路由通告、错误回复、FIND_NODE请求ID、跳数限制、能力协商
+// 3: 控制通道CBOR编码
+// 4: NODE_INFO服务通告、数据通道按服务名连接
+// 5: 数据通道UDP转发、发起方要求目标节点发送PROXY协议头
+const (
+	VERSION     = 5 // 本节点支持的最高版本
+	MIN_VERSION = 1 // 本节点还能兼容的最低版本
+)
+
+// 能力标志，在SYN_MSG/SYN_ACK_MSG中交换，双方都支持的能力才会启用
+const (
+	CAP_ROUTE_UPDATE = 1 << 0 // 支持ROUTE_UPDATE路由通告
+	CAP_ERROR_REPLY  = 1 << 1 // 数据通道失败时回复ERROR
+	CAP_FIND_NODE_ID = 1 << 2 // FIND_NODE带请求ID和跳数限制
+	CAP_CODEC_CBOR   = 1 << 3 // 控制通道使用CBOR编码
+	CAP_NODE_INFO    = 1 << 4 // 支持NODE_INFO服务通告
+	CAP_DATA_UDP     = 1 << 5 // 数据通道支持 protocol: udp
+	CAP_DATA_PROXY   = 1 << 6 // 数据通道支持 proxy_protocol
+)
+
+// 本节点支持的能力
+const CAPABILITIES = CAP_ROUTE_UPDATE | CAP_ERROR_REPLY | CAP_FIND_NODE_ID | CAP_CODEC_CBOR | CAP_NODE_INFO | CAP_DATA_UDP | CAP_DATA_PROXY
+
+// 握手时通告的能力，配置为JSON编码时不通告CBOR，双方都使用JSON方便抓包调试
+func local_capabilities() uint32 {
+	if fm != nil && fm.config != nil && fm.config.Quic.GetCodec() == CODEC_JSON {
+		return CAPABILITIES &^ CAP_CODEC_CBOR
+	}
+	return CAPABILITIES
+}
+
+// 消息类型注册信息
+type msg_type_info struct {
+	name     string             // 类型名称，用于日志
+	since    int                // 引入该消息的协议版本
+	cap      uint32             // 发送该消息需要对端支持的能力，0表示不需要
+	new_data func() interface{} // 创建Data对应的结构体
+}
+
+// 协议注册表
+var msg_types = map[int]msg_type_info{
+	MSG_TYPE_SYN_MSG:       {"SYN_MSG", 1, 0, func() interface{} { return &SynMsgMessage{} }},
+	MSG_TYPE_SYN_ACK_MSG:   {"SYN_ACK_MSG", 1, 0, func() interface{} { return &SynAckMsgMessage{} }},
+	MSG_TYPE_SYN_DATA:      {"SYN_DATA", 1, 0, func() interface{} { return &SynDataMessage{} }},
+	MSG_TYPE_SYN_ACK_DATA:  {"SYN_ACK_DATA", 1, 0, func() interface{} { return &SynAckDataMessage{} }},
+	MSG_TYPE_PING:          {"PING", 1, 0, func() interface{} { return &PingMessage{} }},
+	MSG_TYPE_PONG:          {"PONG", 1, 0, func() interface{} { return &PongMessage{} }},
+	MSG_TYPE_FIND_NODE:     {"FIND_NODE", 1, 0, func() interface{} { return &FindNodeMessage{} }},
+	MSG_TYPE_FIND_NODE_ACK: {"FIND_NODE_ACK", 1, 0, func() interface{} { return &FindNodeAckMessage{} }},
+	MSG_TYPE_ROUTE_UPDATE:  {"ROUTE_UPDATE", 2, CAP_ROUTE_UPDATE, func() interface{} { return &RouteUpdateMessage{} }},
+	MSG_TYPE_NODE_INFO:     {"NODE_INFO", 4, CAP_NODE_INFO, func() interface{} { return &NodeInfoMessage{} }},
+	MSG_TYPE_ERROR:         {"ERROR", 2, CAP_ERROR_REPLY, func() interface{} { return &ErrorMessage{} }},
+}
+
+func msg_type_name(typ int) string {
+	if info, ok := msg_types[typ]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("UNKNOWN-%d", typ)
+}
+
+// 对端（协商后的版本和能力）是否能处理该类型的消息
+func msg_type_supported(typ int, version int, caps uint32) bool {
+	info, ok := msg_types[typ]
+	if !ok || version < info.since {
+		return false
+	}
+	return info.cap == 0 || caps&info.cap != 0
+}
+
+// 协商协议版本：取双方最高版本中较小的一个，低于任意一方的最低版本则拒绝
+// peer_min_version 为0表示对端是不带该字段的老版本
+func negotiate_protocol(peer_version int, peer_min_version int, peer_caps uint32) (int, uint32, error) {
+	version := peer_version
+	if version > VERSION {
+		version = VERSION
+	}
+	if version < MIN_VERSION {
+		return 0, 0, fmt.Errorf("对端协议版本%d过低，本节点最低支持%d", peer_version, MIN_VERSION)
+	}
+	if peer_min_version > VERSION {
+		return 0, 0, fmt.Errorf("对端最低要求协议版本%d，本节点最高支持%d", peer_min_version, VERSION)
+	}
+	return version, peer_caps & local_capabilities(), nil
+}
+
 // 基础消息结构
 type QuicMessage struct {
 	Type   int         `json:"type"`    // 消息类型
@@ -44,86 +132,44 @@ func NewQuicMessage(typ int, remote_node_id string, data interface{}) *QuicMessa
 }
 
 func (m *QuicMessage) ToBuffer() []byte {
-	buf, err := json.Marshal(m)
-	if err != nil {
-		return nil
-	}
-	// 前面2个字节是len
-	lenBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBuf, uint16(len(buf)))
-	buf = append(lenBuf, buf...)
-	return buf
+	return m.encode(codecs[CODEC_JSON])
 }
 
-func QuicMessageFromStream(stream quic.Stream) *QuicMessage {
-	buf := make([]byte, 2)
-	_, err := stream.Read(buf)
-	if err != nil {
-		return nil
-	}
-	len := binary.BigEndian.Uint16(buf)
-	buf = make([]byte, len)
-	_, err = stream.Read(buf)
+// 使用指定的编码序列化消息并加上帧头
+func (m *QuicMessage) encode(c codec) []byte {
+	buf, err := c.encode(m)
 	if err != nil {
-		fmt.Printf("读取消息长度失败: %v\n", err)
+		fmt.Printf("⚠️  序列化消息失败: %v\n", err)
 		return nil
 	}
-	var msg QuicMessage
-	err = json.Unmarshal(buf, &msg)
+	return encode_frame(buf)
+}
+
+var errWrongToID = errors.New("节点ID不匹配")
+
+// 从stream读取一条发给本节点的消息
+func QuicMessageFromStream(stream quic.Stream) (*QuicMessage, error) {
+	msg, err := read_quic_message(stream, fm.config.Quic.GetMaxFrameSize())
 	if err != nil {
-		fmt.Printf("解析消息失败: %v\n", err)
-		return nil
+		return nil, err
 	}
 	if msg.ToID != fm.config.NodeID {
-		fmt.Printf("节点ID不匹配，丢弃消息: %s\n", msg.ToID)
-		return nil
+		return nil, fmt.Errorf("%w，丢弃消息: %s", errWrongToID, msg.ToID)
 	}
+	return msg, nil
+}
 
-	// 根据消息类型反序列化Data字段
-	switch msg.Type {
-	case MSG_TYPE_SYN_MSG:
-		var synMsg SynMsgMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &synMsg)
-		msg.Data = &synMsg
-	case MSG_TYPE_SYN_DATA:
-		var synData SynDataMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &synData)
-		msg.Data = &synData
-	case MSG_TYPE_SYN_ACK_MSG:
-		var synAckMsg SynAckMsgMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &synAckMsg)
-		msg.Data = &synAckMsg
-	case MSG_TYPE_SYN_ACK_DATA:
-		var synAckData SynAckDataMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &synAckData)
-		msg.Data = &synAckData
-	case MSG_TYPE_PING:
-		var pingMsg PingMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &pingMsg)
-		msg.Data = &pingMsg
-	case MSG_TYPE_PONG:
-		var pongMsg PongMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &pongMsg)
-		msg.Data = &pongMsg
-	case MSG_TYPE_FIND_NODE:
-		var findNodeMsg FindNodeMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &findNodeMsg)
-		msg.Data = &findNodeMsg
-	case MSG_TYPE_FIND_NODE_ACK:
-		var findNodeAckMsg FindNodeAckMessage
-		dataBytes, _ := json.Marshal(msg.Data)
-		json.Unmarshal(dataBytes, &findNodeAckMsg)
-		msg.Data = &findNodeAckMsg
+// 读取并解析一条消息，Data按消息类型解析成对应的结构体
+func read_quic_message(r io.Reader, max_size int) (*QuicMessage, error) {
+	buf, err := read_frame(r, max_size)
+	if err != nil {
+		return nil, err
 	}
+	return decode_quic_message(buf)
+}
 
-	return &msg
+func decode_quic_message(buf []byte) (*QuicMessage, error) {
+	return detect_codec(buf).decode(buf)
 }
 
 const (
@@ -131,29 +177,84 @@ const (
 	LINK_TYPE_DATA = 1 // 数据通道
 )
 
+// 中继请求（SYN_DATA/FIND_NODE）最多经过的跳数
+const HOP_LIMIT = ROUTE_COST_INFINITY
+
+// 数据通道握手的超时时间
+const (
+	SYN_DATA_TIMEOUT    = 10 * time.Second // 发起方等待synack的时间
+	OPEN_STREAM_TIMEOUT = 3 * time.Second  // 等待对端放开stream数量限制的时间
+	TARGET_DIAL_TIMEOUT = 5 * time.Second  // 目标节点连接目标地址的超时时间
+	DATA_PEER_WAIT      = 2 * time.Second  // 数据通道等待所在连接完成消息通道注册的时间
+)
+
+// 错误码
 const (
-	VERSION = 1
+	ERR_CODE_HOP_LIMIT          = 1 // 超过跳数限制
+	ERR_CODE_LOOP               = 2 // 转发路径出现环路
+	ERR_CODE_TARGET_UNREACHABLE = 3 // 目标节点连接目标地址失败
+	ERR_CODE_NODE_NOT_FOUND     = 4 // 找不到目标节点或下一跳
+	ERR_CODE_REFUSED_BY_ACL     = 5 // 被访问控制策略拒绝
+	ERR_CODE_OVERLOADED         = 6 // 节点过载
+	ERR_CODE_TIMEOUT            = 7 // 等待下游回复超时
+	ERR_CODE_PROTOCOL           = 8 // 下游回复了无法识别的消息或直接关闭
+	ERR_CODE_SERVICE_NOT_FOUND  = 9 // 目标节点没有发布该服务
 )
 
+var error_code_names = map[int]string{
+	ERR_CODE_HOP_LIMIT:          "hop-limit",
+	ERR_CODE_LOOP:               "loop",
+	ERR_CODE_TARGET_UNREACHABLE: "target-unreachable",
+	ERR_CODE_NODE_NOT_FOUND:     "node-not-found",
+	ERR_CODE_REFUSED_BY_ACL:     "refused-by-acl",
+	ERR_CODE_OVERLOADED:         "overloaded",
+	ERR_CODE_TIMEOUT:            "timeout",
+	ERR_CODE_PROTOCOL:           "protocol-error",
+	ERR_CODE_SERVICE_NOT_FOUND:  "service-not-found",
+}
+
+func error_code_name(code int) string {
+	if name, ok := error_code_names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("error-%d", code)
+}
+
 // 握手-并告知这是一条控制信令通道
 type SynMsgMessage struct {
-	Version int    `json:"version"` // 版本号
-	NodeID  string `json:"node_id"` // 发送方节点ID
-	IsUp    bool   `json:"is_up"`   // 是否是上级节点
+	Version      int    `json:"version"`              // 支持的最高版本号
+	MinVersion   int    `json:"min_version"`          // 支持的最低版本号
+	Capabilities uint32 `json:"capabilities"`         // 能力标志
+	NodeID       string `json:"node_id"`              // 发送方节点ID
+	IsUp         bool   `json:"is_up"`                // 是否是上级节点
+	PublicKey    []byte `json:"public_key,omitempty"` // 节点公钥（启用密钥身份时）
+	Signature    []byte `json:"signature,omitempty"`  // 对本连接挑战值的签名
+	Auth         []byte `json:"auth,omitempty"`       // 组网密钥认证码
 }
 
 type SynAckMsgMessage struct {
-	IsUp    bool   `json:"is_up"`   // 是否是上级节点
-	Result  bool   `json:"result"`  // 是否成功
-	Reason  string `json:"reason"`  // 原因
-	Version int    `json:"version"` // 版本号
+	IsUp         bool   `json:"is_up"`                // 是否是上级节点
+	Result       bool   `json:"result"`               // 是否成功
+	Reason       string `json:"reason"`               // 原因
+	Version      int    `json:"version"`              // 协商后的版本号
+	MinVersion   int    `json:"min_version"`          // 支持的最低版本号
+	Capabilities uint32 `json:"capabilities"`         // 能力标志
+	PublicKey    []byte `json:"public_key,omitempty"` // 节点公钥（启用密钥身份时）
+	Signature    []byte `json:"signature,omitempty"`  // 对本连接挑战值的签名
+	Auth         []byte `json:"auth,omitempty"`       // 组网密钥认证码
 }
 
 // 握手-并告知这是一条数据通道
 type SynDataMessage struct {
-	NodeID        string `json:"node_id"`         // 发送方节点ID
-	TargetID      string `json:"target_id"`       // 能帮我传输数据的目标节点ID
-	TargetTcpAddr string `json:"target_tcp_addr"` // 目标tcp地址
+	NodeID        string   `json:"node_id"`                  // 发起方节点ID
+	TargetID      string   `json:"target_id"`                // 能帮我传输数据的目标节点ID
+	TargetTcpAddr string   `json:"target_tcp_addr"`          // 目标tcp地址
+	Service       string   `json:"service,omitempty"`        // 目标节点发布的服务名，设置时忽略目标tcp地址
+	Protocol      string   `json:"protocol,omitempty"`       // 传输协议，为空表示tcp；udp时数据通道上每个报文为一个消息帧
+	ClientAddr    string   `json:"client_addr,omitempty"`    // 发起方节点看到的客户端地址 ip:port
+	ProxyProtocol string   `json:"proxy_protocol,omitempty"` // 要求目标节点连接目标后发送PROXY协议头: v1/v2
+	HopLimit      int      `json:"hop_limit"`                // 剩余可转发跳数
+	Path          []string `json:"path"`                     // 已经过的节点ID（含发起方）
 }
 
 type SynAckDataMessage struct {
@@ -167,22 +268,62 @@ type PingMessage struct {
 type PongMessage struct {
 }
 
-// Ping消息结构
+// 查找节点
 type FindNodeMessage struct {
-	NodeID   string `json:"node_id"`   // 发起查找的节点ID
-	TargetID string `json:"target_id"` // 目标节点ID
+	RequestID string   `json:"request_id"` // 请求ID，由发起方生成，用于匹配回复
+	NodeID    string   `json:"node_id"`    // 发起查找的节点ID
+	TargetID  string   `json:"target_id"`  // 目标节点ID
+	HopLimit  int      `json:"hop_limit"`  // 剩余可转发跳数
+	Path      []string `json:"path"`       // 已经过的节点ID（含发起方）
 }
 
-// Pong回复结构
+// 查找节点回复
 type FindNodeAckMessage struct {
-	NodeID   string `json:"node_id"`   // 发起查找的节点ID
-	TargetID string `json:"target_id"` // 目标节点ID
-	IsExist  bool   `json:"is_exist"`  // 是否存在
+	RequestID string        `json:"request_id"`          // 请求ID
+	NodeID    string        `json:"node_id"`             // 发起查找的节点ID
+	TargetID  string        `json:"target_id"`           // 目标节点ID
+	IsExist   bool          `json:"is_exist"`            // 是否存在
+	Error     *ErrorMessage `json:"error,omitempty"`     // 中继拒绝转发时的错误
+	HopLimit  int           `json:"hop_limit,omitempty"` // 剩余可转发跳数
+	Path      []string      `json:"path,omitempty"`      // 回复已经过的节点ID（含回复方）
+}
+
+// 错误消息，由产生错误的节点发出，沿原路返回给请求发起方
+type ErrorMessage struct {
+	Code   int    `json:"code"`    // 错误码
+	Detail string `json:"detail"`  // 错误详情
+	NodeID string `json:"node_id"` // 产生错误的节点ID
+}
+
+func new_error_message(code int, detail string) *ErrorMessage {
+	return &ErrorMessage{Code: code, Detail: detail, NodeID: fm.config.NodeID}
+}
+
+func (e *ErrorMessage) Error() string {
+	return fmt.Sprintf("%s [%s]: %s", error_code_name(e.Code), e.NodeID, e.Detail)
+}
+
+// 路由通告中的一条路由
+type RouteInfo struct {
+	NodeID string   `json:"node_id"` // 目标节点ID
+	Cost   int      `json:"cost"`    // 发送方到目标节点的开销（跳数）
+	Path   []string `json:"path"`    // 从发送方到目标节点经过的节点ID（含发送方和目标节点）
+}
+
+// 路由更新，每次都携带发送方完整的可达列表
+type RouteUpdateMessage struct {
+	Routes []RouteInfo `json:"routes"` // 可达节点列表
+}
+
+// 服务通告中的一个服务，只包含服务名，不暴露目标节点的本地地址
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"` // 目标节点最近一次探测服务地址是否成功
 }
 
-// 代理数据结构
-type ProxyMessage struct {
-	ProxyID    string `json:"proxy_id"`    // 代理连接ID
-	TargetNode string `json:"target_node"` // 目标节点ID
-	TargetAddr string `json:"target_addr"` // 目标地址
+// 节点信息：节点发布的服务列表，由中继节点转发给整个网络
+type NodeInfoMessage struct {
+	NodeID   string        `json:"node_id"`  // 发布服务的节点ID
+	Seq      uint64        `json:"seq"`      // 通告序号，越大越新
+	Services []ServiceInfo `json:"services"` // 服务列表
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY协议：目标节点连接目标后先发送一个头，告诉后端服务真实的客户端地址
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+
+	PROXY_PROTOCOL_V1_MAX_LEN = 107             // v1头最大长度（含\r\n）
+	PROXY_PROTOCOL_TIMEOUT    = 5 * time.Second // 接受连接后等待PROXY协议头的时间
+)
+
+var proxy_protocol_v2_sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func valid_proxy_protocol(version string) bool {
+	return version == "" || version == PROXY_PROTOCOL_V1 || version == PROXY_PROTOCOL_V2
+}
+
+// 生成PROXY协议头，src为客户端地址，dst为后端地址
+// 客户端地址未知或与后端地址族不同时，v1写UNKNOWN，v2写LOCAL命令，后端使用连接本身的地址
+func proxy_protocol_header(version string, src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	var src_ip, dst_ip net.IP
+	if src != nil && dst != nil {
+		src_ip, dst_ip = src.IP.To4(), dst.IP.To4()
+		if src_ip == nil || dst_ip == nil {
+			src_ip, dst_ip = src.IP.To16(), dst.IP.To16()
+			if src.IP.To4() != nil || dst.IP.To4() != nil {
+				src_ip, dst_ip = nil, nil
+			}
+		}
+	}
+	known := src_ip != nil && dst_ip != nil
+
+	if version == PROXY_PROTOCOL_V1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if len(src_ip) == net.IPv6len {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src_ip, dst_ip, src.Port, dst.Port))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxy_protocol_v2_sig)
+	if !known {
+		// 版本2，LOCAL命令，没有地址
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	family := byte(0x11) // AF_INET, STREAM
+	if len(src_ip) == net.IPv6len {
+		family = 0x21 // AF_INET6, STREAM
+	}
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(src_ip)+4))
+	buf.Write(src_ip)
+	buf.Write(dst_ip)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+// 目标节点要发送的PROXY协议版本：服务配置了就按服务的，否则按发起方代理的要求
+func target_proxy_protocol(service string, requested string) string {
+	if service != "" {
+		if s := fm.config.GetService(service); s != nil && s.ProxyProtocol != "" {
+			return s.ProxyProtocol
+		}
+	}
+	return requested
+}
+
+// 在连接目标的TCP连接上发送PROXY协议头，client_addr为发起方节点看到的客户端地址
+func write_proxy_header(conn net.Conn, version string, client_addr string) error {
+	if version == "" {
+		return nil
+	}
+	var src *net.TCPAddr
+	if addr, err := netip.ParseAddrPort(client_addr); err == nil {
+		src = net.TCPAddrFromAddrPort(addr)
+	}
+	dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+	_, err := conn.Write(proxy_protocol_header(version, src, dst))
+	return err
+}
+
+// 解析PROXY协议头（v1或v2），返回其中的客户端地址
+// LOCAL命令、UNKNOWN或非TCP地址族返回nil，表示使用连接本身的地址
+func read_proxy_protocol(r *bufio.Reader) (*net.TCPAddr, error) {
+	sig, err := r.Peek(len(proxy_protocol_v2_sig))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxy_protocol_v2_sig):
+		return read_proxy_protocol_v2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return read_proxy_protocol_v1(r)
+	}
+	return nil, errors.New("没有PROXY协议头")
+}
+
+// v1: PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n
+func read_proxy_protocol_v1(r *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXY_PROTOCOL_V1_MAX_LEN {
+			return nil, errors.New("v1头过长")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("v1头格式错误: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("v1头地址错误: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// v2: 12字节签名，版本/命令，地址族/协议，2字节长度，地址
+func read_proxy_protocol_v2(r *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("不支持的v2版本: %#x", header[12])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0F {
+	case 0x0:
+		// LOCAL：负载均衡自己的连接（例如健康检查）
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("不支持的v2命令: %#x", header[12])
+	}
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("v2 IPv4地址长度错误")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("v2 IPv6地址长度错误")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// 解析了PROXY协议头的连接：RemoteAddr为头中的客户端地址，已经缓存的数据先读出
+type proxied_conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxied_conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxied_conn) RemoteAddr() net.Addr       { return c.remote }
+
+// 来自负载均衡的连接先读取PROXY协议头，返回的连接的RemoteAddr为真实的客户端地址
+func accept_proxy_protocol(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_PROTOCOL_TIMEOUT))
+	r := bufio.NewReader(conn)
+	src, err := read_proxy_protocol(r)
+	if err != nil {
+		fm.metrics.inc("proxy_protocol_error")
+		return nil, fmt.Errorf("解析%s的PROXY协议头失败: %v", conn.RemoteAddr(), err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	var remote net.Addr = conn.RemoteAddr()
+	if src != nil {
+		remote = src
+	}
+	return &proxied_conn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// 地址中的IP，不是IP地址时返回nil
+func addr_ip(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5555}
+	backend4 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5555}
+	backend6 := &net.TCPAddr{IP: net.IPv6loopback, Port: 5432}
+
+	for _, c := range []struct {
+		src  *net.TCPAddr
+		dst  *net.TCPAddr
+		want string
+	}{
+		{v4, backend4, "PROXY TCP4 203.0.113.7 127.0.0.1 5555 5432\r\n"},
+		{v6, backend6, "PROXY TCP6 2001:db8::1 ::1 5555 5432\r\n"},
+		{v4, backend6, "PROXY UNKNOWN\r\n"},
+		{nil, backend4, "PROXY UNKNOWN\r\n"},
+	} {
+		if got := string(proxy_protocol_header(PROXY_PROTOCOL_V1, c.src, c.dst)); got != c.want {
+			t.Errorf("v1头不正确: %q, 期望: %q", got, c.want)
+		}
+	}
+
+	header := proxy_protocol_header(PROXY_PROTOCOL_V2, v4, backend4)
+	want := append(append([]byte{}, proxy_protocol_v2_sig...), 0x21, 0x11, 0x00, 12, 203, 0, 113, 7, 127, 0, 0, 1, 0x15, 0xb3, 0x15, 0x38)
+	if !bytes.Equal(header, want) {
+		t.Errorf("v2头不正确: %x", header)
+	}
+	if header := proxy_protocol_header(PROXY_PROTOCOL_V2, v6, backend6); len(header) != 16+36 || header[13] != 0x21 {
+		t.Errorf("v2 IPv6头不正确: %x", header)
+	}
+	if header := proxy_protocol_header(PROXY_PROTOCOL_V2, nil, backend4); !bytes.Equal(header[12:], []byte{0x20, 0, 0, 0}) {
+		t.Errorf("未知地址应该使用LOCAL命令: %x", header)
+	}
+}
+
+// 目标节点连接目标后先发送PROXY协议头
+func TestProxyProtocolTarget(t *testing.T) {
+	setup_test_node()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+			conn.Close()
+		}
+	}()
+	child := dial_test_peer(t, "pp-child-1")
+	defer child.close()
+
+	addr := backend.Addr().(*net.TCPAddr)
+	reply := child.open_data(t, SynDataMessage{
+		NodeID:        child.node_id,
+		TargetID:      fm.config.NodeID,
+		TargetTcpAddr: addr.String(),
+		ClientAddr:    "203.0.113.7:5555",
+		ProxyProtocol: PROXY_PROTOCOL_V1,
+		HopLimit:      5,
+		Path:          []string{child.node_id},
+	})
+	if reply == nil || reply.Type != MSG_TYPE_SYN_ACK_DATA {
+		t.Fatalf("应该建立数据通道: %v", reply)
+	}
+	select {
+	case line := <-lines:
+		if want := "PROXY TCP4 203.0.113.7 127.0.0.1 5555 " + strconv.Itoa(addr.Port) + "\r\n"; line != want {
+			t.Errorf("PROXY协议头不正确: %q, 期望: %q", line, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("后端没有收到连接")
+	}
+
+	reply = child.open_data(t, SynDataMessage{
+		NodeID:        child.node_id,
+		TargetID:      fm.config.NodeID,
+		TargetTcpAddr: addr.String(),
+		ProxyProtocol: "v3",
+		HopLimit:      5,
+		Path:          []string{child.node_id},
+	})
+	if reply == nil || reply.Type != MSG_TYPE_ERROR {
+		t.Errorf("不支持的PROXY协议版本应该回复错误: %v", reply)
+	}
+}
+
+// 代理把本地客户端地址和PROXY协议要求带给目标节点
+func TestProxyClientAddr(t *testing.T) {
+	setup_test_node()
+
+	peer := dial_test_peer(t, "pp-peer-1")
+	defer peer.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(peer.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+	syns := make(chan map[string]interface{}, 1)
+	peer.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		syns <- syn
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tcp_proxy_handle(conn, ProxyConfig{Name: "pg", TargetNodeID: peer.node_id, TargetAddress: "10.0.0.5:5432", ProxyProtocol: PROXY_PROTOCOL_V2})
+
+	select {
+	case syn := <-syns:
+		if syn["client_addr"] != client.LocalAddr().String() || syn["proxy_protocol"] != PROXY_PROTOCOL_V2 {
+			t.Errorf("数据通道握手没有带客户端地址: %+v", syn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有建立数据通道")
+	}
+}
+
+func TestReadProxyProtocol(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5555}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5555}
+	backend4 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}
+	backend6 := &net.TCPAddr{IP: net.IPv6loopback, Port: 5432}
+	for _, version := range []string{PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2} {
+		for _, c := range []struct {
+			src  *net.TCPAddr
+			dst  *net.TCPAddr
+			want string
+		}{
+			{v4, backend4, "203.0.113.7:5555"},
+			{v6, backend6, "[2001:db8::1]:5555"},
+			{nil, backend4, ""},
+		} {
+			header := proxy_protocol_header(version, c.src, c.dst)
+			r := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+			src, err := read_proxy_protocol(r)
+			if err != nil {
+				t.Fatalf("[%s] 解析失败: %v", version, err)
+			}
+			if got := ""; src != nil {
+				got = src.String()
+				if got != c.want {
+					t.Errorf("[%s] 客户端地址不正确: %s, 期望: %s", version, got, c.want)
+				}
+			} else if c.want != "" {
+				t.Errorf("[%s] 应该解析出客户端地址%s", version, c.want)
+			}
+			if rest, _ := r.ReadString(0); rest != "data" {
+				t.Errorf("[%s] 头后面的数据不正确: %q", version, rest)
+			}
+		}
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7 127.0.0.1 5555\r\n",
+		"PROXY TCP4 2001:db8::1 ::1 5555 5432\r\n",
+		"PROXY TCP4 203.0.113.7 127.0.0.1 5555 5432" + strings.Repeat(" ", 80) + "\r\n",
+	} {
+		if _, err := read_proxy_protocol(bufio.NewReader(strings.NewReader(bad))); err == nil {
+			t.Errorf("应该解析失败: %q", bad)
+		}
+	}
+}
+
+// 来自负载均衡的连接按PROXY协议头中的地址检查allow_clients
+func TestProxyAccept(t *testing.T) {
+	setup_test_node()
+	config := &Config{NodeID: "pp-accept1", Proxies: []ProxyConfig{{
+		Name:           "pg",
+		LocalPort:      15432,
+		TargetNodeID:   "88b2c4d4e5",
+		TargetAddress:  "127.0.0.1:5432",
+		TrustedProxies: []string{"127.0.0.1"},
+		AllowClients:   []string{"203.0.113.0/24", "2001:db8::/32"},
+	}}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	proxy := config.Proxies[0]
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accept := func(data string) (net.Conn, error) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		client.Write([]byte(data))
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxy_accept(conn, proxy)
+	}
+
+	conn, err := accept("PROXY TCP4 203.0.113.7 127.0.0.1 5555 15432\r\nhello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "203.0.113.7:5555" {
+		t.Errorf("客户端地址应该来自PROXY协议头: %s", conn.RemoteAddr())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("头后面的数据不正确: %q %v", buf, err)
+	}
+
+	if _, err := accept("PROXY TCP4 198.51.100.1 127.0.0.1 5555 15432\r\n"); err == nil {
+		t.Error("不在allow_clients中的客户端应该被拒绝")
+	}
+	if _, err := accept("GET / HTTP/1.1\r\n\r\n"); err == nil {
+		t.Error("来自负载均衡的连接没有PROXY协议头时应该被拒绝")
+	}
+
+	config.Proxies[0].AllowClients = []string{"not-an-ip"}
+	if err := validateConfig(config); err == nil {
+		t.Error("allow_clients应该只接受IP或CIDR")
+	}
+}
+
+// 下一跳不支持PROXY协议头时建立数据通道失败，不能悄悄地不发协议头
+func TestProxyProtocolOldPeer(t *testing.T) {
+	setup_test_node()
+
+	old, ack := dial_test_peer_syn(t, SynMsgMessage{
+		Version:      4,
+		MinVersion:   MIN_VERSION,
+		Capabilities: CAPABILITIES &^ (CAP_CODEC_CBOR | CAP_DATA_UDP | CAP_DATA_PROXY),
+		NodeID:       "pp-old-1",
+	})
+	defer old.close()
+	if ack == nil || !ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Fatalf("握手失败: %v", ack)
+	}
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(old.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+	opened := make(chan map[string]interface{}, 2)
+	old.accept_data(func(syn map[string]interface{}, stream quic.Stream) { opened <- syn })
+
+	syn := SynDataMessage{TargetID: old.node_id, TargetTcpAddr: "10.0.0.8:80", ClientAddr: "203.0.113.7:5555", ProxyProtocol: PROXY_PROTOCOL_V1}
+	if _, merr := mesh_dial(syn); merr == nil || merr.Code != ERR_CODE_PROTOCOL {
+		t.Fatalf("应该回复protocol错误: %v", merr)
+	}
+	select {
+	case <-opened:
+		t.Fatal("不支持PROXY协议头的下一跳不应该收到数据通道")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 不要求PROXY协议头时照常连接
+	syn.ProxyProtocol = ""
+	stream, merr := mesh_dial(syn)
+	if merr != nil {
+		t.Fatalf("应该建立数据通道: %v", merr)
+	}
+	stream.Close()
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -17,18 +19,41 @@ func quic_local_main() {
 		return
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", fm.config.Quic.ListenPort)
-	fmt.Printf("🚀 启动本地QUIC监听器: %s\n", addr)
+	// 每个绑定地址一个UDP socket
+	var listeners []*quic.Listener
+	for _, bind := range fm.config.Quic.Bind.or(BIND_DEFAULT) {
+		network, addr := bind_network(PROTO_UDP, bind, fm.config.Quic.ListenPort)
+		fmt.Printf("🚀 启动本地QUIC监听器: %s (%s)\n", addr, network)
 
-	listener, err := quic.ListenAddr(addr, GetServerTLSConfig(), GetQuicServerConfig())
-	if err != nil {
-		fmt.Printf("⚠️  启动QUIC监听器失败: %v\n", err)
-		os.Exit(1)
-		return
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			fmt.Printf("⚠️  启动QUIC监听器失败: %v\n", err)
+			os.Exit(1)
+			return
+		}
+		listener, err := quic.Listen(conn, GetServerTLSConfig(), GetQuicServerConfig())
+		if err != nil {
+			fmt.Printf("⚠️  启动QUIC监听器失败: %v\n", err)
+			os.Exit(1)
+			return
+		}
+		listeners = append(listeners, listener)
 	}
 
 	fmt.Printf("✅ QUIC监听器启动成功，等待连接...\n")
 
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *quic.Listener) {
+			defer wg.Done()
+			quic_local_serve(listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+func quic_local_serve(listener *quic.Listener) {
 	for {
 		conn, err := listener.Accept(context.Background())
 		if err != nil {
@@ -73,15 +98,15 @@ func handleQuicConnection(conn quic.Connection) {
 }
 
 func handleQuicStream(conn quic.Connection, stream quic.Stream) {
-	msgsyn := QuicMessageFromStream(stream)
-	fmt.Printf("收到消息: %v\n", msgsyn)
-	if msgsyn == nil {
-		fmt.Printf("⚠️  收到空握手消息\n")
+	msgsyn, err := QuicMessageFromStream(stream)
+	if err != nil {
+		fmt.Printf("⚠️  读取握手消息失败: %v\n", err)
 		stream.Close()
 		conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "empty syn message")
 		delete_quic_client(conn)
 		return
 	}
+	fmt.Printf("收到消息: %v\n", msgsyn)
 	if msgsyn.Type != MSG_TYPE_SYN_MSG && msgsyn.Type != MSG_TYPE_SYN_DATA {
 		fmt.Printf("⚠️  收到非握手消息: %v\n", msgsyn)
 		stream.Close()
@@ -104,20 +129,59 @@ func handleQuicStream_msg(msgsyn *QuicMessage, conn quic.Connection, stream quic
 
 	fmt.Printf("🤝 建立消息通道: %s\n", remote_node_id)
 
-	// 如果id+conn 发生了改变，删除原有conn
-	delete_quic_client_when_conn_change(remote_node_id, conn)
+	// 消息通道会被多个goroutine并发写
+	stream = new_locked_stream(stream)
+
+	// 不允许自己连自己
+	if remote_node_id == fm.config.NodeID {
+		reject_syn_msg(stream, remote_node_id, "node id conflict")
+		return
+	}
+
+	// 证书中的节点ID必须与握手声称的一致
+	if err := check_peer_identity(conn, remote_node_id); err != nil {
+		reject_syn_msg(stream, remote_node_id, fmt.Sprintf("identity mismatch: %v", err))
+		return
+	}
+
+	// 配置了组网密钥时，不知道密钥的节点不能接入
+	if err := check_mesh_auth(conn, fm.config.Quic.Secret, AUTH_ROLE_SYN, remote_node_id, synmsg.Auth); err != nil {
+		auth_failed("syn_msg", conn, remote_node_id, err)
+		reject_syn_msg(stream, remote_node_id, fmt.Sprintf("authentication failed: %v", err))
+		return
+	}
+
+	// 提供了节点公钥时验证签名，证明对端拥有该节点ID
+	if err := check_node_key(conn, IDENTITY_ROLE_SYN, remote_node_id, synmsg.PublicKey, synmsg.Signature); err != nil {
+		reject_syn_msg(stream, remote_node_id, fmt.Sprintf("node key verification failed: %v", err))
+		return
+	}
+
+	// 协商协议版本和能力
+	version, caps, err := negotiate_protocol(synmsg.Version, synmsg.MinVersion, synmsg.Capabilities)
+	if err != nil {
+		reject_syn_msg(stream, remote_node_id, fmt.Sprintf("unsupported protocol version: %v", err))
+		return
+	}
+	fmt.Printf("🤝 协商协议: %s 版本%d, 能力%#x, 编码%s\n", remote_node_id, version, caps, select_codec(caps).name())
 
 	// 回复ack
+	pub, sig := sign_node_key(conn, IDENTITY_ROLE_SYN_ACK)
 	msgsynack := NewQuicMessage(MSG_TYPE_SYN_ACK_MSG, remote_node_id, SynAckMsgMessage{
-		Result:  true,
-		Reason:  "",
-		Version: synmsg.Version,
-		IsUp:    fm.config.IsQuicEnabled(),
+		Result:       true,
+		Reason:       "",
+		Version:      version,
+		MinVersion:   MIN_VERSION,
+		Capabilities: local_capabilities(),
+		IsUp:         fm.config.IsQuicEnabled(),
+		PublicKey:    pub,
+		Signature:    sig,
+		Auth:         mesh_auth(conn, fm.config.Quic.Secret, AUTH_ROLE_SYN_ACK, fm.config.NodeID),
 	})
 	stream.Write(msgsynack.ToBuffer())
 
-	// 保存新stream信息
-	save_quic_stream(remote_node_id, conn, stream, synmsg.IsUp, synmsg.Version)
+	// 保存新stream信息（如果id+conn 发生了改变，会替换原有conn）
+	client := save_quic_stream(remote_node_id, conn, stream, synmsg.IsUp, version, caps)
 
 	defer func() {
 		// msg通道关闭  等价于 conn关闭
@@ -129,62 +193,171 @@ func handleQuicStream_msg(msgsyn *QuicMessage, conn quic.Connection, stream quic
 
 	// 处理消息
 	for {
-		msg := QuicMessageFromStream(stream)
-		if msg == nil {
-			fmt.Printf("⚠️  消息通道收到空消息\n")
+		msg, err := QuicMessageFromStream(stream)
+		if err != nil {
+			fmt.Printf("⚠️  消息通道读取失败 [%s]: %v\n", remote_node_id, err)
 			return
 		}
 		switch msg.Type {
 		case MSG_TYPE_PING:
 			// 创建一个pong消息
 			msgpong := NewQuicMessage(MSG_TYPE_PONG, remote_node_id, PongMessage{})
-			stream.Write(msgpong.ToBuffer())
+			client.send_msg(msgpong)
 		case MSG_TYPE_PONG:
 			fmt.Printf("🔔 收到来自%s的pong消息\n", remote_node_id)
 		case MSG_TYPE_FIND_NODE:
-			go handleQuicStream_find_node(msg, conn, stream)
+			go handleQuicStream_find_node(msg, client)
 		case MSG_TYPE_FIND_NODE_ACK:
-			go handleQuicStream_find_node_ack(msg, conn, stream)
+			go handleQuicStream_find_node_ack(msg)
+		case MSG_TYPE_ROUTE_UPDATE:
+			handle_route_update(msg, remote_node_id)
+		case MSG_TYPE_NODE_INFO:
+			handle_node_info(msg, remote_node_id)
 		default:
 			fmt.Printf("⚠️  消息通道收到未知消息: %v\n", msg)
 		}
 	}
 }
 
+// 检查数据通道所在的连接已经注册为prev_hop
+// 消息通道回复ack之后才注册节点，对端紧接着打开的数据通道可能先到，稍等一下
+func check_data_peer(conn quic.Connection, prev_hop string) error {
+	deadline := time.Now().Add(DATA_PEER_WAIT)
+	client := fm.peers.get_by_conn(conn)
+	for client == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		client = fm.peers.get_by_conn(conn)
+	}
+	if client == nil {
+		return errors.New("连接没有完成消息通道握手")
+	}
+	if client.node_id != prev_hop {
+		return fmt.Errorf("连接注册的节点为%s, 数据通道声称来自%s", client.node_id, prev_hop)
+	}
+	return nil
+}
+
+// 拒绝消息通道握手
+func reject_syn_msg(stream quic.Stream, remote_node_id string, reason string) {
+	fmt.Printf("⚠️  拒绝消息通道 [%s]: %s\n", remote_node_id, reason)
+	msgsynack := NewQuicMessage(MSG_TYPE_SYN_ACK_MSG, remote_node_id, SynAckMsgMessage{
+		Result:       false,
+		Reason:       reason,
+		Version:      VERSION,
+		MinVersion:   MIN_VERSION,
+		Capabilities: local_capabilities(),
+	})
+	stream.Write(msgsynack.ToBuffer())
+	stream.Close()
+}
+
 func handleQuicStream_data(msgsyn *QuicMessage, conn quic.Connection, stream quic.Stream) {
 	synmsg := msgsyn.Data.(*SynDataMessage)
 	target_id := synmsg.TargetID
 	remote_node_id := synmsg.NodeID
 	target_tcp_addr := synmsg.TargetTcpAddr
+	// 数据通道上的回复发给上一跳，多跳时上一跳不一定是发起方
+	prev_hop := msgsyn.FromID
+
+	fmt.Printf("📊 数据通道请求: %s -> %s (%s), 路径: %v\n", remote_node_id, target_id, target_tcp_addr, synmsg.Path)
+
+	// 上一跳必须是证书标识的节点
+	if err := check_peer_identity(conn, prev_hop); err != nil {
+		fmt.Printf("⚠️  拒绝数据通道 [%s]: %v\n", prev_hop, err)
+		stream.Close()
+		return
+	}
 
-	fmt.Printf("📊 数据通道请求: %s -> %s (%s)\n", remote_node_id, target_id, target_tcp_addr)
+	// 数据通道只能开在已经完成消息通道握手（组网密钥、节点密钥）的连接上，上一跳必须是该连接注册的节点
+	if err := check_data_peer(conn, prev_hop); err != nil {
+		auth_failed("syn_data", conn, prev_hop, err)
+		send_error(stream, prev_hop, new_error_message(ERR_CODE_REFUSED_BY_ACL, err.Error()))
+		stream.Close()
+		return
+	}
+
+	// 策略按来源节点判断，来源必须和上一跳、路径一致
+	src, merr := data_source(synmsg, prev_hop)
+	if merr != nil {
+		fmt.Printf("⚠️  拒绝数据通道 [%s]: %s\n", prev_hop, merr.Detail)
+		send_error(stream, prev_hop, merr)
+		stream.Close()
+		return
+	}
 
 	// 应该先去看看targetid是不是自己，或者能不能在client列表中找到
 	if target_id == fm.config.NodeID {
 		fmt.Printf("🎯 数据通道：目标节点是自己: %s\n", target_id)
-		handleQuicStream_data_target_self(remote_node_id, stream, target_tcp_addr)
+		handleQuicStream_data_target_self(prev_hop, src, stream, synmsg)
 		return
 	}
 	// 转发
-	handleQuicStream_data_target_other(remote_node_id, stream, target_id, target_tcp_addr)
+	handleQuicStream_data_target_other(prev_hop, src, stream, synmsg)
 }
 
-func handleQuicStream_data_target_self(remote_node_id string, stream quic.Stream, tcptarget string) {
+func handleQuicStream_data_target_self(prev_hop string, src string, stream quic.Stream, synmsg *SynDataMessage) {
 	defer stream.Close()
+	tcptarget := synmsg.TargetTcpAddr
+
+	var dial_addr string
+	var merr *ErrorMessage
+	if synmsg.Service != "" {
+		// 按服务名连接：地址由本节点的配置决定，只检查服务的allow列表
+		tcptarget = synmsg.Service
+		dial_addr, merr = resolve_service(src, synmsg.Service)
+	} else {
+		// 检查来源节点能否连接目标地址
+		dial_addr, merr = fm.config.policy.authorize_target(src, tcptarget)
+	}
+	if merr != nil {
+		send_error(stream, prev_hop, merr)
+		return
+	}
 
-	fmt.Printf("🔗 连接本地TCP目标: %s\n", tcptarget)
-	tcpconn, err := net.Dial("tcp", tcptarget)
+	network := PROTO_TCP
+	if synmsg.Protocol == PROTO_UDP {
+		network = PROTO_UDP
+	} else if synmsg.Protocol != "" {
+		send_error(stream, prev_hop, new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("不支持的传输协议: %s", synmsg.Protocol)))
+		return
+	}
+	if !valid_proxy_protocol(synmsg.ProxyProtocol) {
+		send_error(stream, prev_hop, new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("不支持的PROXY协议版本: %s", synmsg.ProxyProtocol)))
+		return
+	}
+
+	fmt.Printf("🔗 连接本地%s目标: %s (客户端 %s@%s)\n", network, tcptarget, synmsg.ClientAddr, src)
+	if _, ok := unix_path(dial_addr); ok && network != PROTO_TCP {
+		send_error(stream, prev_hop, new_error_message(ERR_CODE_PROTOCOL, fmt.Sprintf("unix socket不支持%s: %s", network, tcptarget)))
+		return
+	}
+	tcpconn, err := dial_address(network, dial_addr, TARGET_DIAL_TIMEOUT)
 	if err != nil {
 		fmt.Printf("⚠️  连接目标地址失败: %v\n", err)
+		send_error(stream, prev_hop, new_error_message(ERR_CODE_TARGET_UNREACHABLE, fmt.Sprintf("连接%s失败: %v", tcptarget, err)))
 		return
 	}
 	defer tcpconn.Close()
 
+	// 按服务或发起方的要求告诉后端真实的客户端地址，UDP不支持
+	if network == PROTO_TCP {
+		if err := write_proxy_header(tcpconn, target_proxy_protocol(synmsg.Service, synmsg.ProxyProtocol), synmsg.ClientAddr); err != nil {
+			send_error(stream, prev_hop, new_error_message(ERR_CODE_TARGET_UNREACHABLE, fmt.Sprintf("发送PROXY协议头失败: %v", err)))
+			return
+		}
+	}
+
 	// 回复ack
-	msgsynack := NewQuicMessage(MSG_TYPE_SYN_ACK_DATA, remote_node_id, SynAckMsgMessage{})
+	msgsynack := NewQuicMessage(MSG_TYPE_SYN_ACK_DATA, prev_hop, SynAckDataMessage{})
 	stream.Write(msgsynack.ToBuffer())
 
-	fmt.Printf("✅ 开始数据转发: %s <-> %s\n", remote_node_id, tcptarget)
+	fmt.Printf("✅ 开始数据转发: %s <-> %s\n", prev_hop, tcptarget)
+
+	if network == PROTO_UDP {
+		udp_target_forward(stream, tcpconn)
+		fmt.Printf("🔌 UDP转发结束: %s <-> %s\n", prev_hop, tcptarget)
+		return
+	}
 
 	ch := make(chan struct{}, 1)
 	go func() {
@@ -197,59 +370,46 @@ func handleQuicStream_data_target_self(remote_node_id string, stream quic.Stream
 	}()
 	<-ch
 
-	fmt.Printf("🔌 数据转发结束: %s <-> %s\n", remote_node_id, tcptarget)
+	fmt.Printf("🔌 数据转发结束: %s <-> %s\n", prev_hop, tcptarget)
 }
 
-func handleQuicStream_data_target_other(src_node_id string, srcstream quic.Stream, target_id string, target_tcp_addr string) {
+func handleQuicStream_data_target_other(prev_hop string, src_node_id string, srcstream quic.Stream, synmsg *SynDataMessage) {
 	defer srcstream.Close()
+	target_id := synmsg.TargetID
+	target_tcp_addr := synmsg.TargetTcpAddr
 
-	// 优先查找我有木有目标节点信息，决定我是否可以帮源请求转发
-	dstclient, ok := fm.quic_client[target_id]
-	if !ok { // 如果我自己没有，那么看看有没有其他isup的节点
-		fmt.Printf("⚠️  数据通道：目标节点不存在: %s\n", target_id)
-
-		// 如果自己没有，那么查看有没有isup=true的节点，决定我是否可以帮源请求转发
-		for cid, client := range fm.quic_client {
-			// 是上级节点 & 不是请求来源节点
-			if client.is_up && cid != src_node_id {
-				dstclient = client
-				break
-			}
-		}
-		if dstclient == nil {
-			fmt.Printf("⚠️  数据通道：没有找到可以帮源请求转发的节点: %s\n", target_id)
-			return
-		}
-	}
-
-	// 先和client握手 数据通道，如果通了，再答复stream ack
-
-	// 创建steram
-	if dstclient == nil || dstclient.conn == nil {
-		fmt.Printf("⚠️  数据通道：目标节点连接不存在: %s\n", target_id)
+	// 检查跳数和环路
+	hop_limit, path, merr := check_relay_hops(synmsg.HopLimit, synmsg.Path)
+	if merr != nil {
+		fmt.Printf("⚠️  数据通道：拒绝中继 %s -> %s: %v\n", src_node_id, target_id, merr)
+		send_error(srcstream, prev_hop, merr)
 		return
 	}
 
-	// 创建dststream
-	dststream, err := dstclient.conn.OpenStreamSync(context.Background())
-	if err != nil {
-		fmt.Printf("⚠️  创建数据通道失败: %v\n", err)
+	// 检查来源节点能否经过本节点转发
+	if merr := fm.config.policy.authorize_transit(src_node_id, target_id); merr != nil {
+		send_error(srcstream, prev_hop, merr)
 		return
 	}
-	defer dststream.Close()
 
-	// 发送syn消息
-	ok = send_syn_data(target_id, dststream, target_id, target_tcp_addr)
-	if !ok {
-		fmt.Printf("⚠️  数据通道：发送syn消息失败: %s\n", target_id)
+	// 按路由表转发，不会再绕回已经经过的节点
+	relay := *synmsg
+	relay.HopLimit = hop_limit
+	relay.Path = path
+	dststream, next_hop, merr := open_data_channel(relay, prev_hop)
+	if merr != nil {
+		fmt.Printf("⚠️  数据通道：中继失败: %v\n", merr)
+		// 下游返回的错误原样传回上一跳
+		send_error(srcstream, prev_hop, merr)
 		return
 	}
+	defer dststream.Close()
 
 	// dst数据通道通了，向src回复ack
-	msgsynack_src := NewQuicMessage(MSG_TYPE_SYN_ACK_DATA, src_node_id, SynAckMsgMessage{})
+	msgsynack_src := NewQuicMessage(MSG_TYPE_SYN_ACK_DATA, prev_hop, SynAckDataMessage{})
 	srcstream.Write(msgsynack_src.ToBuffer())
 
-	fmt.Printf("✅ 开始中继数据转发: %s -> %s -> %s\n", src_node_id, target_id, target_tcp_addr)
+	fmt.Printf("✅ 开始中继数据转发: %s -> %s -> %s (下一跳 %s)\n", src_node_id, target_id, target_tcp_addr, next_hop)
 
 	// 进行数据拷贝
 	ch := make(chan struct{}, 1)
@@ -266,75 +426,88 @@ func handleQuicStream_data_target_other(src_node_id string, srcstream quic.Strea
 	fmt.Printf("🔌 中继数据转发结束: %s -> %s -> %s\n", src_node_id, target_id, target_tcp_addr)
 }
 
-func handleQuicStream_find_node(msg *QuicMessage, conn quic.Connection, stream quic.Stream) {
+func handleQuicStream_find_node(msg *QuicMessage, client *quic_client) {
 	findNodeMsg := msg.Data.(*FindNodeMessage)
-
-	// 先看看自己有没有目标节点
-	_, ok := fm.quic_client[findNodeMsg.TargetID]
-	if ok {
-		// 回复存在
+	reply := func(is_exist bool, merr *ErrorMessage) {
 		findNodeAckMsg := NewQuicMessage(MSG_TYPE_FIND_NODE_ACK, msg.FromID, FindNodeAckMessage{
-			NodeID:   findNodeMsg.NodeID,
-			TargetID: findNodeMsg.TargetID,
-			IsExist:  true,
+			RequestID: findNodeMsg.RequestID,
+			NodeID:    findNodeMsg.NodeID,
+			TargetID:  findNodeMsg.TargetID,
+			IsExist:   is_exist,
+			Error:     merr,
+			HopLimit:  HOP_LIMIT,
+			Path:      []string{fm.config.NodeID},
 		})
-		stream.Write(findNodeAckMsg.ToBuffer())
+		client.send_msg(findNodeAckMsg)
+	}
+
+	// 先看看目标是不是自己或者自己的直连节点
+	if findNodeMsg.TargetID == fm.config.NodeID || fm.peers.get(findNodeMsg.TargetID) != nil {
+		// 回复存在
+		reply(true, nil)
 		return
 	}
 
-	// 看看有没有其他isup的节点
-	upstream, upid := getupnodestream(msg.FromID, "")
-	if upstream != nil {
-		findNodeMsgxx := NewQuicMessage(MSG_TYPE_FIND_NODE, upid, FindNodeMessage{
-			NodeID:   findNodeMsg.NodeID,
-			TargetID: findNodeMsg.TargetID,
-		})
-		upstream.Write(findNodeMsgxx.ToBuffer())
+	// 检查跳数和环路
+	hop_limit, path, merr := check_relay_hops(findNodeMsg.HopLimit, findNodeMsg.Path)
+	if merr != nil {
+		fmt.Printf("⚠️  拒绝转发查找节点请求 %s -> %s: %v\n", findNodeMsg.NodeID, findNodeMsg.TargetID, merr)
+		reply(false, merr)
 		return
 	}
 
+	// 按路由表或上级节点继续查找，不会再发回给已经经过的节点
+	next := find_node_next_hop(findNodeMsg.TargetID, msg.FromID, path...)
+	if next != nil {
+		findNodeMsgxx := NewQuicMessage(MSG_TYPE_FIND_NODE, next.node_id, FindNodeMessage{
+			RequestID: findNodeMsg.RequestID,
+			NodeID:    findNodeMsg.NodeID,
+			TargetID:  findNodeMsg.TargetID,
+			HopLimit:  hop_limit,
+			Path:      path,
+		})
+		if next.send_msg(findNodeMsgxx) == nil {
+			return
+		}
+	}
+
 	// 回复不存在
-	findNodeAckMsg := NewQuicMessage(MSG_TYPE_FIND_NODE_ACK, msg.FromID, FindNodeAckMessage{
-		NodeID:   findNodeMsg.NodeID,
-		TargetID: findNodeMsg.TargetID,
-		IsExist:  false,
-	})
-	stream.Write(findNodeAckMsg.ToBuffer())
+	reply(false, nil)
 }
 
-func handleQuicStream_find_node_ack(msg *QuicMessage, conn quic.Connection, stream quic.Stream) {
+func handleQuicStream_find_node_ack(msg *QuicMessage) {
 	findNodeAckMsg := msg.Data.(*FindNodeAckMessage)
-	fmt.Printf("🔍 收到来自%s的find node ack消息: %v\n", findNodeAckMsg.NodeID, findNodeAckMsg)
+	fmt.Printf("🔍 收到来自%s的find node ack消息: %v\n", msg.FromID, findNodeAckMsg)
+
+	// 自己发起的查找
 	if findNodeAckMsg.NodeID == fm.config.NodeID {
-		fmt.Println("find node ack message from myself,how can this happen?")
+		if !fm.finds.deliver(findNodeAckMsg) {
+			fmt.Printf("⚠️  查找节点请求已结束: %s\n", findNodeAckMsg.RequestID)
+		}
 		return
 	}
 
-	// 先看看自己有没有目标节点
-	client, ok := fm.quic_client[findNodeAckMsg.NodeID]
-	if ok {
-		// 回复
-		findNodeAckMsg := NewQuicMessage(MSG_TYPE_FIND_NODE_ACK, findNodeAckMsg.NodeID, FindNodeAckMessage{
-			NodeID:   findNodeAckMsg.NodeID,
-			TargetID: findNodeAckMsg.TargetID,
-			IsExist:  findNodeAckMsg.IsExist,
-		})
-		if len(client.streaminfo) > 0 && client.streaminfo[0].stream != nil {
-			client.streaminfo[0].stream.Write(findNodeAckMsg.ToBuffer())
-			return
-		}
+	// 检查跳数和环路，超过限制的回复直接丢弃
+	hop_limit, path, merr := check_relay_hops(findNodeAckMsg.HopLimit, findNodeAckMsg.Path)
+	if merr != nil {
+		fmt.Printf("⚠️  丢弃查找节点回复 %s: %v\n", findNodeAckMsg.RequestID, merr)
 		return
 	}
 
-	// 看看有没有其他isup的节点
-	upstream, upid := getupnodestream(msg.FromID, "")
-	if upstream != nil {
-		findNodeAckMsgxx := NewQuicMessage(MSG_TYPE_FIND_NODE_ACK, upid, FindNodeAckMessage{
-			NodeID:   findNodeAckMsg.NodeID,
-			TargetID: findNodeAckMsg.TargetID,
-			IsExist:  findNodeAckMsg.IsExist,
-		})
-		upstream.Write(findNodeAckMsgxx.ToBuffer())
+	// 沿路由转发回查找发起方，没有路由时丢弃
+	next := find_node_route(findNodeAckMsg.NodeID, msg.FromID, path...)
+	if next == nil {
+		fmt.Printf("⚠️  找不到查找发起方: %s\n", findNodeAckMsg.NodeID)
 		return
 	}
+	findNodeAckMsgxx := NewQuicMessage(MSG_TYPE_FIND_NODE_ACK, next.node_id, FindNodeAckMessage{
+		RequestID: findNodeAckMsg.RequestID,
+		NodeID:    findNodeAckMsg.NodeID,
+		TargetID:  findNodeAckMsg.TargetID,
+		IsExist:   findNodeAckMsg.IsExist,
+		Error:     findNodeAckMsg.Error,
+		HopLimit:  hop_limit,
+		Path:      path,
+	})
+	next.send_msg(findNodeAckMsgxx)
 }
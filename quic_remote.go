@@ -30,9 +30,15 @@ func quic_connect_upstream_do(remote_node_id string, address string) {
 		fmt.Printf("连接上级节点失败: %v\n", err)
 		return
 	}
-	defer delete_quic_client_by_id(remote_node_id)
+	defer delete_quic_client(conn)
 	defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "连接关闭")
 
+	// 上级节点证书中的节点ID必须与配置的一致
+	if err := check_peer_identity(conn, remote_node_id); err != nil {
+		fmt.Printf("⚠️  上级节点身份校验失败 [%s]: %v\n", address, err)
+		return
+	}
+
 	fmt.Printf("✅ 成功连接到上级节点: %s\n", address)
 
 	// 建立消息通道
@@ -41,37 +47,63 @@ func quic_connect_upstream_do(remote_node_id string, address string) {
 		fmt.Printf("打开stream失败: %v\n", err)
 		return
 	}
-	quic_send_syn_msg(stream, remote_node_id)
+	// 消息通道会被多个goroutine并发写
+	stream = new_locked_stream(stream)
+	quic_send_syn_msg(conn, stream, remote_node_id)
 
 	synack := get_syn_ack(stream, MSG_TYPE_SYN_ACK_MSG)
-	if synack == nil || !synack.Result {
-		fmt.Printf("⚠️  消息通道: 没有收到synack, 原因: %s\n", synack.Reason)
+	if synack == nil {
+		fmt.Printf("⚠️  消息通道: 没有收到synack\n")
+		return
+	}
+
+	// 上级节点也要证明它知道组网密钥
+	if err := check_mesh_auth(conn, fm.config.Quic.GetUpstreamSecret(remote_node_id), AUTH_ROLE_SYN_ACK, remote_node_id, synack.Auth); err != nil {
+		auth_failed("syn_ack_msg", conn, remote_node_id, err)
+		return
+	}
+
+	// 上级节点提供了公钥时验证它拥有配置的节点ID
+	if err := check_node_key(conn, IDENTITY_ROLE_SYN_ACK, remote_node_id, synack.PublicKey, synack.Signature); err != nil {
+		fmt.Printf("⚠️  消息通道: 上级节点密钥身份验证失败 [%s]: %v\n", remote_node_id, err)
 		return
 	}
 
-	save_quic_stream(remote_node_id, conn, stream, synack.IsUp, synack.Version)
+	// 老版本节点会原样回显我们的版本号且不带能力标志，按能力降级
+	version, caps, err := negotiate_protocol(synack.Version, synack.MinVersion, synack.Capabilities)
+	if err != nil {
+		fmt.Printf("⚠️  消息通道: 协议版本不兼容: %v\n", err)
+		return
+	}
+	fmt.Printf("🤝 协商协议: %s 版本%d, 能力%#x, 编码%s\n", remote_node_id, version, caps, select_codec(caps).name())
+
+	client := save_quic_stream(remote_node_id, conn, stream, synack.IsUp, version, caps)
 
 	// 处理数据通道
 	go handleQuicConnection_remote(conn)
 
 	//处理msg
 	for {
-		msg := QuicMessageFromStream(stream)
-		if msg == nil {
-			fmt.Printf("⚠️  消息通道收到空消息\n")
+		msg, err := QuicMessageFromStream(stream)
+		if err != nil {
+			fmt.Printf("⚠️  消息通道读取失败 [%s]: %v\n", remote_node_id, err)
 			return
 		}
 		switch msg.Type {
 		case MSG_TYPE_PING:
 			// 创建一个pong消息
 			msgpong := NewQuicMessage(MSG_TYPE_PONG, remote_node_id, PongMessage{})
-			stream.Write(msgpong.ToBuffer())
+			client.send_msg(msgpong)
 		case MSG_TYPE_PONG:
 			fmt.Printf("🔔 收到来自%s的pong消息\n", remote_node_id)
 		case MSG_TYPE_FIND_NODE:
-			go handleQuicStream_find_node(msg, conn, stream)
+			go handleQuicStream_find_node(msg, client)
 		case MSG_TYPE_FIND_NODE_ACK:
-			go handleQuicStream_find_node_ack(msg, conn, stream)
+			go handleQuicStream_find_node_ack(msg)
+		case MSG_TYPE_ROUTE_UPDATE:
+			handle_route_update(msg, remote_node_id)
+		case MSG_TYPE_NODE_INFO:
+			handle_node_info(msg, remote_node_id)
 		default:
 			fmt.Printf("⚠️  消息通道收到未知消息: %v\n", msg)
 		}
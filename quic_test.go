@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,30 +31,45 @@ var testConfig = &Config{
 			TargetAddress: "127.0.0.1:80",
 		},
 	},
+	Services: []ServiceConfig{
+		{Name: "api", Address: "127.0.0.1:3341"},
+		{Name: "db", Address: "127.0.0.1:3342", Allow: []string{"app-*"}},
+	},
 }
 
-func TestQuicLocalConnection(t *testing.T) {
-	fmt.Println("=== QUIC本地连接测试 ===")
+var testNodeOnce sync.Once
 
-	// 初始化ffmesh
-	fm = new_ffmesh()
-	fm.config = testConfig
+// 初始化ffmesh并启动本地QUIC监听器，所有测试共用一个节点
+func setup_test_node() {
+	testNodeOnce.Do(func() {
+		// 初始化ffmesh
+		fm = new_ffmesh()
+		fm.config = testConfig
+		fm.start()
 
-	// 启动本地QUIC监听器
-	go func() {
-		fmt.Println("启动本地QUIC监听器...")
-		quic_local_main()
-	}()
+		// 启动本地QUIC监听器
+		go func() {
+			fmt.Println("启动本地QUIC监听器...")
+			quic_local_main()
+		}()
 
-	// 等待监听器启动
-	time.Sleep(2 * time.Second)
+		// 等待监听器启动
+		time.Sleep(2 * time.Second)
+	})
+}
 
-	// 测试连接本地节点
+func TestQuicLocalConnection(t *testing.T) {
+	fmt.Println("=== QUIC本地连接测试 ===")
+
+	setup_test_node()
+
+	// 测试连接本地节点，自己连自己应该被拒绝并返回
 	fmt.Println("测试连接本地节点...")
 	quic_connect_upstream_do("test-server-001", "127.0.0.1:3333")
 
-	// 等待一段时间观察结果
-	time.Sleep(5 * time.Second)
+	if fm.peers.get("test-server-001") != nil {
+		t.Error("自己连自己不应该被注册")
+	}
 }
 
 func TestQuicDirectConnection(t *testing.T) {
@@ -126,6 +142,8 @@ func TestQuicConfig(t *testing.T) {
 func TestQuicMessageProtocol(t *testing.T) {
 	fmt.Println("=== QUIC消息协议测试 ===")
 
+	setup_test_node()
+
 	// 测试消息创建
 	synMsg := NewQuicMessage(MSG_TYPE_SYN_MSG, "test-node", SynMsgMessage{
 		NodeID: "test-node",
@@ -150,3 +168,61 @@ func TestQuicMessageProtocol(t *testing.T) {
 
 	fmt.Println("✅ QUIC消息协议测试完成")
 }
+
+func TestProtocolNegotiation(t *testing.T) {
+	cases := []struct {
+		version, min_version int
+		caps                 uint32
+		want_version         int
+		want_caps            uint32
+		ok                   bool
+	}{
+		{VERSION, MIN_VERSION, CAPABILITIES, VERSION, CAPABILITIES, true},
+		{1, 0, 0, 1, 0, true}, // 老版本节点
+		{VERSION + 5, 1, 0xffff, VERSION, CAPABILITIES, true}, // 更新的节点向下兼容
+		{VERSION + 5, VERSION + 1, 0, 0, 0, false},            // 更新的节点不再兼容本版本
+		{0, 0, 0, 0, 0, false},
+	}
+	for _, c := range cases {
+		version, caps, err := negotiate_protocol(c.version, c.min_version, c.caps)
+		if (err == nil) != c.ok || version != c.want_version || caps != c.want_caps {
+			t.Errorf("协商结果不正确 %+v: 版本%d 能力%#x 错误%v", c, version, caps, err)
+		}
+	}
+
+	// 老版本节点不支持路由通告和错误回复
+	if msg_type_supported(MSG_TYPE_ROUTE_UPDATE, 1, 0) || msg_type_supported(MSG_TYPE_ERROR, 1, 0) {
+		t.Error("版本1不应该支持ROUTE_UPDATE/ERROR")
+	}
+	if !msg_type_supported(MSG_TYPE_FIND_NODE, 1, 0) {
+		t.Error("版本1应该支持FIND_NODE")
+	}
+}
+
+func TestProtocolHandshakeVersions(t *testing.T) {
+	setup_test_node()
+
+	// 老版本节点：只带version=1，注册后按版本1降级
+	old, ack := dial_test_peer_syn(t, SynMsgMessage{Version: 1, NodeID: "old-node-1"})
+	defer old.close()
+	if ack == nil || ack.Type != MSG_TYPE_SYN_ACK_MSG || !ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Fatalf("老版本节点握手失败: %v", ack)
+	}
+	if !wait_for(t, 5*time.Second, func() bool { return fm.peers.get("old-node-1") != nil }) {
+		t.Fatal("老版本节点没有注册")
+	}
+	client := fm.peers.get("old-node-1")
+	if client.version != 1 || client.supports(MSG_TYPE_ROUTE_UPDATE) {
+		t.Errorf("老版本节点协商结果不正确: 版本%d 能力%#x", client.version, client.caps)
+	}
+
+	// 要求更高版本的节点被拒绝
+	future, ack := dial_test_peer_syn(t, SynMsgMessage{Version: VERSION + 1, MinVersion: VERSION + 1, NodeID: "future-node"})
+	defer future.close()
+	if ack == nil || ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Fatalf("不兼容版本的节点应该被拒绝: %v", ack)
+	}
+	if fm.peers.get("future-node") != nil {
+		t.Error("不兼容版本的节点不应该被注册")
+	}
+}
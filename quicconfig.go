@@ -6,8 +6,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,18 +23,17 @@ var (
 	tlsConfig     *tls.Config
 )
 
-// 生成自签名TLS证书
-func generateTLSConfig() *tls.Config {
-	// 生成RSA私钥
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// 证书模板，自签名证书和组网CA签发的证书共用
+func new_cert_template(common_name string, valid time.Duration) *x509.Certificate {
+	// 随机序列号，吊销列表按序列号识别证书
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
 		panic(err)
 	}
-
-	// 创建证书模板
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+	return &x509.Certificate{
+		SerialNumber: serial,
 		Subject: pkix.Name{
+			CommonName:    common_name,
 			Organization:  []string{"FFMesh"},
 			Country:       []string{"CN"},
 			Province:      []string{""},
@@ -39,21 +41,33 @@ func generateTLSConfig() *tls.Config {
 			StreetAddress: []string{""},
 			PostalCode:    []string{""},
 		},
-		NotBefore:   time.Now().Add(-24 * time.Hour),            // 当前时间减去1天，避免时间差异
-		NotAfter:    time.Now().Add(100 * 365 * 24 * time.Hour), // 100年有效期
-		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses: []net.IP{
-			net.IPv4(127, 0, 0, 1),
-			net.IPv4(0, 0, 0, 0),
-			net.IPv6loopback,
-			net.IPv6unspecified,
-		},
-		DNSNames: []string{"localhost", "*"},
+		NotBefore: time.Now().Add(-24 * time.Hour), // 当前时间减去1天，避免时间差异
+		NotAfter:  time.Now().Add(valid),
+	}
+}
+
+// 生成自签名TLS证书
+func generateTLSConfig() *tls.Config {
+	// 生成RSA私钥
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
 	}
 
+	// 创建证书模板
+	template := new_cert_template("", 100*365*24*time.Hour) // 100年有效期
+	template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.IPAddresses = []net.IP{
+		net.IPv4(127, 0, 0, 1),
+		net.IPv4(0, 0, 0, 0),
+		net.IPv6loopback,
+		net.IPv6unspecified,
+	}
+	template.DNSNames = []string{"localhost", "*"}
+
 	// 创建证书
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
 		panic(err)
 	}
@@ -122,8 +136,145 @@ func GetQuicClientConfig() *quic.Config {
 	}
 }
 
-// 获取客户端TLS配置（跳过证书验证）
+// 证书中携带节点ID的URI SAN前缀，例如 spiffe://ffmesh/node/88b2c4d4e5
+const SPIFFE_NODE_PREFIX = "spiffe://ffmesh/node/"
+
+// 组网证书：本节点证书 + 信任的CA
+type mesh_tls struct {
+	cert tls.Certificate
+	ca   *x509.CertPool
+	crl  *crl_file // 吊销列表，nil表示未配置
+}
+
+// 加载配置的证书，未配置时返回nil（使用自签名证书且不校验对端）
+func load_mesh_tls(c TLSConfig) (*mesh_tls, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("加载节点证书失败: %w", err)
+	}
+	ca_certs, err := read_pem_certs(c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("读取CA证书失败: %w", err)
+	}
+	ca := x509.NewCertPool()
+	for _, cert := range ca_certs {
+		ca.AddCert(cert)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("解析节点证书失败: %w", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: ca, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, fmt.Errorf("节点证书不是由配置的CA签发: %w", err)
+	}
+	cert.Leaf = leaf
+	m := &mesh_tls{cert: cert, ca: ca}
+	if c.CRL != "" {
+		if m.crl, err = load_crl_file(c.CRL, ca_certs); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// 对端证书是否已被吊销
+func (m *mesh_tls) check_revoked(certs []*x509.Certificate) error {
+	if m.crl == nil {
+		return nil
+	}
+	for _, cert := range certs {
+		if m.crl.is_revoked(cert) {
+			return fmt.Errorf("证书已被吊销: %s (序列号 %s)", cert_node_id(cert), cert.SerialNumber.Text(16))
+		}
+	}
+	return nil
+}
+
+// 本节点证书中的节点ID
+func (m *mesh_tls) node_id() string {
+	return cert_node_id(m.cert.Leaf)
+}
+
+// 服务端：要求并校验客户端证书
+func (m *mesh_tls) server_config() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{m.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    m.ca,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return m.check_revoked(cs.PeerCertificates)
+		},
+		NextProtos: []string{"ffmesh-quic"},
+	}
+}
+
+// 客户端：上级节点通常用IP连接，不校验主机名，只校验证书链，节点ID在握手后校验
+func (m *mesh_tls) client_config() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{m.cert},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if err := verify_peer_chain(cs.PeerCertificates, m.ca, x509.ExtKeyUsageServerAuth); err != nil {
+				return err
+			}
+			return m.check_revoked(cs.PeerCertificates)
+		},
+		NextProtos: []string{"ffmesh-quic"},
+	}
+}
+
+func verify_peer_chain(certs []*x509.Certificate, ca *x509.CertPool, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("对端没有提供证书")
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// 证书标识的节点ID：优先取 spiffe://ffmesh/node/<id> 形式的URI SAN，没有时取CN
+func cert_node_id(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	for _, uri := range cert.URIs {
+		if s := uri.String(); strings.HasPrefix(s, SPIFFE_NODE_PREFIX) {
+			return strings.TrimPrefix(s, SPIFFE_NODE_PREFIX)
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// 校验连接对端证书中的节点ID与其声称的节点ID一致，未配置证书时不校验
+func check_peer_identity(conn quic.Connection, node_id string) error {
+	if fm.tls == nil {
+		return nil
+	}
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("对端没有提供证书")
+	}
+	if cert_id := cert_node_id(certs[0]); cert_id != node_id {
+		return fmt.Errorf("证书节点ID不匹配: 证书为%q, 声称为%q", cert_id, node_id)
+	}
+	return nil
+}
+
+// 获取客户端TLS配置（未配置证书时跳过证书验证）
 func GetClientTLSConfig() *tls.Config {
+	if fm.tls != nil {
+		return fm.tls.client_config()
+	}
 	return &tls.Config{
 		// 跳过证书验证
 		InsecureSkipVerify: true,
@@ -133,8 +284,11 @@ func GetClientTLSConfig() *tls.Config {
 	}
 }
 
-// 获取服务端TLS配置
+// 获取服务端TLS配置（未配置证书时使用自签名证书）
 func GetServerTLSConfig() *tls.Config {
+	if fm.tls != nil {
+		return fm.tls.server_config()
+	}
 	tlsConfigOnce.Do(func() {
 		tlsConfig = generateTLSConfig()
 	})
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROUTE_COST_DIRECT     = 1                // 直连节点的开销
+	ROUTE_COST_INFINITY   = 16               // 开销达到此值视为不可达
+	ROUTE_UPDATE_INTERVAL = 10 * time.Second // 周期性发送路由更新的间隔
+	ROUTE_EXPIRE          = 35 * time.Second // 邻居超过此时间没有发送路由更新，丢弃从它学到的路由
+)
+
+// 路由表条目：目标节点 -> 下一跳
+type route_entry struct {
+	node_id      string    // 目标节点ID
+	next_hop     string    // 下一跳节点ID
+	cost         int       // 开销（跳数）
+	learned_from string    // 从哪个邻居学到的，直连路由为目标节点自己
+	path         []string  // 从本节点出发经过的节点ID（不含本节点，含目标节点）
+	updated      time.Time // 最近一次更新时间
+}
+
+func (e *route_entry) age() time.Duration {
+	return time.Since(e.updated)
+}
+
+// 邻居通告的一条路由
+type route_advert struct {
+	cost int
+	path []string
+}
+
+// 邻居通告的完整路由列表
+type neighbor_adverts struct {
+	routes  map[string]route_advert
+	updated time.Time
+}
+
+// 直连的邻居
+type direct_neighbor struct {
+	since time.Time // 会话建立时间
+	relay bool      // 是否为中继节点（握手时is_up），只有中继节点可以通告其他节点
+}
+
+// 路由表（path-vector）
+// 保留每个邻居通告的全部路由，任何变化后重新计算最优路由：
+// 邻居断开时可以立即切换到其他邻居，路径中带有本节点的通告直接丢弃，保证无环
+type route_table struct {
+	mu      sync.RWMutex
+	self    string
+	transit bool                         // 是否向邻居通告学到的路由（只有中继节点才帮别人转发）
+	direct  map[string]direct_neighbor   // 直连节点 -> 会话信息
+	learned map[string]*neighbor_adverts // 邻居 -> 它通告的路由
+	best    map[string]*route_entry      // 目标节点 -> 最优路由
+}
+
+func new_route_table(self string, transit bool) *route_table {
+	return &route_table{
+		self:    self,
+		transit: transit,
+		direct:  make(map[string]direct_neighbor),
+		learned: make(map[string]*neighbor_adverts),
+		best:    make(map[string]*route_entry),
+	}
+}
+
+// 直连节点上线，relay 为对端是否为中继节点，返回路由表是否变化
+func (t *route_table) peer_up(node_id string, relay bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.direct[node_id]
+	if !ok {
+		d.since = time.Now()
+	}
+	if d.relay != relay {
+		// 会话被替换后不再是中继节点时，丢弃它之前通告的其他节点
+		delete(t.learned, node_id)
+	}
+	d.relay = relay
+	t.direct[node_id] = d
+	return t.recompute()
+}
+
+// 直连节点下线，删除直连路由和从它学到的所有路由
+func (t *route_table) peer_down(node_id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.direct, node_id)
+	delete(t.learned, node_id)
+	return t.recompute()
+}
+
+// 应用邻居发来的完整路由列表，返回路由表是否变化
+func (t *route_table) apply_update(from string, routes []RouteInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	neighbor, ok := t.direct[from]
+	if !ok {
+		// 只接受直连节点的路由通告
+		return false
+	}
+	adverts := &neighbor_adverts{
+		routes:  make(map[string]route_advert),
+		updated: time.Now(),
+	}
+	for _, r := range routes {
+		if r.NodeID == "" || r.NodeID == t.self || r.Cost < 0 || r.Cost >= ROUTE_COST_INFINITY {
+			continue
+		}
+		if len(r.Path) == 0 || r.Path[0] != from || contains_string(r.Path, t.self) {
+			// 路径必须从通告者开始，且不能经过自己
+			continue
+		}
+		if !neighbor.relay && r.NodeID != from {
+			// 非中继节点不帮别人转发，只能通告自己
+			continue
+		}
+		adverts.routes[r.NodeID] = route_advert{cost: r.Cost, path: r.Path}
+	}
+	t.learned[from] = adverts
+	return t.recompute()
+}
+
+// 丢弃长时间没有刷新的邻居通告
+func (t *route_table) expire(max_age time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expired := false
+	for node_id, adverts := range t.learned {
+		if time.Since(adverts.updated) > max_age {
+			delete(t.learned, node_id)
+			expired = true
+		}
+	}
+	if !expired {
+		return false
+	}
+	return t.recompute()
+}
+
+// 重新计算最优路由，调用方需持有写锁
+func (t *route_table) recompute() bool {
+	best := make(map[string]*route_entry)
+	consider := func(e *route_entry) {
+		cur, ok := best[e.node_id]
+		if !ok || e.cost < cur.cost || (e.cost == cur.cost && e.next_hop < cur.next_hop) {
+			best[e.node_id] = e
+		}
+	}
+
+	for node_id, d := range t.direct {
+		consider(&route_entry{
+			node_id:      node_id,
+			next_hop:     node_id,
+			cost:         ROUTE_COST_DIRECT,
+			learned_from: node_id,
+			path:         []string{node_id},
+			updated:      d.since,
+		})
+	}
+	for neighbor, adverts := range t.learned {
+		if _, ok := t.direct[neighbor]; !ok {
+			continue
+		}
+		for node_id, r := range adverts.routes {
+			cost := r.cost + ROUTE_COST_DIRECT
+			if cost >= ROUTE_COST_INFINITY {
+				continue
+			}
+			consider(&route_entry{
+				node_id:      node_id,
+				next_hop:     neighbor,
+				cost:         cost,
+				learned_from: neighbor,
+				path:         r.path,
+				updated:      adverts.updated,
+			})
+		}
+	}
+	// 直连路由开销最小，同开销时上面按下一跳排序保证结果确定
+
+	changed := len(best) != len(t.best)
+	for node_id, e := range best {
+		cur, ok := t.best[node_id]
+		if !ok || cur.next_hop != e.next_hop || cur.cost != e.cost {
+			changed = true
+		}
+	}
+	t.best = best
+	return changed
+}
+
+// 查找到目标节点的路由
+func (t *route_table) lookup(node_id string) (route_entry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok := t.best[node_id]
+	if !ok {
+		return route_entry{}, false
+	}
+	return *e, true
+}
+
+// 生成发给某个邻居的路由通告
+// 本节点开销为0；下一跳是该邻居的路由不通告（split horizon），非中继节点只通告自己
+func (t *route_table) advertise(to string) []RouteInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	routes := []RouteInfo{{NodeID: t.self, Cost: 0, Path: []string{t.self}}}
+	if !t.transit {
+		return routes
+	}
+	for node_id, e := range t.best {
+		if node_id == to || e.next_hop == to || contains_string(e.path, to) {
+			continue
+		}
+		path := append([]string{t.self}, e.path...)
+		routes = append(routes, RouteInfo{NodeID: node_id, Cost: e.cost, Path: path})
+	}
+	return routes
+}
+
+// 获取路由表快照，按目标节点ID排序
+func (t *route_table) snapshot() []route_entry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entries := make([]route_entry, 0, len(t.best))
+	for _, e := range t.best {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].node_id < entries[j].node_id
+	})
+	return entries
+}
+
+// 打印路由表
+func (t *route_table) print() {
+	entries := t.snapshot()
+	fmt.Printf("🧭 路由表 (%d条):\n", len(entries))
+	for _, e := range entries {
+		fmt.Printf("   %s -> 下一跳 %s, 开销 %d, 来源 %s, 路径 %s, %ds前更新\n",
+			e.node_id, e.next_hop, e.cost, e.learned_from, strings.Join(e.path, ">"), int(e.age().Seconds()))
+	}
+}
+
+func contains_string(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 节点注册表变化时同步路由表
+func route_on_peer_event(ev peer_event) {
+	var changed bool
+	if client := fm.peers.get(ev.node_id); client != nil {
+		changed = fm.routes.peer_up(ev.node_id, client.is_up)
+	} else {
+		changed = fm.routes.peer_down(ev.node_id)
+	}
+	if ev.typ != PEER_EVENT_REMOVE {
+		// 新会话立即发送完整路由
+		send_route_update(ev.client)
+	}
+	if changed {
+		fm.routes.print()
+		broadcast_route_update()
+	}
+}
+
+// 处理邻居发来的路由更新
+func handle_route_update(msg *QuicMessage, remote_node_id string) {
+	update := msg.Data.(*RouteUpdateMessage)
+	if fm.routes.apply_update(remote_node_id, update.Routes) {
+		fm.routes.print()
+		broadcast_route_update()
+	}
+}
+
+// 向某个直连节点发送路由更新
+func send_route_update(client *quic_client) {
+	if client == nil || !client.supports(MSG_TYPE_ROUTE_UPDATE) {
+		// 老版本节点不支持路由通告，只保留直连路由
+		return
+	}
+	msg := NewQuicMessage(MSG_TYPE_ROUTE_UPDATE, client.node_id, RouteUpdateMessage{
+		Routes: fm.routes.advertise(client.node_id),
+	})
+	if err := client.send_msg(msg); err != nil {
+		fmt.Printf("⚠️  发送路由更新失败 [%s]: %v\n", client.node_id, err)
+	}
+}
+
+// 向所有直连节点发送路由更新
+func broadcast_route_update() {
+	fm.peers.each(func(client *quic_client) bool {
+		send_route_update(client)
+		return true
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRouteTableMultiHop(t *testing.T) {
+	rt := new_route_table("self", true)
+	rt.peer_up("up-a", true)
+	rt.peer_up("up-b", true)
+
+	// up-a 能到 far（两跳），up-b 能到 far（三跳）
+	rt.apply_update("up-a", []RouteInfo{
+		{NodeID: "up-a", Cost: 0, Path: []string{"up-a"}},
+		{NodeID: "far", Cost: 2, Path: []string{"up-a", "mid", "far"}},
+	})
+	rt.apply_update("up-b", []RouteInfo{
+		{NodeID: "up-b", Cost: 0, Path: []string{"up-b"}},
+		{NodeID: "far", Cost: 3, Path: []string{"up-b", "x", "y", "far"}},
+		// 经过自己的路由必须丢弃
+		{NodeID: "loop", Cost: 2, Path: []string{"up-b", "self", "loop"}},
+	})
+
+	route, ok := rt.lookup("far")
+	if !ok || route.next_hop != "up-a" || route.cost != 3 {
+		t.Fatalf("到far的路由不正确: %+v", route)
+	}
+	if _, ok := rt.lookup("loop"); ok {
+		t.Error("经过自己的路由不应该被接受")
+	}
+
+	// up-a 断开后立即切换到 up-b
+	rt.peer_down("up-a")
+	route, ok = rt.lookup("far")
+	if !ok || route.next_hop != "up-b" || route.cost != 4 {
+		t.Fatalf("up-a断开后到far的路由不正确: %+v", route)
+	}
+
+	// 不向下一跳通告经过它的路由
+	for _, r := range rt.advertise("up-b") {
+		if r.NodeID == "far" {
+			t.Errorf("不应该把经过up-b的路由通告给up-b: %+v", r)
+		}
+	}
+}
+
+func TestRouteTableNonTransit(t *testing.T) {
+	rt := new_route_table("leaf", false)
+	rt.peer_up("up-a", true)
+	rt.apply_update("up-a", []RouteInfo{
+		{NodeID: "far", Cost: 1, Path: []string{"up-a", "far"}},
+	})
+	if _, ok := rt.lookup("far"); !ok {
+		t.Fatal("非中继节点也应该学到路由")
+	}
+
+	routes := rt.advertise("up-b")
+	if len(routes) != 1 || routes[0].NodeID != "leaf" {
+		t.Errorf("非中继节点只应该通告自己: %+v", routes)
+	}
+}
+
+func TestRouteTableIgnoresUnknownNeighbor(t *testing.T) {
+	rt := new_route_table("self", true)
+	changed := rt.apply_update("stranger", []RouteInfo{
+		{NodeID: "far", Cost: 1, Path: []string{"stranger", "far"}},
+	})
+	if changed {
+		t.Error("不应该接受非直连节点的路由通告")
+	}
+	if _, ok := rt.lookup("far"); ok {
+		t.Error("不应该存在到far的路由")
+	}
+}
+
+// 非中继节点只能通告自己，不能把别的节点的流量引到自己这里
+func TestRouteTableLeafNeighbor(t *testing.T) {
+	rt := new_route_table("self", true)
+	rt.peer_up("victim", false)
+	rt.peer_up("leaf", false)
+	rt.apply_update("leaf", []RouteInfo{
+		{NodeID: "leaf", Cost: 0, Path: []string{"leaf"}},
+		{NodeID: "victim", Cost: 0, Path: []string{"leaf", "victim"}},
+		{NodeID: "far", Cost: 1, Path: []string{"leaf", "far"}},
+	})
+	if route, ok := rt.lookup("victim"); !ok || route.next_hop != "victim" {
+		t.Errorf("非中继节点不能抢走其他节点的路由: %+v", route)
+	}
+	if _, ok := rt.lookup("far"); ok {
+		t.Error("不应该接受非中继节点通告的其他节点")
+	}
+	if route, ok := rt.lookup("leaf"); !ok || route.cost != ROUTE_COST_DIRECT {
+		t.Errorf("非中继节点通告自己应该被接受: %+v", route)
+	}
+
+	// 同一个节点以中继身份重新连接后可以通告其他节点
+	rt.peer_up("leaf", true)
+	rt.apply_update("leaf", []RouteInfo{
+		{NodeID: "far", Cost: 1, Path: []string{"leaf", "far"}},
+	})
+	if route, ok := rt.lookup("far"); !ok || route.next_hop != "leaf" {
+		t.Errorf("中继节点通告的路由应该被接受: %+v", route)
+	}
+	rt.peer_up("leaf", false)
+	if _, ok := rt.lookup("far"); ok {
+		t.Error("不再是中继节点后应该丢弃它通告的其他节点")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 发布的服务
+// 目标节点在配置中声明服务名和本地地址，通过NODE_INFO把服务名（不含地址）通告给其他节点
+// 代理用 name@node_id 指定服务，由目标节点自己把服务名解析成地址，客户端不能指定任意地址
+const (
+	SERVICE_NAME_MAX_LEN   = 64
+	SERVICE_PROBE_INTERVAL = 15 * time.Second // 探测本节点服务地址的间隔
+	SERVICE_PROBE_TIMEOUT  = 2 * time.Second
+	SERVICE_SEQ_MAX_SKEW   = 24 * time.Hour // 通告序号超前本地时钟太多时不接受，避免一条通告把序号顶到上限
+)
+
+// 服务名只能包含字母、数字、.、_、-，不能包含@
+func valid_service_name(name string) bool {
+	if name == "" || len(name) > SERVICE_NAME_MAX_LEN {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '_' || c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// 某个节点通告的服务列表
+type service_entry struct {
+	node_id  string
+	seq      uint64 // 通告序号，只接受比已有的更新的通告
+	services []ServiceInfo
+	updated  time.Time
+}
+
+// 从其他节点学到的服务目录，以及本节点服务的健康状态
+type service_catalog struct {
+	mu    sync.RWMutex
+	nodes map[string]*service_entry
+
+	local_seq  uint64          // 本节点通告序号，健康状态变化时加1
+	local_down map[string]bool // 探测失败的本节点服务
+}
+
+// 本节点通告序号从启动时间开始，重启后的通告总是比旧的新
+func new_service_catalog() *service_catalog {
+	return &service_catalog{
+		nodes:      make(map[string]*service_entry),
+		local_seq:  uint64(time.Now().UnixNano()),
+		local_down: make(map[string]bool),
+	}
+}
+
+// 更新本节点服务的健康状态，返回是否变化
+func (c *service_catalog) set_local_health(name string, healthy bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.local_down[name] == !healthy {
+		return false
+	}
+	if healthy {
+		delete(c.local_down, name)
+	} else {
+		c.local_down[name] = true
+	}
+	c.local_seq++
+	return true
+}
+
+// 应用节点通告，返回是否更新（旧的、重复的或序号超前太多的通告返回false）
+func (c *service_catalog) apply(info *NodeInfoMessage) bool {
+	if info.Seq > uint64(time.Now().Add(SERVICE_SEQ_MAX_SKEW).UnixNano()) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.nodes[info.NodeID]; ok && cur.seq >= info.Seq {
+		return false
+	}
+	c.nodes[info.NodeID] = &service_entry{
+		node_id:  info.NodeID,
+		seq:      info.Seq,
+		services: info.Services,
+		updated:  time.Now(),
+	}
+	return true
+}
+
+// 删除节点的通告，之后该节点的任何序号都会被接受
+func (c *service_catalog) forget(node_id string) {
+	c.mu.Lock()
+	delete(c.nodes, node_id)
+	c.mu.Unlock()
+}
+
+// 节点是否通告了该服务
+func (c *service_catalog) lookup(node_id string, name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if e, ok := c.nodes[node_id]; ok {
+		for _, s := range e.services {
+			if s.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 服务目录中的一项，用于选择节点和管理接口
+type service_view struct {
+	Service string `json:"service"`
+	NodeID  string `json:"node_id"`
+	Healthy bool   `json:"healthy"`
+	Cost    int    `json:"cost"` // 路由开销，本节点为0
+}
+
+// 列出所有可达节点（含本节点）提供的服务，按服务名、开销、节点ID排序
+func (c *service_catalog) list() []service_view {
+	var views []service_view
+	for _, s := range local_node_info().Services {
+		views = append(views, service_view{Service: s.Name, NodeID: fm.config.NodeID, Healthy: s.Healthy})
+	}
+	for _, e := range c.snapshot() {
+		route, ok := fm.routes.lookup(e.node_id)
+		if !ok {
+			continue
+		}
+		for _, s := range e.services {
+			views = append(views, service_view{Service: s.Name, NodeID: e.node_id, Healthy: s.Healthy, Cost: route.cost})
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		a, b := views[i], views[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Cost != b.Cost {
+			return a.Cost < b.Cost
+		}
+		return a.NodeID < b.NodeID
+	})
+	return views
+}
+
+// 为只写了服务名的代理选择节点：健康的节点中路由开销最小的一个
+func (c *service_catalog) pick(name string) (string, bool) {
+	for _, v := range c.list() {
+		if v.Service == name && v.Healthy {
+			return v.NodeID, true
+		}
+	}
+	return "", false
+}
+
+// 获取服务目录快照，只包含路由可达的节点，按节点ID排序
+func (c *service_catalog) snapshot() []service_entry {
+	c.mu.RLock()
+	entries := make([]service_entry, 0, len(c.nodes))
+	for _, e := range c.nodes {
+		entries = append(entries, *e)
+	}
+	c.mu.RUnlock()
+
+	reachable := entries[:0]
+	for _, e := range entries {
+		if _, ok := fm.routes.lookup(e.node_id); ok {
+			reachable = append(reachable, e)
+		}
+	}
+	sort.Slice(reachable, func(i, j int) bool {
+		return reachable[i].node_id < reachable[j].node_id
+	})
+	return reachable
+}
+
+// 打印服务目录
+func (c *service_catalog) print() {
+	entries := c.snapshot()
+	fmt.Printf("📇 服务目录 (%d个节点):\n", len(entries))
+	for _, e := range entries {
+		names := make([]string, 0, len(e.services))
+		for _, s := range e.services {
+			names = append(names, s.Name)
+		}
+		fmt.Printf("   %s: %v\n", e.node_id, names)
+	}
+}
+
+// 本节点的服务通告
+func local_node_info() *NodeInfoMessage {
+	fm.services.mu.RLock()
+	defer fm.services.mu.RUnlock()
+	info := &NodeInfoMessage{
+		NodeID: fm.config.NodeID,
+		Seq:    fm.services.local_seq,
+	}
+	for _, s := range fm.config.Services {
+		info.Services = append(info.Services, ServiceInfo{Name: s.Name, Healthy: !fm.services.local_down[s.Name]})
+	}
+	return info
+}
+
+// 探测本节点的服务地址，健康状态变化时向所有邻居重新通告
+func probe_local_services() {
+	changed := false
+	for _, s := range fm.config.Services {
+		conn, err := dial_address(PROTO_TCP, s.Address, SERVICE_PROBE_TIMEOUT)
+		if err == nil {
+			conn.Close()
+		}
+		if fm.services.set_local_health(s.Name, err == nil) {
+			changed = true
+			if err != nil {
+				fmt.Printf("⚠️  服务%s不可用: %v\n", s.Name, err)
+			} else {
+				fmt.Printf("✅ 服务%s恢复\n", s.Name)
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	info := local_node_info()
+	fm.peers.each(func(client *quic_client) bool {
+		send_node_info(client, info)
+		return true
+	})
+}
+
+func send_node_info(client *quic_client, info *NodeInfoMessage) {
+	if client == nil || !client.supports(MSG_TYPE_NODE_INFO) {
+		return
+	}
+	msg := NewQuicMessage(MSG_TYPE_NODE_INFO, client.node_id, info)
+	if err := client.send_msg(msg); err != nil {
+		fmt.Printf("⚠️  发送服务通告失败 [%s]: %v\n", client.node_id, err)
+	}
+}
+
+// 新会话建立时发送本节点的服务；中继节点把学到的服务也发给它
+func services_on_peer_event(ev peer_event) {
+	if ev.typ == PEER_EVENT_REMOVE {
+		// 节点断开后由路由表决定它的服务是否还可达
+		return
+	}
+	// 节点重新直连时以它自己发来的通告为准，旧的序号（比如重启前的）不再挡住它
+	fm.services.forget(ev.node_id)
+	send_node_info(ev.client, local_node_info())
+	if !fm.routes.transit {
+		return
+	}
+	fm.services.mu.RLock()
+	known := make([]*NodeInfoMessage, 0, len(fm.services.nodes))
+	for _, e := range fm.services.nodes {
+		known = append(known, &NodeInfoMessage{NodeID: e.node_id, Seq: e.seq, Services: e.services})
+	}
+	fm.services.mu.RUnlock()
+	for _, info := range known {
+		if info.NodeID != ev.node_id {
+			send_node_info(ev.client, info)
+		}
+	}
+}
+
+// 处理节点发来的服务通告，中继节点继续转发给其他邻居（序号去重，不会无限转发）
+func handle_node_info(msg *QuicMessage, remote_node_id string) {
+	info := msg.Data.(*NodeInfoMessage)
+	if info.NodeID == "" || info.NodeID == fm.config.NodeID {
+		return
+	}
+	// 只接受节点自己发来的通告，或者路由上通往它的下一跳转发的通告，其他邻居不能替别的节点通告
+	if info.NodeID != remote_node_id {
+		if route, ok := fm.routes.lookup(info.NodeID); !ok || route.next_hop != remote_node_id {
+			fmt.Printf("⚠️  丢弃%s的服务通告: 来自%s, 不是到该节点的下一跳\n", info.NodeID, remote_node_id)
+			return
+		}
+	}
+	if !fm.services.apply(info) {
+		return
+	}
+	fmt.Printf("📇 收到%s的服务通告 (来自%s): %d个服务\n", info.NodeID, remote_node_id, len(info.Services))
+	if !fm.routes.transit {
+		return
+	}
+	fm.peers.each(func(client *quic_client) bool {
+		if client.node_id != remote_node_id && client.node_id != info.NodeID {
+			send_node_info(client, info)
+		}
+		return true
+	})
+}
+
+// 目标节点解析服务名，检查来源节点是否允许访问，返回服务的本地地址
+func resolve_service(src string, name string) (string, *ErrorMessage) {
+	service := fm.config.GetService(name)
+	if service == nil {
+		return "", new_error_message(ERR_CODE_SERVICE_NOT_FOUND, fmt.Sprintf("本节点没有发布服务%s", name))
+	}
+	if match_patterns(service.Allow, src) {
+		return service.Address, nil
+	}
+	fm.metrics.inc("policy_denied.service")
+	fmt.Printf("🛡️  服务拒绝 %s -> %s (不在allow列表中)\n", src, name)
+	return "", new_error_message(ERR_CODE_REFUSED_BY_ACL, fmt.Sprintf("服务%s不允许%s访问", name, src))
+}
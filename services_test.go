@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServiceConfig(t *testing.T) {
+	config := &Config{
+		NodeID:   "svc-node-01",
+		Services: []ServiceConfig{{Name: "postgres", Address: "127.0.0.1:5432"}},
+		Proxies:  []ProxyConfig{{Name: "pg", LocalPort: 15432, Service: "postgres@db-node"}},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("配置应该有效: %v", err)
+	}
+	if config.Proxies[0].TargetNodeID != "db-node" {
+		t.Errorf("应该从service解析出目标节点: %q", config.Proxies[0].TargetNodeID)
+	}
+	if name, node_id := config.Proxies[0].ServiceTarget(); name != "postgres" || node_id != "db-node" {
+		t.Errorf("解析service错误: %s@%s", name, node_id)
+	}
+
+	for _, c := range []Config{
+		{Services: []ServiceConfig{{Name: "a@b", Address: "127.0.0.1:1"}}},
+		{Services: []ServiceConfig{{Name: "web", Address: "127.0.0.1"}}},
+		{Services: []ServiceConfig{{Name: "web", Address: "127.0.0.1:80"}, {Name: "web", Address: "127.0.0.1:81"}}},
+		{Services: []ServiceConfig{{Name: "web", Address: "127.0.0.1:80", Allow: []string{"["}}}},
+		{Proxies: []ProxyConfig{{Name: "pg", LocalPort: 1, Service: "postgres@"}}},
+		{Proxies: []ProxyConfig{{Name: "pg", LocalPort: 1, Service: "postgres@db", TargetAddress: "127.0.0.1:5432"}}},
+	} {
+		c.NodeID = "svc-node-01"
+		if err := validateConfig(&c); err == nil {
+			t.Errorf("配置应该无效: %+v", c)
+		}
+	}
+}
+
+func TestServiceCatalog(t *testing.T) {
+	setup_test_node()
+
+	peer := dial_test_peer(t, "svc-peer-1")
+	defer peer.close()
+
+	// 握手后收到测试节点自己的服务通告
+	peer.stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var info map[string]interface{}
+	for info == nil {
+		msg := peer.read()
+		if msg == nil {
+			t.Fatal("没有收到服务通告")
+		}
+		if msg.Type == MSG_TYPE_NODE_INFO {
+			info = msg.Data.(map[string]interface{})
+		}
+	}
+	services := info["services"].([]interface{})
+	if info["node_id"] != fm.config.NodeID || len(services) != len(fm.config.Services) || services[0].(map[string]interface{})["name"] != "api" {
+		t.Errorf("服务通告不正确: %v", info)
+	}
+	if _, ok := services[0].(map[string]interface{})["address"]; ok {
+		t.Error("服务通告不应该包含本地地址")
+	}
+
+	// 学习对端的服务，旧序号的通告被忽略
+	peer.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "svc-peer-1", Seq: 2, Services: []ServiceInfo{{Name: "postgres"}}})
+	if !wait_for(t, 3*time.Second, func() bool { return fm.services.lookup("svc-peer-1", "postgres") }) {
+		t.Fatal("没有学到对端的服务")
+	}
+	peer.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "svc-peer-1", Seq: 1, Services: []ServiceInfo{{Name: "redis"}}})
+	time.Sleep(100 * time.Millisecond)
+	if fm.services.lookup("svc-peer-1", "redis") || !fm.services.lookup("svc-peer-1", "postgres") {
+		t.Error("旧的服务通告不应该覆盖新的")
+	}
+
+	found := false
+	for _, e := range fm.services.snapshot() {
+		found = found || e.node_id == "svc-peer-1"
+	}
+	if !found {
+		t.Error("可达节点的服务应该在目录中")
+	}
+	peer.close()
+	if !wait_for(t, 3*time.Second, func() bool {
+		for _, e := range fm.services.snapshot() {
+			if e.node_id == "svc-peer-1" {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Error("不可达节点的服务不应该在目录中")
+	}
+}
+
+// 邻居不能替别的节点通告服务，只有节点自己或者路由上通往它的下一跳可以
+func TestServiceCatalogSpoof(t *testing.T) {
+	setup_test_node()
+
+	owner := dial_test_peer(t, "svc-owner-1")
+	defer owner.close()
+	other := dial_test_peer(t, "svc-other-1")
+	defer other.close()
+	relay := dial_test_peer_up(t, "svc-relay-1", true)
+	defer relay.close()
+	if !wait_for(t, 3*time.Second, func() bool {
+		return fm.peers.get(owner.node_id) != nil && fm.peers.get(other.node_id) != nil && fm.peers.get(relay.node_id) != nil
+	}) {
+		t.Fatal("节点没有注册")
+	}
+
+	owner.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: owner.node_id, Seq: 5, Services: []ServiceInfo{{Name: "postgres"}}})
+	if !wait_for(t, 3*time.Second, func() bool { return fm.services.lookup(owner.node_id, "postgres") }) {
+		t.Fatal("没有学到节点自己的服务")
+	}
+
+	// 其他邻居冒充节点通告，序号顶到上限也不会被接受；节点自己的序号超前太多同样不接受
+	other.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: owner.node_id, Seq: math.MaxUint64, Services: []ServiceInfo{{Name: "evil"}}})
+	owner.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: owner.node_id, Seq: math.MaxUint64, Services: []ServiceInfo{{Name: "stuck"}}})
+	owner.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: owner.node_id, Seq: 6, Services: []ServiceInfo{{Name: "mysql"}}})
+	other.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: other.node_id, Seq: 1, Services: []ServiceInfo{{Name: "marker"}}})
+	if !wait_for(t, 3*time.Second, func() bool {
+		return fm.services.lookup(owner.node_id, "mysql") && fm.services.lookup(other.node_id, "marker")
+	}) {
+		t.Fatal("节点自己的新通告应该被接受")
+	}
+	if fm.services.lookup(owner.node_id, "evil") || fm.services.lookup(owner.node_id, "stuck") {
+		t.Error("冒充的或序号超前太多的通告不应该被接受")
+	}
+
+	// 路由上的下一跳可以转发远端节点的通告
+	relay.send(MSG_TYPE_ROUTE_UPDATE, RouteUpdateMessage{Routes: []RouteInfo{
+		{NodeID: relay.node_id, Cost: 0, Path: []string{relay.node_id}},
+		{NodeID: "svc-far-1", Cost: 1, Path: []string{relay.node_id, "svc-far-1"}},
+	}})
+	if !wait_for(t, 3*time.Second, func() bool { _, ok := fm.routes.lookup("svc-far-1"); return ok }) {
+		t.Fatal("没有学到远端节点的路由")
+	}
+	other.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "svc-far-1", Seq: 5, Services: []ServiceInfo{{Name: "evil"}}})
+	other.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: other.node_id, Seq: 2, Services: []ServiceInfo{{Name: "marker-2"}}})
+	if !wait_for(t, 3*time.Second, func() bool { return fm.services.lookup(other.node_id, "marker-2") }) {
+		t.Fatal("没有收到邻居自己的通告")
+	}
+	if fm.services.lookup("svc-far-1", "evil") {
+		t.Error("不是下一跳的邻居不能替远端节点通告")
+	}
+	relay.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "svc-far-1", Seq: 1, Services: []ServiceInfo{{Name: "redis"}}})
+	if !wait_for(t, 3*time.Second, func() bool { return fm.services.lookup("svc-far-1", "redis") }) {
+		t.Fatal("下一跳转发的通告应该被接受")
+	}
+
+	// 节点重新连接后重置序号，重启后从小序号开始的通告也会被接受
+	owner.close()
+	owner = dial_test_peer(t, owner.node_id)
+	defer owner.close()
+	owner.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: owner.node_id, Seq: 1, Services: []ServiceInfo{{Name: "mongo"}}})
+	if !wait_for(t, 3*time.Second, func() bool { return fm.services.lookup(owner.node_id, "mongo") }) {
+		t.Error("节点重新连接后应该重置通告序号")
+	}
+}
+
+// 按服务名建立数据通道：地址由目标节点解析，不存在的服务和不允许的来源被拒绝
+func TestServiceDataChannel(t *testing.T) {
+	setup_test_node()
+
+	backend, err := net.Listen("tcp", fm.config.GetService("db").Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	child := dial_test_peer_up(t, "svc-child-1", true)
+	defer child.close()
+
+	open := func(src string, service string) *QuicMessage {
+		return child.open_data(t, SynDataMessage{NodeID: src, TargetID: fm.config.NodeID, Service: service, HopLimit: 5, Path: []string{src, child.node_id}})
+	}
+	error_code := func(reply *QuicMessage) int {
+		if reply == nil || reply.Type != MSG_TYPE_ERROR {
+			return 0
+		}
+		return int(reply.Data.(map[string]interface{})["code"].(float64))
+	}
+	if reply := open("app-1", "db"); reply == nil || reply.Type != MSG_TYPE_SYN_ACK_DATA {
+		t.Errorf("应该连接到服务: %v", reply)
+	}
+	if reply := open("app-1", "missing"); error_code(reply) != ERR_CODE_SERVICE_NOT_FOUND {
+		t.Errorf("不存在的服务应该回复service-not-found: %v", reply)
+	}
+	if reply := open("guest", "db"); error_code(reply) != ERR_CODE_REFUSED_BY_ACL {
+		t.Errorf("不在allow列表中的来源应该被拒绝: %v", reply)
+	}
+
+	// 直连时冒充allow列表中的节点
+	before := fm.metrics.get("policy_denied.service")
+	spoof := child.open_data(t, SynDataMessage{NodeID: "app-1", TargetID: fm.config.NodeID, Service: "db", HopLimit: 5, Path: []string{"app-1"}})
+	if error_code(spoof) != ERR_CODE_REFUSED_BY_ACL || fm.metrics.get("policy_denied.service") != before {
+		t.Errorf("冒充的来源应该在解析服务之前被拒绝: %v", spoof)
+	}
+}
+
+// 只写服务名时选择健康且路由开销最小的节点，管理接口列出服务目录
+func TestServiceDiscovery(t *testing.T) {
+	setup_test_node()
+
+	backend, err := net.Listen("tcp", fm.config.GetService("api").Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sick := dial_test_peer(t, "disc-peer-1")
+	defer sick.close()
+	healthy := dial_test_peer(t, "disc-peer-2")
+	defer healthy.close()
+	sick.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "disc-peer-1", Seq: 1, Services: []ServiceInfo{{Name: "web", Healthy: false}}})
+	healthy.send(MSG_TYPE_NODE_INFO, NodeInfoMessage{NodeID: "disc-peer-2", Seq: 1, Services: []ServiceInfo{{Name: "web", Healthy: true}}})
+	if !wait_for(t, 3*time.Second, func() bool {
+		return fm.services.lookup("disc-peer-1", "web") && fm.services.lookup("disc-peer-2", "web")
+	}) {
+		t.Fatal("没有学到对端的服务")
+	}
+	if node_id, ok := fm.services.pick("web"); !ok || node_id != "disc-peer-2" {
+		t.Errorf("应该选择健康的节点: %s", node_id)
+	}
+	if _, ok := fm.services.pick("missing"); ok {
+		t.Error("没有节点提供的服务不应该选出节点")
+	}
+
+	// 本节点的服务开销为0，优先选择；探测失败后通告为不健康
+	probe_local_services()
+	if node_id, ok := fm.services.pick("api"); !ok || node_id != fm.config.NodeID {
+		t.Errorf("应该选择本节点: %s", node_id)
+	}
+	backend.Close()
+	probe_local_services()
+	if _, ok := fm.services.pick("api"); ok {
+		t.Error("探测失败的服务不应该被选择")
+	}
+	defer func() {
+		for _, s := range fm.config.Services {
+			fm.services.set_local_health(s.Name, true)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	admin_services(rec, httptest.NewRequest("GET", "/services", nil))
+	var all, views []service_view
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+		t.Fatalf("管理接口返回格式错误: %v", err)
+	}
+	for _, v := range all {
+		if v.Service == "api" || v.Service == "web" {
+			views = append(views, v)
+		}
+	}
+	want := []service_view{
+		{Service: "api", NodeID: fm.config.NodeID, Healthy: false, Cost: 0},
+		{Service: "web", NodeID: "disc-peer-1", Healthy: false, Cost: 1},
+		{Service: "web", NodeID: "disc-peer-2", Healthy: true, Cost: 1},
+	}
+	if !reflect.DeepEqual(views, want) {
+		t.Errorf("服务目录不正确: %+v", views)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// TLS透传：读取ClientHello中的SNI选择目标，不终止TLS，原始字节流经数据通道转发
+const (
+	SNI_PEEK_TIMEOUT = 10 * time.Second
+)
+
+var errSNIPeeked = errors.New("已读取ClientHello")
+
+// SNI规则只按主机名匹配，不能配置路径和证书
+func validate_sni(l *ListenerConfig) error {
+	if l.TLSCert != "" || l.TLSKey != "" {
+		return errors.New("sni监听器不终止TLS，不能配置 tls_cert/tls_key")
+	}
+	for i, r := range l.Ingress {
+		if (r.Path != "" && r.Path != "/") || r.StripPrefix {
+			return fmt.Errorf("入口规则[%d] sni监听器不能配置 path/strip_prefix", i)
+		}
+	}
+	return validate_ingress(l)
+}
+
+// 按配置顺序选择第一条主机名匹配的规则，host为空的规则匹配所有（包括没有SNI的连接）
+func (l *ListenerConfig) sni_route(server_name string) *IngressRoute {
+	server_name = strings.ToLower(server_name)
+	for i := range l.Ingress {
+		r := &l.Ingress[i]
+		if r.Host == "" {
+			return r
+		}
+		if ok, _ := path.Match(r.Host, server_name); ok && server_name != "" {
+			return r
+		}
+	}
+	return nil
+}
+
+// 只读的连接：握手时写入（例如告警）直接失败，客户端不会收到任何数据
+type sni_peek_conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sni_peek_conn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c sni_peek_conn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// 读取ClientHello中的SNI，返回已经读取的字节，转发时需要先发送
+// 用标准库解析ClientHello，读到之后中止握手
+func sni_peek(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var server_name string
+	var got_hello bool
+	err := tls.Server(sni_peek_conn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			server_name = hello.ServerName
+			got_hello = true
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	if !got_hello {
+		return "", nil, fmt.Errorf("读取ClientHello失败: %v", err)
+	}
+	return server_name, buf.Bytes(), nil
+}
+
+func sni_main(l ListenerConfig) {
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		fmt.Printf("⚠️  启动SNI监听器失败 [%s]: %v\n", l.Name, err)
+		return
+	}
+	defer listener.Close()
+	fmt.Printf("🔐 SNI监听器 [%s]: %s, %d条规则\n", l.Name, l.Listen, len(l.Ingress))
+	sni_serve(listener, &l)
+}
+
+func sni_serve(listener net.Listener, l *ListenerConfig) {
+	listener_serve(listener, func(conn net.Conn) {
+		sni_handle(conn, l)
+	})
+}
+
+func sni_handle(conn net.Conn, l *ListenerConfig) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SNI_PEEK_TIMEOUT))
+	server_name, hello, err := sni_peek(conn)
+	if err != nil {
+		fmt.Printf("⚠️  SNI [%s] %s: %v\n", l.Name, conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	route := l.sni_route(server_name)
+	if route == nil {
+		fmt.Printf("⚠️  SNI [%s]: 没有匹配%q的规则\n", l.Name, server_name)
+		fm.metrics.inc("sni_no_route")
+		return
+	}
+	target, err := ingress_dial(route, conn.RemoteAddr().String())
+	if err != nil {
+		fmt.Printf("⚠️  SNI [%s]: 连接%s失败: %v\n", l.Name, server_name, err)
+		return
+	}
+	defer target.Close()
+	if _, err := target.Write(hello); err != nil {
+		return
+	}
+
+	ch := make(chan bool, 1)
+	go func() {
+		io.Copy(conn, target)
+		ch <- true
+	}()
+	go func() {
+		io.Copy(target, conn)
+		ch <- true
+	}()
+	<-ch
+}
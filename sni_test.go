@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestSNIPeek(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true}).Handshake()
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	name, hello, err := sni_peek(server)
+	if err != nil || name != "db.example.com" {
+		t.Fatalf("SNI不正确: %q %v", name, err)
+	}
+	if len(hello) < 5 || hello[0] != 0x16 {
+		t.Errorf("应该返回读取的ClientHello记录: %x", hello)
+	}
+
+	// 不是TLS的连接
+	client2, server2 := net.Pipe()
+	defer server2.Close()
+	go func() {
+		client2.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client2.Close()
+	}()
+	if _, _, err := sni_peek(server2); err == nil {
+		t.Error("非TLS连接应该失败")
+	}
+}
+
+func TestSNIListener(t *testing.T) {
+	setup_test_node()
+
+	backend := dial_test_peer(t, "sni-backend-1")
+	defer backend.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(backend.node_id) != nil }) {
+		t.Fatal("目标节点没有注册")
+	}
+	// 模拟目标节点上的TLS服务：完成握手后回复目标地址，再回显数据
+	server_config := generateTLSConfig()
+	server_config.NextProtos = nil
+	backend.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		conn := tls.Server(&mesh_conn{Stream: stream}, server_config)
+		if err := conn.Handshake(); err != nil {
+			return
+		}
+		conn.Write([]byte(syn["target_tcp_addr"].(string) + "|"))
+		io.Copy(conn, conn)
+	})
+
+	l := ListenerConfig{
+		Name:   "tls",
+		Type:   LISTENER_SNI,
+		Listen: "127.0.0.1:0",
+		Ingress: []IngressRoute{
+			{Host: "db.example.com", Node: backend.node_id, Address: "10.0.0.5:5432"},
+			{Host: "*.example.com", Node: backend.node_id, Address: "10.0.0.6:443"},
+		},
+	}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go sni_serve(listener, &l)
+
+	for name, want := range map[string]string{
+		"db.example.com":  "10.0.0.5:5432|hello",
+		"www.example.com": "10.0.0.6:443|hello",
+	} {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(),
+			&tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("[%s] TLS握手失败: %v", name, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != want {
+			t.Errorf("[%s] 数据不正确: %q %v", name, buf, err)
+		}
+		conn.Close()
+	}
+
+	// 没有匹配的规则时直接关闭连接
+	_, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(),
+		&tls.Config{ServerName: "other.org", InsecureSkipVerify: true})
+	if err == nil {
+		t.Error("没有匹配的规则时握手应该失败")
+	}
+
+	bad := ListenerConfig{Name: "x", Type: LISTENER_SNI, Listen: "127.0.0.1:443", Ingress: []IngressRoute{{Host: "a", Path: "/api", Service: "api"}}}
+	if err := validate_listener(&bad); err == nil {
+		t.Error("sni监听器不能配置路径")
+	}
+}
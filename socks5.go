@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// SOCKS5入站（RFC 1928 / RFC 1929），支持CONNECT和UDP ASSOCIATE
+const (
+	SOCKS5_VERSION      = 0x05
+	SOCKS5_AUTH_VERSION = 0x01
+
+	SOCKS5_METHOD_NONE     = 0x00
+	SOCKS5_METHOD_PASSWORD = 0x02
+	SOCKS5_METHOD_REJECT   = 0xFF
+
+	SOCKS5_CMD_CONNECT       = 0x01
+	SOCKS5_CMD_UDP_ASSOCIATE = 0x03
+
+	SOCKS5_ATYP_IPV4   = 0x01
+	SOCKS5_ATYP_DOMAIN = 0x03
+	SOCKS5_ATYP_IPV6   = 0x04
+
+	SOCKS5_REP_SUCCESS            = 0x00
+	SOCKS5_REP_FAILURE            = 0x01
+	SOCKS5_REP_NOT_ALLOWED        = 0x02
+	SOCKS5_REP_HOST_UNREACHABLE   = 0x04
+	SOCKS5_REP_CONNECTION_REFUSED = 0x05
+	SOCKS5_REP_TTL_EXPIRED        = 0x06
+	SOCKS5_REP_CMD_NOT_SUPPORTED  = 0x07
+	SOCKS5_REP_ADDR_NOT_SUPPORTED = 0x08
+	SOCKS5_HANDSHAKE_TIMEOUT      = 10 * time.Second
+)
+
+var errSocks5Auth = errors.New("SOCKS5认证失败")
+
+func socks5_main(l ListenerConfig) {
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		fmt.Printf("⚠️  启动SOCKS5监听器失败 [%s]: %v\n", l.Name, err)
+		return
+	}
+	defer listener.Close()
+	fmt.Printf("🧦 SOCKS5监听器 [%s]: %s\n", l.Name, l.Listen)
+	socks5_serve(listener, &l)
+}
+
+func socks5_serve(listener net.Listener, l *ListenerConfig) {
+	listener_serve(listener, func(conn net.Conn) {
+		socks5_handle(conn, l)
+	})
+}
+
+func socks5_handle(conn net.Conn, l *ListenerConfig) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SOCKS5_HANDSHAKE_TIMEOUT))
+
+	username, err := socks5_negotiate(conn, l)
+	if err != nil {
+		fmt.Printf("⚠️  SOCKS5握手失败 [%s]: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	// 请求: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil || header[0] != SOCKS5_VERSION {
+		return
+	}
+	host, port, err := socks5_read_addr(conn)
+	if err != nil {
+		socks5_reply(conn, SOCKS5_REP_ADDR_NOT_SUPPORTED, nil)
+		return
+	}
+	// 建立数据通道可能比握手超时更久
+	conn.SetDeadline(time.Time{})
+
+	switch header[1] {
+	case SOCKS5_CMD_CONNECT:
+		socks5_connect(conn, l, username, host, port)
+	case SOCKS5_CMD_UDP_ASSOCIATE:
+		socks5_udp_associate(conn, l, username)
+	default:
+		socks5_reply(conn, SOCKS5_REP_CMD_NOT_SUPPORTED, nil)
+	}
+}
+
+// 协商认证方式，返回用户名（没有认证时为空）
+// 配置了用户时必须用户名密码认证；没有配置用户时也接受用户名密码认证，用户名只用于选择出口节点
+func socks5_negotiate(conn net.Conn, l *ListenerConfig) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != SOCKS5_VERSION {
+		return "", fmt.Errorf("不支持的SOCKS版本: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	// 客户端提供用户名时优先用户名密码认证，用户名可能指定了出口节点
+	method := byte(SOCKS5_METHOD_REJECT)
+	switch {
+	case bytes.IndexByte(methods, SOCKS5_METHOD_PASSWORD) >= 0:
+		method = SOCKS5_METHOD_PASSWORD
+	case len(l.Users) == 0 && bytes.IndexByte(methods, SOCKS5_METHOD_NONE) >= 0:
+		method = SOCKS5_METHOD_NONE
+	}
+	conn.Write([]byte{SOCKS5_VERSION, method})
+	switch method {
+	case SOCKS5_METHOD_NONE:
+		return "", nil
+	case SOCKS5_METHOD_REJECT:
+		return "", errors.New("客户端不支持可用的认证方式")
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", err
+	}
+	username := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", err
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if ver[0] != SOCKS5_AUTH_VERSION || !l.check_user(string(username), string(password)) {
+		conn.Write([]byte{SOCKS5_AUTH_VERSION, 0x01})
+		fm.metrics.inc("auth_failed.socks5")
+		return "", fmt.Errorf("%w: %s", errSocks5Auth, username)
+	}
+	conn.Write([]byte{SOCKS5_AUTH_VERSION, 0x00})
+	return string(username), nil
+}
+
+// 读取 ATYP DST.ADDR DST.PORT
+func socks5_read_addr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4, SOCKS5_ATYP_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == SOCKS5_ATYP_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case SOCKS5_ATYP_DOMAIN:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("不支持的地址类型: %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// 编码 ATYP ADDR PORT
+func socks5_encode_addr(host string, port int) []byte {
+	var buf []byte
+	if ip := net.ParseIP(host); ip == nil {
+		buf = append([]byte{SOCKS5_ATYP_DOMAIN, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{SOCKS5_ATYP_IPV4}, ip4...)
+	} else {
+		buf = append([]byte{SOCKS5_ATYP_IPV6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// 回复: VER REP RSV ATYP BND.ADDR BND.PORT
+func socks5_reply(conn net.Conn, rep byte, bind *net.UDPAddr) {
+	buf := []byte{SOCKS5_VERSION, rep, 0x00}
+	if bind == nil {
+		buf = append(buf, socks5_encode_addr("0.0.0.0", 0)...)
+	} else {
+		buf = append(buf, socks5_encode_addr(bind.IP.String(), bind.Port)...)
+	}
+	conn.Write(buf)
+}
+
+// 数据通道错误转换成SOCKS5回复码
+func socks5_error_reply(merr *ErrorMessage) byte {
+	switch merr.Code {
+	case ERR_CODE_REFUSED_BY_ACL:
+		return SOCKS5_REP_NOT_ALLOWED
+	case ERR_CODE_TARGET_UNREACHABLE:
+		return SOCKS5_REP_CONNECTION_REFUSED
+	case ERR_CODE_NODE_NOT_FOUND, ERR_CODE_LOOP, ERR_CODE_SERVICE_NOT_FOUND:
+		return SOCKS5_REP_HOST_UNREACHABLE
+	case ERR_CODE_HOP_LIMIT, ERR_CODE_TIMEOUT:
+		return SOCKS5_REP_TTL_EXPIRED
+	}
+	return SOCKS5_REP_FAILURE
+}
+
+func socks5_connect(conn net.Conn, l *ListenerConfig, username string, host string, port int) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	node_id := l.exit_node(username, host, port)
+	if node_id == "" {
+		fmt.Printf("⚠️  SOCKS5 [%s]: 没有到%s的出口节点\n", l.Name, addr)
+		socks5_reply(conn, SOCKS5_REP_NOT_ALLOWED, nil)
+		return
+	}
+	stream, merr := mesh_dial(SynDataMessage{TargetID: node_id, TargetTcpAddr: addr, ClientAddr: conn.RemoteAddr().String()})
+	if merr != nil {
+		fmt.Printf("⚠️  SOCKS5 [%s]: 连接%s失败: %v\n", l.Name, addr, merr)
+		socks5_reply(conn, socks5_error_reply(merr), nil)
+		return
+	}
+	defer stream.Close()
+	socks5_reply(conn, SOCKS5_REP_SUCCESS, nil)
+
+	ch := make(chan bool, 1)
+	go func() {
+		io.Copy(conn, stream)
+		ch <- true
+	}()
+	go func() {
+		io.Copy(stream, conn)
+		ch <- true
+	}()
+	<-ch
+}
+
+// UDP ASSOCIATE：为客户端开一个UDP中继端口，每个目标地址一条UDP数据通道，TCP控制连接断开时结束
+func socks5_udp_associate(conn net.Conn, l *ListenerConfig, username string) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		socks5_reply(conn, SOCKS5_REP_FAILURE, nil)
+		return
+	}
+	defer relay.Close()
+	socks5_reply(conn, SOCKS5_REP_SUCCESS, relay.LocalAddr().(*net.UDPAddr))
+
+	assoc := &socks5_udp_assoc{
+		listener:  l,
+		username:  username,
+		relay:     relay,
+		client_ip: conn.RemoteAddr().(*net.TCPAddr).IP,
+		flows:     make(map[string]*socks5_udp_flow),
+		done:      make(chan struct{}),
+	}
+	go assoc.serve()
+	defer assoc.close()
+
+	// 控制连接上不会再有数据，读到EOF说明客户端结束了关联
+	io.Copy(io.Discard, conn)
+}
+
+type socks5_udp_assoc struct {
+	listener  *ListenerConfig
+	username  string
+	relay     *net.UDPConn
+	client_ip net.IP
+	done      chan struct{} // 关联结束时关闭
+
+	mu     sync.Mutex
+	client *net.UDPAddr                // 客户端的UDP地址，以收到的第一个报文为准
+	flows  map[string]*socks5_udp_flow // 目标地址 -> 会话
+	closed bool
+}
+
+// 一个目标地址对应的会话，数据通道建立前报文在out中排队
+type socks5_udp_flow struct {
+	out    chan []byte
+	stream quic.Stream // 数据通道建立后设置，由关联的mu保护
+}
+
+// 读取客户端报文: RSV(2) FRAG ATYP DST.ADDR DST.PORT DATA
+func (a *socks5_udp_assoc) serve() {
+	buf := make([]byte, UDP_MAX_PACKET)
+	for {
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !src.IP.Equal(a.client_ip) || n < 4 || buf[2] != 0 {
+			// 只接受控制连接的客户端，不支持分片
+			fm.metrics.inc("udp_dropped")
+			continue
+		}
+		a.mu.Lock()
+		if a.client == nil {
+			a.client = src
+		}
+		a.mu.Unlock()
+
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := socks5_read_addr(r)
+		if err != nil || r.Len() == 0 {
+			continue
+		}
+		pkt := make([]byte, r.Len())
+		r.Read(pkt)
+		a.send(host, port, pkt)
+	}
+}
+
+// 报文放入目标地址的会话队列，新目标地址在单独的goroutine中建立数据通道，不会挡住其他目标的报文
+func (a *socks5_udp_assoc) send(host string, port int, pkt []byte) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	flow := a.flows[addr]
+	if flow == nil {
+		flow = &socks5_udp_flow{out: make(chan []byte, UDP_FLOW_QUEUE)}
+		a.flows[addr] = flow
+		go a.flow_handle(host, port, flow)
+	}
+	a.mu.Unlock()
+
+	select {
+	case flow.out <- pkt:
+	default:
+		fm.metrics.inc("udp_dropped")
+	}
+}
+
+// 建立数据通道并转发会话的报文，数据通道失败或关联结束时返回，返回后从会话表中删除
+func (a *socks5_udp_assoc) flow_handle(host string, port int, flow *socks5_udp_flow) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	defer func() {
+		a.mu.Lock()
+		if a.flows[addr] == flow {
+			delete(a.flows, addr)
+		}
+		a.mu.Unlock()
+	}()
+
+	node_id := a.listener.exit_node(a.username, host, port)
+	if node_id == "" {
+		fmt.Printf("⚠️  SOCKS5 [%s]: 没有到%s的出口节点\n", a.listener.Name, addr)
+		return
+	}
+	a.mu.Lock()
+	client := a.client.String()
+	a.mu.Unlock()
+	stream, merr := mesh_dial(SynDataMessage{TargetID: node_id, TargetTcpAddr: addr, Protocol: PROTO_UDP, ClientAddr: client})
+	if merr != nil {
+		fmt.Printf("⚠️  SOCKS5 [%s]: UDP连接%s失败: %v\n", a.listener.Name, addr, merr)
+		return
+	}
+	defer stream.Close()
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		stream.CancelRead(0)
+		return
+	}
+	flow.stream = stream
+	a.mu.Unlock()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		a.receive(host, port, stream)
+	}()
+	for {
+		select {
+		case pkt := <-flow.out:
+			if _, err := stream.Write(encode_frame(pkt)); err != nil {
+				return
+			}
+		case <-received:
+			return
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// 目标的回复加上SOCKS5 UDP头发回客户端
+func (a *socks5_udp_assoc) receive(host string, port int, stream quic.Stream) {
+	header := append([]byte{0, 0, 0}, socks5_encode_addr(host, port)...)
+	for {
+		pkt, err := read_frame(stream, UDP_MAX_PACKET)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		a.relay.WriteToUDP(append(header[:len(header):len(header)], pkt...), client)
+	}
+}
+
+func (a *socks5_udp_assoc) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	close(a.done)
+	for _, flow := range a.flows {
+		if flow.stream != nil {
+			flow.stream.CancelRead(0)
+			flow.stream.Close()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestListenerExitNode(t *testing.T) {
+	l := ListenerConfig{
+		Name:   "socks",
+		Type:   LISTENER_SOCKS5,
+		Listen: "127.0.0.1:1080",
+		Routes: []ListenerRoute{
+			{Destinations: []string{"*.corp", "10.0.0.0/8"}, Node: "office"},
+			{Destinations: []string{"db.lan:5432", "[fd00::/8]"}, Node: "dc"},
+		},
+		DefaultNode: "exit",
+	}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user string
+		host string
+		port int
+		want string
+	}{
+		{"", "git.corp", 443, "office"},
+		{"", "10.1.2.3", 22, "office"},
+		{"", "db.lan", 5432, "dc"},
+		{"", "db.lan", 80, "exit"},
+		{"", "fd00::1", 80, "dc"},
+		{"alice@home", "git.corp", 443, "home"},
+		{"alice", "example.com", 443, "exit"},
+	} {
+		if got := l.exit_node(c.user, c.host, c.port); got != c.want {
+			t.Errorf("%s %s:%d 出口应该是%s, 实际: %s", c.user, c.host, c.port, c.want, got)
+		}
+	}
+
+	for _, bad := range []ListenerConfig{
+		{Name: "x", Type: "socks4", Listen: "127.0.0.1:1080"},
+		{Name: "x", Type: LISTENER_SOCKS5, Listen: "1080"},
+		{Name: "x", Type: LISTENER_SOCKS5, Listen: "127.0.0.1:1080", Users: []ListenerUser{{Username: "a@b"}}},
+		{Name: "x", Type: LISTENER_SOCKS5, Listen: "127.0.0.1:1080", Routes: []ListenerRoute{{Destinations: []string{"*"}}}},
+	} {
+		if err := validate_listener(&bad); err == nil {
+			t.Errorf("配置应该无效: %+v", bad)
+		}
+	}
+}
+
+// SOCKS5客户端用户名密码认证后发送请求，返回连接、回复码和编码后的绑定地址
+func socks5_dial(t *testing.T, addr string, user string, pass string, cmd byte, host string, port int) (net.Conn, byte, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply := make([]byte, 2)
+	conn.Write([]byte{SOCKS5_VERSION, 2, SOCKS5_METHOD_NONE, SOCKS5_METHOD_PASSWORD})
+	io.ReadFull(conn, reply)
+	if reply[1] != SOCKS5_METHOD_PASSWORD {
+		t.Fatalf("应该选择用户名密码认证: %v", reply)
+	}
+	auth := append([]byte{SOCKS5_AUTH_VERSION, byte(len(user))}, user...)
+	auth = append(append(auth, byte(len(pass))), pass...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		conn.Close()
+		return nil, SOCKS5_REP_NOT_ALLOWED, nil
+	}
+	conn.Write(append([]byte{SOCKS5_VERSION, cmd, 0}, socks5_encode_addr(host, port)...))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("读取SOCKS5回复失败: %v", err)
+	}
+	bind_host, bind_port, err := socks5_read_addr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, header[1], socks5_encode_addr(bind_host, bind_port)
+}
+
+func TestSocks5Listener(t *testing.T) {
+	setup_test_node()
+
+	exit := dial_test_peer(t, "socks-exit-1")
+	defer exit.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(exit.node_id) != nil }) {
+		t.Fatal("出口节点没有注册")
+	}
+	// 模拟出口节点：TCP数据通道回显目标地址和数据，UDP数据通道回显报文
+	exit.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		if syn["protocol"] == PROTO_UDP {
+			if syn["target_tcp_addr"] == "once.corp:53" {
+				// 回复一个报文后关闭数据通道
+				if pkt, err := read_frame(stream, UDP_MAX_PACKET); err == nil {
+					stream.Write(encode_frame(pkt))
+				}
+				stream.CancelRead(0)
+				stream.Close()
+				return
+			}
+			udp_echo_frames(stream)
+			return
+		}
+		stream.Write([]byte(syn["target_tcp_addr"].(string) + "|"))
+		io.Copy(stream, stream)
+	})
+
+	l := ListenerConfig{
+		Name:   "socks",
+		Type:   LISTENER_SOCKS5,
+		Listen: "127.0.0.1:0",
+		Users:  []ListenerUser{{Username: "alice", Password: "secret"}},
+		Routes: []ListenerRoute{
+			{Destinations: []string{"lost.corp"}, Node: "socks-missing-1"},
+			{Destinations: []string{"*.corp"}, Node: exit.node_id},
+		},
+	}
+	if err := validate_listener(&l); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go socks5_serve(listener, &l)
+	addr := listener.Addr().String()
+
+	if conn, rep, _ := socks5_dial(t, addr, "alice", "wrong", SOCKS5_CMD_CONNECT, "git.corp", 22); rep != SOCKS5_REP_NOT_ALLOWED || conn != nil {
+		t.Error("密码错误应该被拒绝")
+	}
+	if conn, rep, _ := socks5_dial(t, addr, "alice", "secret", SOCKS5_CMD_CONNECT, "example.com", 80); rep != SOCKS5_REP_NOT_ALLOWED {
+		t.Errorf("没有出口节点时应该拒绝: %d", rep)
+	} else {
+		conn.Close()
+	}
+
+	// CONNECT：按规则选择出口，用户名后缀指定出口
+	for _, user := range []string{"alice", "alice@" + exit.node_id} {
+		host := "git.corp"
+		if user != "alice" {
+			host = "example.com"
+		}
+		conn, rep, _ := socks5_dial(t, addr, user, "secret", SOCKS5_CMD_CONNECT, host, 22)
+		if rep != SOCKS5_REP_SUCCESS {
+			t.Fatalf("[%s] CONNECT失败: %d", user, rep)
+		}
+		conn.Write([]byte("hello"))
+		want := net.JoinHostPort(host, "22") + "|hello"
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != want {
+			t.Errorf("[%s] 数据不正确: %q %v", user, buf, err)
+		}
+		conn.Close()
+	}
+
+	// UDP ASSOCIATE
+	ctrl, rep, bind := socks5_dial(t, addr, "alice", "secret", SOCKS5_CMD_UDP_ASSOCIATE, "0.0.0.0", 0)
+	if rep != SOCKS5_REP_SUCCESS {
+		t.Fatalf("UDP ASSOCIATE失败: %d", rep)
+	}
+	defer ctrl.Close()
+	relay_port := binary.BigEndian.Uint16(bind[len(bind)-2:])
+	udp, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(relay_port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	// 查找出口节点要等上级节点回复，不能挡住其他目标的报文
+	relay := dial_test_peer_up(t, "socks-relay-1", true)
+	defer relay.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(relay.node_id) != nil }) {
+		t.Fatal("中继节点没有注册")
+	}
+	udp.Write(append(append([]byte{0, 0, 0}, socks5_encode_addr("lost.corp", 53)...), "lost"...))
+	udp.SetReadDeadline(time.Now().Add(FIND_NODE_TIMEOUT / 2))
+	header := append([]byte{0, 0, 0}, socks5_encode_addr("dns.corp", 53)...)
+	udp.Write(append(header, "query"...))
+	buf := make([]byte, 512)
+	n, err := udp.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], append(header, "query"...)) {
+		t.Errorf("UDP回复不正确: %q %v", buf[:n], err)
+	}
+
+	// 数据通道断开后会话被删除，之后的报文重新建立数据通道
+	header = append([]byte{0, 0, 0}, socks5_encode_addr("once.corp", 53)...)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	udp.Write(append(header, "first"...))
+	if n, err := udp.Read(buf); err != nil || !bytes.Equal(buf[:n], append(header, "first"...)) {
+		t.Errorf("UDP回复不正确: %q %v", buf[:n], err)
+	}
+	if !wait_for(t, 5*time.Second, func() bool {
+		udp.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		udp.Write(append(header, "second"...))
+		n, err := udp.Read(buf)
+		return err == nil && bytes.Equal(buf[:n], append(header, "second"...))
+	}) {
+		t.Error("数据通道断开后应该重新建立")
+	}
+}
@@ -1,73 +1,89 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"sync"
+
+	"github.com/quic-go/quic-go"
 )
 
-func tcp_proxy_main(local_port int, target_node_id string, target_address string) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", local_port))
+func tcp_proxy_main(proxy ProxyConfig) {
+	listeners, err := tcp_proxy_listen(proxy)
 	if err != nil {
 		fmt.Printf("监听本地端口失败: %v\n", err)
 		return
 	}
-	defer listener.Close()
-	fmt.Printf("监听本地端口: %d\n", local_port)
-	errorcount := 0
-	for {
-		conn, err := listener.Accept()
+	fmt.Printf("监听本地端口: %s\n", proxy.ListenAddr())
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			defer listener.Close()
+			listener_serve(listener, func(conn net.Conn) {
+				tcp_proxy_handle(conn, proxy)
+			})
+		}(listener)
+	}
+	wg.Wait()
+}
+
+// 监听代理的本地地址：unix:/path，或者每个绑定地址一个监听
+func tcp_proxy_listen(proxy ProxyConfig) ([]net.Listener, error) {
+	if p, ok := unix_path(proxy.Listen); ok {
+		mode, err := parse_socket_mode(proxy.ListenMode)
+		if err != nil {
+			return nil, err
+		}
+		listener, err := listen_unix(p, mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+	var listeners []net.Listener
+	for _, bind := range proxy.binds() {
+		listener, err := net.Listen(bind_network(PROTO_TCP, bind, proxy.LocalPort))
 		if err != nil {
-			fmt.Printf("接受连接失败: %v\n", err)
-			errorcount++
-			if errorcount > 5 {
-				fmt.Printf("⚠️  接受连接失败次数过多，退出\n")
-				os.Exit(1)
+			if proxy.optional_bind(bind) {
+				fmt.Printf("⚠️  跳过本地地址 %s: %v\n", bind, err)
+				continue
 			}
-			continue
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
 		}
-		errorcount = 0
-		go tcp_proxy_handle(conn, target_node_id, target_address)
+		listeners = append(listeners, listener)
 	}
+	return listeners, nil
 }
 
-func tcp_proxy_handle(conn net.Conn, target_node_id string, target_address string) {
-	if len(fm.quic_client) != 1 {
-		fmt.Printf("⚠️  跳跃节点数量不正确: %d\n", len(fm.quic_client))
-		conn.Close()
+func tcp_proxy_handle(conn net.Conn, proxy ProxyConfig) {
+	conn, err := proxy_accept(conn, proxy)
+	if err != nil {
+		fmt.Printf("⚠️  [%s] %v\n", proxy.Name, err)
 		return
 	}
-	// fm.quic_client里面应该只有一个跳跃节点，找出那个，但是id应该不是target_node_id
-	proxynodeid := ""
-	var proxyquic *quic_client
-	for node_id, quic_client := range fm.quic_client {
-		proxynodeid = node_id
-		proxyquic = quic_client
-		break
-	}
-
-	if proxyquic == nil {
-		fmt.Printf("⚠️  没有找到目标节点: %s\n", target_node_id)
+	target_node_id, service, err := proxy_target(proxy)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
 		conn.Close()
 		return
 	}
-
-	// 建立数据通道
-	stream, err := proxyquic.conn.OpenStreamSync(context.Background())
-	if err != nil {
-		fmt.Printf("打开stream失败: %v\n", err)
-		conn.Close()
+	if target_node_id == fm.config.NodeID && service != "" {
+		tcp_proxy_local_service(conn, proxy, service)
 		return
 	}
 
-	// 数据通道握手
-	ok := send_syn_data(proxynodeid, stream, target_node_id, target_address)
-	if !ok {
+	stream, err := proxy_open_data_channel(proxy, target_node_id, service, conn.RemoteAddr().String())
+	if err != nil {
 		conn.Close()
 		return
 	}
+
 	// 进行io.copy
 	ch := make(chan bool)
 	go func() {
@@ -82,3 +98,92 @@ func tcp_proxy_handle(conn net.Conn, target_node_id string, target_address strin
 	stream.Close()
 	conn.Close()
 }
+
+// 检查接受的连接：来自trusted_proxies的连接先解析PROXY协议头，再按真实的客户端地址检查allow_clients
+// 失败时关闭连接
+func proxy_accept(conn net.Conn, proxy ProxyConfig) (net.Conn, error) {
+	if match_cidrs(proxy.trusted_proxies, addr_ip(conn.RemoteAddr())) {
+		proxied, err := accept_proxy_protocol(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = proxied
+	}
+	if len(proxy.allow_clients) > 0 && !match_cidrs(proxy.allow_clients, addr_ip(conn.RemoteAddr())) {
+		fm.metrics.inc("policy_denied.client")
+		conn.Close()
+		return nil, fmt.Errorf("拒绝客户端%s (不在allow_clients中)", conn.RemoteAddr())
+	}
+	return conn, nil
+}
+
+// 代理的目标节点和服务名（按地址连接时服务名为空）
+// 只写了服务名时，从服务目录中选择路由开销最小的健康节点
+func proxy_target(proxy ProxyConfig) (string, string, error) {
+	service, _ := proxy.ServiceTarget()
+	if proxy.TargetNodeID != "" {
+		return proxy.TargetNodeID, service, nil
+	}
+	node_id, ok := fm.services.pick(service)
+	if !ok {
+		return "", "", fmt.Errorf("没有可用的节点提供服务: %s", service)
+	}
+	return node_id, service, nil
+}
+
+// 建立代理到目标节点的数据通道，client_addr 为本地客户端地址
+func proxy_open_data_channel(proxy ProxyConfig, target_node_id string, service string, client_addr string) (quic.Stream, error) {
+	stream, merr := mesh_dial(SynDataMessage{
+		TargetID:      target_node_id,
+		TargetTcpAddr: proxy.TargetAddress,
+		Service:       service,
+		Protocol:      proxy.GetProtocol(),
+		ClientAddr:    client_addr,
+		ProxyProtocol: proxy.ProxyProtocol,
+	})
+	if merr != nil {
+		fmt.Printf("⚠️  建立数据通道失败: %v\n", merr)
+		return nil, merr
+	}
+	return stream, nil
+}
+
+// 本节点自己提供的服务直接连接，不经过数据通道
+func tcp_proxy_local_service(conn net.Conn, proxy ProxyConfig, service string) {
+	defer conn.Close()
+	target, merr := dial_local_service(service, conn.RemoteAddr().String(), proxy.ProxyProtocol)
+	if merr != nil {
+		fmt.Printf("⚠️  连接本地服务失败: %v\n", merr)
+		return
+	}
+	defer target.Close()
+
+	ch := make(chan bool, 1)
+	go func() {
+		io.Copy(conn, target)
+		ch <- true
+	}()
+	go func() {
+		io.Copy(target, conn)
+		ch <- true
+	}()
+	<-ch
+}
+
+// 连接本节点发布的服务，按服务或代理的配置发送PROXY协议头
+func dial_local_service(service string, client_addr string, proxy_protocol string) (net.Conn, *ErrorMessage) {
+	addr, merr := resolve_service(fm.config.NodeID, service)
+	if merr != nil {
+		return nil, merr
+	}
+	conn, err := dial_address(PROTO_TCP, addr, TARGET_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, new_error_message(ERR_CODE_TARGET_UNREACHABLE, fmt.Sprintf("连接%s失败: %v", service, err))
+	}
+	if err := write_proxy_header(conn, target_proxy_protocol(service, proxy_protocol), client_addr); err != nil {
+		conn.Close()
+		return nil, new_error_message(ERR_CODE_TARGET_UNREACHABLE, fmt.Sprintf("发送PROXY协议头失败: %v", err))
+	}
+	return conn, nil
+}
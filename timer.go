@@ -3,40 +3,70 @@ package main
 import (
 	"fmt"
 	"time"
-
-	"github.com/quic-go/quic-go"
 )
 
+const METRICS_PRINT_INTERVAL = 60 * time.Second
+
 func timer_main() {
 	go timer_ping_quic()
+	go timer_route_update()
+	go timer_print_metrics()
+	go timer_reload_crl()
+	go timer_probe_services()
+}
+
+func timer_probe_services() {
+	if len(fm.config.Services) == 0 {
+		return
+	}
+	for {
+		probe_local_services()
+		time.Sleep(SERVICE_PROBE_INTERVAL)
+	}
+}
+
+func timer_reload_crl() {
+	for {
+		time.Sleep(CRL_RELOAD_INTERVAL)
+		reload_crl()
+	}
 }
 
 func timer_ping_quic() {
 	// 遍历client列表，发送ping消息
 	for {
 		time.Sleep(time.Second * 5)
-		for remote_node_id, client := range fm.quic_client {
-			if client == nil {
-				continue
-			}
-			for _, streaminfo := range client.streaminfo {
-				if streaminfo.link_type == LINK_TYPE_MSG {
-					quic_send_ping_msg(streaminfo.stream, remote_node_id)
-				}
-			}
-		}
+		fm.peers.each(func(client *quic_client) bool {
+			quic_send_ping_msg(client)
+			return true
+		})
 	}
 }
 
-func quic_send_ping_msg(stream quic.SendStream, remote_node_id string) {
-	if stream == nil {
-		return
-	}
-	msgping := NewQuicMessage(MSG_TYPE_PING, remote_node_id, PingMessage{})
-	_, err := stream.Write(msgping.ToBuffer())
+func quic_send_ping_msg(client *quic_client) {
+	msgping := NewQuicMessage(MSG_TYPE_PING, client.node_id, PingMessage{})
+	err := client.send_msg(msgping)
 	if err != nil {
 		fmt.Printf("⚠️  发送ping消息失败: %v\n", err)
 		// msg通道不通，等价于节点已下线
-		delete_quic_client_by_id(remote_node_id)
+		delete_quic_client(client.conn)
+	}
+}
+
+func timer_route_update() {
+	// 周期性向邻居发送完整路由，并清理过期的邻居通告
+	for {
+		time.Sleep(ROUTE_UPDATE_INTERVAL)
+		if fm.routes.expire(ROUTE_EXPIRE) {
+			fm.routes.print()
+		}
+		broadcast_route_update()
+	}
+}
+
+func timer_print_metrics() {
+	for {
+		time.Sleep(METRICS_PRINT_INTERVAL)
+		fm.metrics.print_if_changed()
 	}
 }
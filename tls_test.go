@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+type test_ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func write_pem(t *testing.T, path string, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func new_test_ca(t *testing.T, dir string) *test_ca {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	f, _ := os.CreateTemp(dir, "ca-*.pem")
+	f.Close()
+	write_pem(t, f.Name(), "CERTIFICATE", der)
+	return &test_ca{cert: cert, key: key, path: f.Name()}
+}
+
+// 签发节点证书并加载
+func (ca *test_ca) issue(t *testing.T, dir string, node_id string) *mesh_tls {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uri, _ := url.Parse(SPIFFE_NODE_PREFIX + node_id)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "not-the-node-id"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{uri},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, _ := x509.MarshalECPrivateKey(key)
+	cert_path := filepath.Join(dir, node_id+".crt")
+	key_path := filepath.Join(dir, node_id+".key")
+	write_pem(t, cert_path, "CERTIFICATE", der)
+	write_pem(t, key_path, "EC PRIVATE KEY", key_der)
+
+	m, err := load_mesh_tls(TLSConfig{Cert: cert_path, Key: key_path, CA: ca.path})
+	if err != nil {
+		t.Fatalf("加载节点证书失败: %v", err)
+	}
+	if m.node_id() != node_id {
+		t.Fatalf("证书节点ID不正确: %s", m.node_id())
+	}
+	return m
+}
+
+// 用指定的TLS配置连接，发送握手，返回握手结果（连接失败返回nil）
+func tls_handshake(addr string, client *mesh_tls, node_id string) *QuicMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tls_config := GetClientTLSConfig()
+	if client != nil {
+		tls_config = client.client_config()
+	}
+	conn, err := quic.DialAddr(ctx, addr, tls_config, GetQuicClientConfig())
+	if err != nil {
+		return nil
+	}
+	defer conn.CloseWithError(0, "test complete")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil
+	}
+	stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p := &test_peer{node_id: node_id, conn: conn, stream: stream}
+	p.send(MSG_TYPE_SYN_MSG, SynMsgMessage{Version: VERSION, MinVersion: MIN_VERSION, NodeID: node_id})
+	return p.read()
+}
+
+func TestMeshTLS(t *testing.T) {
+	setup_test_node()
+
+	dir := t.TempDir()
+	ca := new_test_ca(t, dir)
+	server := ca.issue(t, dir, fm.config.NodeID)
+	client := ca.issue(t, dir, "tls-node-b")
+	rogue := new_test_ca(t, dir).issue(t, dir, "tls-node-b")
+
+	if _, err := load_mesh_tls(TLSConfig{Cert: filepath.Join(dir, "tls-node-b.crt"), Key: filepath.Join(dir, "tls-node-b.key"), CA: ca.path}); err == nil {
+		t.Error("其他CA签发的证书应该加载失败")
+	}
+
+	fm.tls = server
+	defer func() { fm.tls = nil }()
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", GetServerTLSConfig(), GetQuicServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go handleQuicConnection(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+
+	result := func(msg *QuicMessage) bool {
+		return msg != nil && msg.Data.(map[string]interface{})["result"].(bool)
+	}
+	if msg := tls_handshake(addr, client, "tls-node-b"); !result(msg) {
+		t.Errorf("证书匹配的节点应该握手成功: %v", msg)
+	}
+	if msg := tls_handshake(addr, client, "tls-node-c"); result(msg) {
+		t.Error("证书与声称的节点ID不一致时应该被拒绝")
+	}
+	if fm.peers.get("tls-node-c") != nil {
+		t.Error("身份不匹配的节点不应该被注册")
+	}
+	if msg := tls_handshake(addr, rogue, "tls-node-b"); msg != nil {
+		t.Error("其他CA签发的证书应该被拒绝")
+	}
+	fm.tls = nil
+	if msg := tls_handshake(addr, nil, "tls-node-b"); msg != nil {
+		t.Error("没有客户端证书应该被拒绝")
+	}
+}
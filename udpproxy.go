@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// UDP转发
+// 本地UDP报文按来源地址分成会话，每个会话一条数据通道，通道上每个报文是一个消息帧
+// 目标节点把消息帧还原成UDP报文发给目标地址，回复按原路返回；会话空闲超时后关闭数据通道
+const (
+	PROTO_TCP = "tcp"
+	PROTO_UDP = "udp"
+
+	UDP_MAX_PACKET        = 65535
+	UDP_FLOW_IDLE_TIMEOUT = 60 * time.Second // 会话两个方向都没有报文时关闭
+	UDP_FLOW_QUEUE        = 64               // 数据通道建立前缓存的报文数，超过后丢弃
+)
+
+// 一个本地来源地址对应的会话
+type udp_flow struct {
+	src    *net.UDPAddr
+	out    chan []byte
+	active atomic.Int64 // 最近一次收发报文的时间
+}
+
+func (f *udp_flow) touch() {
+	f.active.Store(time.Now().UnixNano())
+}
+
+func (f *udp_flow) idle() time.Duration {
+	return time.Since(time.Unix(0, f.active.Load()))
+}
+
+func udp_proxy_main(proxy ProxyConfig) {
+	var conns []*net.UDPConn
+	for _, bind := range proxy.binds() {
+		pc, err := net.ListenPacket(bind_network(PROTO_UDP, bind, proxy.LocalPort))
+		if err != nil {
+			if proxy.optional_bind(bind) {
+				fmt.Printf("⚠️  跳过本地地址 %s: %v\n", bind, err)
+				continue
+			}
+			fmt.Printf("监听本地UDP端口失败: %v\n", err)
+			for _, c := range conns {
+				c.Close()
+			}
+			return
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+	}
+	fmt.Printf("监听本地UDP端口: %s\n", proxy.ListenAddr())
+	var wg sync.WaitGroup
+	for _, pc := range conns {
+		wg.Add(1)
+		go func(pc *net.UDPConn) {
+			defer wg.Done()
+			defer pc.Close()
+			udp_proxy_serve(pc, proxy)
+		}(pc)
+	}
+	wg.Wait()
+}
+
+func udp_proxy_serve(pc *net.UDPConn, proxy ProxyConfig) {
+	var mu sync.Mutex
+	flows := make(map[string]*udp_flow)
+
+	buf := make([]byte, UDP_MAX_PACKET)
+	for {
+		n, src, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("读取UDP报文失败: %v\n", err)
+			return
+		}
+		if n == 0 {
+			// 空报文无法用消息帧表示
+			continue
+		}
+		if len(proxy.allow_clients) > 0 && !match_cidrs(proxy.allow_clients, src.IP) {
+			fm.metrics.inc("policy_denied.client")
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+
+		key := src.String()
+		mu.Lock()
+		flow := flows[key]
+		if flow == nil {
+			flow = &udp_flow{src: src, out: make(chan []byte, UDP_FLOW_QUEUE)}
+			flow.touch()
+			flows[key] = flow
+			go func() {
+				udp_flow_handle(pc, proxy, flow)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case flow.out <- pkt:
+		default:
+			fm.metrics.inc("udp_dropped")
+		}
+	}
+}
+
+// 为会话建立数据通道，转发两个方向的报文，空闲超时后返回
+func udp_flow_handle(pc *net.UDPConn, proxy ProxyConfig, flow *udp_flow) {
+	target_node_id, service, err := proxy_target(proxy)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		return
+	}
+	if target_node_id == fm.config.NodeID {
+		fmt.Printf("⚠️  UDP代理不支持连接本节点自己的服务: %s\n", service)
+		return
+	}
+	stream, err := proxy_open_data_channel(proxy, target_node_id, service, flow.src.String())
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	fmt.Printf("🔀 UDP会话开始: %s -> %s\n", flow.src, target_node_id)
+
+	// 目标节点的回复发回本地来源地址
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			pkt, err := read_frame(stream, UDP_MAX_PACKET)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			pc.WriteToUDP(pkt, flow.src)
+		}
+	}()
+
+	timer := time.NewTimer(UDP_FLOW_IDLE_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case pkt := <-flow.out:
+			flow.touch()
+			if _, err := stream.Write(encode_frame(pkt)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-timer.C:
+			if idle := flow.idle(); idle < UDP_FLOW_IDLE_TIMEOUT {
+				timer.Reset(UDP_FLOW_IDLE_TIMEOUT - idle)
+				continue
+			}
+			fmt.Printf("🔌 UDP会话空闲超时: %s -> %s\n", flow.src, target_node_id)
+			stream.CancelRead(0)
+			return
+		}
+	}
+}
+
+// 目标节点：数据通道上的消息帧与UDP报文互相转换
+// 会话由发起方的空闲超时控制，发起方关闭数据通道后结束
+func udp_target_forward(stream quic.Stream, conn net.Conn) {
+	ch := make(chan struct{}, 2)
+	go func() {
+		for {
+			pkt, err := read_frame(stream, UDP_MAX_PACKET)
+			if err != nil {
+				break
+			}
+			conn.Write(pkt)
+		}
+		ch <- struct{}{}
+	}()
+	go func() {
+		buf := make([]byte, UDP_MAX_PACKET)
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			if err != nil {
+				// 目标端口不可达等ICMP错误只影响当前报文
+				continue
+			}
+			if n == 0 {
+				continue
+			}
+			if _, err := stream.Write(encode_frame(buf[:n])); err != nil {
+				break
+			}
+		}
+		ch <- struct{}{}
+	}()
+	<-ch
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 测试用的UDP回显服务
+func udp_echo_server(t *testing.T) *net.UDPConn {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, UDP_MAX_PACKET)
+		for {
+			n, src, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return pc
+}
+
+// 把数据通道上收到的消息帧原样发回
+func udp_echo_frames(stream quic.Stream) {
+	for {
+		pkt, err := read_frame(stream, UDP_MAX_PACKET)
+		if err != nil {
+			return
+		}
+		stream.Write(encode_frame(pkt))
+	}
+}
+
+// 目标节点把数据通道上的消息帧转换成UDP报文
+func TestUDPTargetForward(t *testing.T) {
+	setup_test_node()
+	echo := udp_echo_server(t)
+	defer echo.Close()
+
+	child := dial_test_peer(t, "udp-child-1")
+	defer child.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := child.conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := &test_peer{node_id: child.node_id, conn: child.conn, stream: stream}
+	data.send(MSG_TYPE_SYN_DATA, SynDataMessage{
+		NodeID:        child.node_id,
+		TargetID:      fm.config.NodeID,
+		TargetTcpAddr: echo.LocalAddr().String(),
+		Protocol:      PROTO_UDP,
+		HopLimit:      5,
+		Path:          []string{child.node_id},
+	})
+	if reply := data.read(); reply == nil || reply.Type != MSG_TYPE_SYN_ACK_DATA {
+		t.Fatalf("应该建立UDP数据通道: %v", reply)
+	}
+	for _, pkt := range []string{"query-1", "query-2"} {
+		stream.Write(encode_frame([]byte(pkt)))
+		reply, err := read_frame(stream, UDP_MAX_PACKET)
+		if err != nil || string(reply) != pkt {
+			t.Fatalf("UDP回显不正确: %q %v", reply, err)
+		}
+	}
+}
+
+// 本地UDP报文按来源地址分成会话，每个会话一条数据通道
+func TestUDPProxyFlows(t *testing.T) {
+	setup_test_node()
+
+	peer := dial_test_peer(t, "udp-peer-1")
+	defer peer.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(peer.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+
+	// 模拟目标节点：接受数据通道并回显消息帧
+	channels := make(chan map[string]interface{}, 4)
+	peer.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		channels <- syn
+		udp_echo_frames(stream)
+	})
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go udp_proxy_serve(pc, ProxyConfig{Name: "dns", Protocol: PROTO_UDP, TargetNodeID: peer.node_id, TargetAddress: "10.0.0.53:53"})
+
+	for i, name := range []string{"client-a", "client-b"} {
+		client, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte(name))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != name {
+			t.Fatalf("[%d] UDP代理回复不正确: %q %v", i, buf[:n], err)
+		}
+		// 同一个会话的后续报文走同一条数据通道
+		client.Write([]byte(name + "-again"))
+		if n, err = client.Read(buf); err != nil || string(buf[:n]) != name+"-again" {
+			t.Fatalf("[%d] UDP代理回复不正确: %q %v", i, buf[:n], err)
+		}
+	}
+	if len(channels) != 2 {
+		t.Errorf("两个来源地址应该建立两条数据通道, 实际: %d", len(channels))
+	}
+	syn := <-channels
+	if syn["protocol"] != PROTO_UDP || syn["target_tcp_addr"] != "10.0.0.53:53" {
+		t.Errorf("数据通道握手不正确: %+v", syn)
+	}
+}
+
+// 下一跳不支持UDP数据通道时在发送握手之前拒绝，不能让老版本节点按TCP连接
+func TestUDPOldPeer(t *testing.T) {
+	setup_test_node()
+
+	old, ack := dial_test_peer_syn(t, SynMsgMessage{
+		Version:      4,
+		MinVersion:   MIN_VERSION,
+		Capabilities: CAPABILITIES &^ (CAP_CODEC_CBOR | CAP_DATA_UDP),
+		NodeID:       "udp-old-1",
+	})
+	defer old.close()
+	if ack == nil || !ack.Data.(map[string]interface{})["result"].(bool) {
+		t.Fatalf("握手失败: %v", ack)
+	}
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(old.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+	opened := make(chan bool, 1)
+	old.accept_data(func(syn map[string]interface{}, stream quic.Stream) { opened <- true })
+
+	_, merr := mesh_dial(SynDataMessage{TargetID: old.node_id, TargetTcpAddr: "10.0.0.53:53", Protocol: PROTO_UDP})
+	if merr == nil || merr.Code != ERR_CODE_PROTOCOL {
+		t.Fatalf("应该回复protocol错误: %v", merr)
+	}
+	select {
+	case <-opened:
+		t.Error("不支持UDP的下一跳不应该收到数据通道")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unix domain socket：代理可以监听 unix:/path，目标地址和服务地址可以是 unix:/path
+const (
+	UNIX_ADDR_PREFIX         = "unix:"
+	UNIX_SOCKET_DEFAULT_MODE = 0600 // 默认只有运行ffmesh的用户能连接
+)
+
+// 地址是 unix:/path 时返回路径
+func unix_path(addr string) (string, bool) {
+	return strings.CutPrefix(addr, UNIX_ADDR_PREFIX)
+}
+
+// 规范化unix socket路径：必须是绝对路径，不能包含 ..（策略按规范化后的路径匹配，防止 /run/apps/../x 绕过通配符）
+func clean_unix_path(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("unix socket应该是绝对路径: %s", p)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("unix socket路径不能包含..: %s", p)
+		}
+	}
+	return filepath.Clean(p), nil
+}
+
+// 检查目标地址：host:port 或 unix:/path（绝对路径）
+func validate_target_address(addr string) error {
+	if p, ok := unix_path(addr); ok {
+		if _, err := clean_unix_path(p); err != nil {
+			return err
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// 连接 host:port 或 unix:/path，unix socket只支持tcp（流式）
+func dial_address(network string, addr string, timeout time.Duration) (net.Conn, error) {
+	if p, ok := unix_path(addr); ok {
+		if network != PROTO_TCP {
+			return nil, fmt.Errorf("unix socket不支持%s", network)
+		}
+		return net.DialTimeout("unix", p, timeout)
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
+
+// 解析socket文件权限（八进制，例如 0660），为空时使用默认值
+func parse_socket_mode(s string) (os.FileMode, error) {
+	if s == "" {
+		return UNIX_SOCKET_DEFAULT_MODE, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("socket文件权限应该是八进制，例如 0660: %s", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// 监听unix socket：删除上次异常退出留下的socket文件（仍有程序在监听时报错），设置文件权限，关闭监听时删除文件
+func listen_unix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s 已存在且不是socket文件", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s 已有程序在监听", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("删除残留的socket文件失败: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("设置socket文件权限失败: %v", err)
+	}
+	return listener, nil
+}
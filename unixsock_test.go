@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 残留的socket文件被删除，正在使用的socket和普通文件不会被删除
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run", "app.sock")
+
+	listener, err := listen_unix(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket文件权限不正确: %v %v", fi.Mode(), err)
+	}
+	if _, err := listen_unix(path, 0600); err == nil {
+		t.Error("已有程序在监听时应该失败")
+	}
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("关闭监听后应该删除socket文件: %v", err)
+	}
+
+	// 模拟异常退出留下的socket文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listen_unix(path, UNIX_SOCKET_DEFAULT_MODE)
+	if err != nil {
+		t.Fatalf("应该删除残留的socket文件: %v", err)
+	}
+	listener.Close()
+
+	file := filepath.Join(dir, "data.txt")
+	os.WriteFile(file, []byte("x"), 0600)
+	if _, err := listen_unix(file, 0600); err == nil {
+		t.Error("不是socket的文件不应该被删除")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("普通文件被删除: %v", err)
+	}
+}
+
+// 目标节点连接unix socket目标，策略按unix路径匹配
+func TestUnixTarget(t *testing.T) {
+	setup_test_node()
+
+	path := filepath.Join(t.TempDir(), "backend.sock")
+	backend, err := listen_unix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+			conn.Close()
+		}
+	}()
+
+	p, err := compile_policy(PolicyConfig{Targets: []PolicyRule{
+		{Action: "allow", Destinations: []string{"*:*", "unix:" + filepath.Dir(path) + "/*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, ok := range map[string]bool{
+		"unix:" + path:              true,
+		"unix:/var/run/docker.sock": false,
+		"127.0.0.1:22":              true,
+	} {
+		if _, merr := p.authorize_target("node-a", addr); (merr == nil) != ok {
+			t.Errorf("%s 期望允许=%v, 实际: %v", addr, ok, merr)
+		}
+	}
+
+	// 按规范化后的路径匹配，.. 和相对路径被拒绝
+	apps, err := compile_policy(PolicyConfig{Targets: []PolicyRule{
+		{Action: "allow", Destinations: []string{"unix:/run/apps/*/api.sock"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{
+		"unix:/run/apps/a/api.sock":    "unix:/run/apps/a/api.sock",
+		"unix:/run/apps/a/./api.sock":  "unix:/run/apps/a/api.sock",
+		"unix://run/apps/a//api.sock":  "unix:/run/apps/a/api.sock",
+		"unix:/run/apps/../api.sock":   "",
+		"unix:/run/apps/a/../api.sock": "",
+		"unix:run/apps/a/api.sock":     "",
+	} {
+		if got, merr := apps.authorize_target("node-a", addr); got != want {
+			t.Errorf("%s 期望连接%q, 实际: %q %v", addr, want, got, merr)
+		}
+	}
+	if _, err := compile_policy(PolicyConfig{Targets: []PolicyRule{{Action: "allow", Destinations: []string{"unix:*.sock"}}}}); err == nil {
+		t.Error("unix socket规则应该是绝对路径")
+	}
+
+	// 没有targets规则时其他目标全部允许，unix socket默认拒绝
+	var none *mesh_policy
+	if _, merr := none.authorize_target("node-a", "unix:"+path); merr == nil || merr.Code != ERR_CODE_REFUSED_BY_ACL {
+		t.Errorf("没有策略时unix socket应该被拒绝: %v", merr)
+	}
+	if _, merr := none.authorize_target("node-a", "127.0.0.1:22"); merr != nil {
+		t.Errorf("没有策略时其他目标应该允许: %v", merr)
+	}
+	use_test_policy(t, p)
+
+	child := dial_test_peer(t, "unix-child-1")
+	defer child.close()
+
+	syn := SynDataMessage{
+		NodeID:        child.node_id,
+		TargetID:      fm.config.NodeID,
+		TargetTcpAddr: UNIX_ADDR_PREFIX + path,
+		ClientAddr:    "203.0.113.7:5555",
+		ProxyProtocol: PROXY_PROTOCOL_V1,
+		HopLimit:      5,
+		Path:          []string{child.node_id},
+	}
+	if reply := child.open_data(t, syn); reply == nil || reply.Type != MSG_TYPE_SYN_ACK_DATA {
+		t.Fatalf("应该建立数据通道: %v", reply)
+	}
+	select {
+	case line := <-lines:
+		if line != "PROXY UNKNOWN\r\n" {
+			t.Errorf("unix连接没有IP地址，应该发送UNKNOWN: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("后端没有收到连接")
+	}
+
+	udp := syn
+	udp.Protocol = PROTO_UDP
+	udp.ProxyProtocol = ""
+	reply := child.open_data(t, udp)
+	if reply == nil || reply.Type != MSG_TYPE_ERROR || int(reply.Data.(map[string]interface{})["code"].(float64)) != ERR_CODE_PROTOCOL {
+		t.Errorf("udp连接unix socket应该回复protocol错误: %v", reply)
+	}
+
+	denied := syn
+	denied.TargetTcpAddr = "unix:/var/run/docker.sock"
+	if reply := child.open_data(t, denied); reply == nil || reply.Type != MSG_TYPE_ERROR {
+		t.Errorf("策略不允许的unix socket应该回复错误: %v", reply)
+	}
+}
+
+// 代理监听unix socket
+func TestUnixListenProxy(t *testing.T) {
+	setup_test_node()
+
+	peer := dial_test_peer(t, "unix-peer-1")
+	defer peer.close()
+	if !wait_for(t, 3*time.Second, func() bool { return fm.peers.get(peer.node_id) != nil }) {
+		t.Fatal("对端没有注册")
+	}
+	peer.accept_data(func(syn map[string]interface{}, stream quic.Stream) {
+		stream.Write([]byte(syn["target_tcp_addr"].(string) + "|"))
+		io.Copy(stream, stream)
+	})
+
+	path := filepath.Join(t.TempDir(), "pg.sock")
+	config := &Config{NodeID: "unix-listen1", Proxies: []ProxyConfig{{
+		Name:          "pg",
+		Listen:        UNIX_ADDR_PREFIX + path,
+		ListenMode:    "0660",
+		TargetNodeID:  peer.node_id,
+		TargetAddress: "unix:/var/run/postgresql/.s.PGSQL.5432",
+	}}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := tcp_proxy_listen(config.Proxies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners[0]
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go tcp_proxy_handle(conn, config.Proxies[0])
+		}
+	}()
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	want := "unix:/var/run/postgresql/.s.PGSQL.5432|hello"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != want {
+		t.Errorf("数据不正确: %q %v", buf, err)
+	}
+
+	for _, bad := range []ProxyConfig{
+		{Name: "a", Listen: "unix:relative.sock", TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "b", Listen: "/run/a.sock", TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "c", Listen: "unix:/run/a.sock", LocalPort: 80, TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "d", Listen: "unix:/run/a.sock", Protocol: PROTO_UDP, TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "e", Listen: "unix:/run/a.sock", ListenMode: "rw", TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "f", Listen: "unix:/run/a.sock", AllowClients: []string{"127.0.0.1"}, TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "g", LocalPort: 80, ListenMode: "0600", TargetNodeID: "n", TargetAddress: "127.0.0.1:1"},
+		{Name: "h", LocalPort: 80, TargetNodeID: "n", TargetAddress: "unix:x.sock"},
+	} {
+		if err := validateConfig(&Config{NodeID: "unix-listen1", Proxies: []ProxyConfig{bad}}); err == nil {
+			t.Errorf("代理%s配置应该无效", bad.Name)
+		}
+	}
+}